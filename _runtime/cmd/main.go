@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -13,6 +12,7 @@ import (
 	"os/signal"
 	"runtime/debug"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
@@ -24,6 +24,7 @@ var logger *log.Logger
 func main() {
 	// FIXME(paulsmith): detect if connected to terminal for VT100 escapes
 	logger = log.New(os.Stderr, "[\x1b[36mPUSHUP\x1b[0m] ", 0)
+	build.ErrorLog = logger
 
 	port := flag.String("port", "8080", "port to listen on with TCP IPv4")
 	unixSocket := flag.String("unix-socket", "", "path to listen on with Unix socket")
@@ -35,8 +36,12 @@ func main() {
 	mux := http.NewServeMux()
 	// TODO(paulsmith): allow these middlewares to be configurable on/off
 	var h http.Handler = http.HandlerFunc(pushupHandler)
+	if build.StreamPages {
+		h = deadlineMiddleware(h, 5*time.Second)
+	} else {
+		h = http.TimeoutHandler(h, 5 * time.Second, "")
+	}
 	h = requestLogMiddleware(h)
-	h = http.TimeoutHandler(h, 5 * time.Second, "")
 	h = panicRecoveryMiddleware(h)
 	mux.Handle("/", h)
 	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
@@ -105,16 +110,15 @@ func main() {
 }
 
 func pushupHandler(w http.ResponseWriter, r *http.Request) {
+	w = build.TrackResponse(w)
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	if r.Header.Get("HX-Request") == "true" {
 		w.Header().Set("HX-Response", "true")
 	}
 	if err := build.Respond(w, r); err != nil {
 		logger.Printf("responding with route: %v", err)
-		if errors.Is(err, build.ErrNotFound) {
-			http.NotFound(w, r)
-		} else {
-			http.Error(w, http.StatusText(500), 500)
+		if err := build.RespondWithError(w, r, err); err != nil {
+			logger.Printf("responding with error page: %v", err)
 		}
 	}
 }
@@ -132,6 +136,104 @@ func panicRecoveryMiddleware(h http.Handler) http.Handler {
 	})
 }
 
+// deadlineMiddleware limits the time to respond to a request like
+// http.TimeoutHandler, but without buffering the response, so that streamed
+// pages can be flushed to the client as they render. at the deadline, the
+// request's context is canceled and the middleware returns, with a 503
+// response if nothing was sent yet. from then on, writes and flushes by the
+// handler fail, so a slow page doesn't send any more of itself.
+func deadlineMiddleware(h http.Handler, dt time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), dt)
+		defer cancel()
+		dw := &deadlineResponseWriter{w: w, h: make(http.Header)}
+		done := make(chan struct{})
+		panicked := make(chan any, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			h.ServeHTTP(dw, r.WithContext(ctx))
+			close(done)
+		}()
+		select {
+		case p := <-panicked:
+			panic(p)
+		case <-done:
+		case <-ctx.Done():
+			dw.mu.Lock()
+			defer dw.mu.Unlock()
+			dw.timedOut = true
+			if !dw.wrote && ctx.Err() == context.DeadlineExceeded {
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			}
+		}
+	})
+}
+
+// deadlineResponseWriter writes a handler's response until the handler's
+// deadline, after which its writes fail. the handler's header is its own,
+// copied to the response when it's first written, so that the 503 at the
+// deadline doesn't race with the handler.
+type deadlineResponseWriter struct {
+	w        http.ResponseWriter
+	h        http.Header
+	mu       sync.Mutex
+	wrote    bool
+	timedOut bool
+}
+
+func (w *deadlineResponseWriter) Header() http.Header {
+	return w.h
+}
+
+// writeHeader copies the handler's header to the response the first time the
+// response is written. w.mu must be held.
+func (w *deadlineResponseWriter) writeHeader() {
+	if w.wrote {
+		return
+	}
+	w.wrote = true
+	dst := w.w.Header()
+	for k, vv := range w.h {
+		dst[k] = vv
+	}
+}
+
+func (w *deadlineResponseWriter) WriteHeader(statusCode int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut || w.wrote {
+		return
+	}
+	w.writeHeader()
+	w.w.WriteHeader(statusCode)
+}
+
+func (w *deadlineResponseWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	w.writeHeader()
+	return w.w.Write(p)
+}
+
+func (w *deadlineResponseWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return
+	}
+	if fl, ok := w.w.(http.Flusher); ok {
+		w.writeHeader()
+		fl.Flush()
+	}
+}
+
 type loggingResponseWriter struct {
 	http.ResponseWriter
 	code  int
@@ -152,11 +254,14 @@ func (w *loggingResponseWriter) WriteHeader(statusCode int) {
 	return
 }
 
+func (w *loggingResponseWriter) Write(p []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(p)
+}
+
 func (w *loggingResponseWriter) Flush() {
 	if fl, ok := w.ResponseWriter.(http.Flusher); ok {
-		if w.code == 0 {
-			w.WriteHeader(200)
-		}
+		w.wrote = true
 		fl.Flush()
 	}
 }
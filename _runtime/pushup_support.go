@@ -1,218 +1,1426 @@
 package build
 
 import (
+	"bytes"
 	"context"
 	"embed"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"io/fs"
+	"log"
 	"net/http"
+	"net/url"
+	"path"
 	"path/filepath"
-	"regexp"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 type Responder interface {
-	// TODO(paulsmith): return a pushup.Response object instead and don't take
-	// a writer
+	// Respond may return a Response in place of an error, for an outcome of
+	// a page's handler other than rendering the page.
+	// TODO(paulsmith): don't take a writer
 	Respond(http.ResponseWriter, *http.Request) error
 }
 
 // FIXME(paulsmith): add a wrapper type for easily going between a component and a http.Handler
-// TODO(paulsmith): HTTP methods? how to handle? right now, not dealt with at route level
+
+// methodResponder is implemented by pages and partials with handlers for
+// specific HTTP methods. methods returns those methods, or nil if the page
+// responds to every method.
+type methodResponder interface {
+	methods() []string
+}
 
 // NOTE(paulsmith): routing inspired by https://benhoyt.com/writings/go-routing/
 
-type routeList []*route
+// routeTree is the app's routes, compiled into a tree of their path segments
+// as they are added at init time, so that a URL path is matched in a single
+// walk down the tree instead of against every route.
+type routeTree struct {
+	root *routeNode
+	// all the routes, in the order they were added
+	all []*route
+	// the routes by their path, like "/people/:id"
+	byPath map[string]*route
+}
+
+var routes routeTree
+
+type routeRole int
+
+const (
+	routePage routeRole = iota
+	routePartial
+)
+
+func (t *routeTree) add(path string, responder Responder, role routeRole) {
+	if t.root == nil {
+		t.root = new(routeNode)
+		t.byPath = make(map[string]*route)
+	}
+	r := newRoute(path, responder, role)
+	t.root.insert(r.segments, r)
+	t.all = append(t.all, r)
+	if _, ok := t.byPath[path]; !ok {
+		t.byPath[path] = r
+	}
+}
+
+// lookup returns the most specific route that matches the URL path, and the
+// values of its dynamic segments, or nil if no route matches.
+func (t *routeTree) lookup(path string) (*route, []string) {
+	if t.root == nil || !strings.HasPrefix(path, "/") {
+		return nil, nil
+	}
+	return t.root.lookup(strings.Split(path[1:], "/"), nil)
+}
+
+// routeNode is a node of a routeTree, for a segment of the routes' paths.
+// static segments are children keyed by their text, and dynamic segments are
+// children by their kind, so that routes that differ only in the names of
+// their parameters share nodes.
+type routeNode struct {
+	static  map[string]*routeNode
+	dynamic [optionalRest + 1]*routeNode
+	// the route whose last segment this is, if any. the first route added
+	// wins, when more than one has the same segments.
+	route *route
+}
+
+func (n *routeNode) insert(segments []string, r *route) {
+	if len(segments) == 0 {
+		if n.route == nil {
+			n.route = r
+		}
+		return
+	}
+	var child *routeNode
+	if rank := rankSegment(segments[0]); rank == staticSegment {
+		if n.static == nil {
+			n.static = make(map[string]*routeNode)
+		}
+		if child = n.static[segments[0]]; child == nil {
+			child = new(routeNode)
+			n.static[segments[0]] = child
+		}
+	} else {
+		if child = n.dynamic[rank]; child == nil {
+			child = new(routeNode)
+			n.dynamic[rank] = child
+		}
+	}
+	child.insert(segments[1:], r)
+}
+
+// lookup matches the segments of a URL path against the subtree, returning
+// the route they match and the values of its dynamic segments appended to
+// vals. the children are tried from most to least specific kind of segment,
+// so that the first match is the most specific one: a static segment wins over
+// a dynamic one, a single segment over an optional one, and those over a rest
+// segment. a longer route wins over a route that ends where its optional
+// segments match nothing.
+func (n *routeNode) lookup(parts []string, vals []string) (*route, []string) {
+	if len(parts) > 0 {
+		if child := n.static[parts[0]]; child != nil {
+			if r, v := child.lookup(parts[1:], vals); r != nil {
+				return r, v
+			}
+		}
+		if child := n.dynamic[singleSegment]; child != nil && parts[0] != "" {
+			if r, v := child.lookup(parts[1:], append(vals, parts[0])); r != nil {
+				return r, v
+			}
+		}
+	}
+	if child := n.dynamic[optionalSegment]; child != nil {
+		if len(parts) > 0 && parts[0] != "" {
+			if r, v := child.lookup(parts[1:], append(vals, parts[0])); r != nil {
+				return r, v
+			}
+		}
+		if r, v := child.lookup(parts, append(vals, "")); r != nil {
+			return r, v
+		}
+	}
+	// rest segments match as many non-empty segments as they can
+	for _, rank := range []segmentRank{restSegment, optionalRest} {
+		child := n.dynamic[rank]
+		if child == nil {
+			continue
+		}
+		end := 0
+		for end < len(parts) && parts[end] != "" {
+			end++
+		}
+		for i := end; i > 0; i-- {
+			if r, v := child.lookup(parts[i:], append(vals, strings.Join(parts[:i], "/"))); r != nil {
+				return r, v
+			}
+		}
+		if rank == optionalRest {
+			if r, v := child.lookup(parts, append(vals, "")); r != nil {
+				return r, v
+			}
+		}
+	}
+	if len(parts) == 0 && n.route != nil {
+		return n.route, vals
+	}
+	return nil, nil
+}
+
+type route struct {
+	path string
+	// the segments of the path, following its leading slash
+	segments  []string
+	slugs     []string
+	responder Responder
+	role      routeRole
+	// methods the route responds to, or nil for every method
+	methods []string
+	// the route on its own, for matching it alone
+	node *routeNode
+}
+
+func newRoute(path string, responder Responder, role routeRole) *route {
+	result := new(route)
+	result.path = path
+	result.segments = strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for _, seg := range result.segments {
+		if rankSegment(seg) != staticSegment {
+			result.slugs = append(result.slugs, strings.TrimSuffix(seg[1:], "?"))
+		}
+	}
+	result.responder = responder
+	result.role = role
+	if mr, ok := responder.(methodResponder); ok {
+		result.methods = mr.methods()
+	}
+	result.node = new(routeNode)
+	result.node.insert(result.segments, result)
+	return result
+}
+
+// match reports whether the route matches the URL path, and returns the
+// values of its dynamic segments.
+func (r *route) match(path string) ([]string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	found, vals := r.node.lookup(strings.Split(path[1:], "/"), nil)
+	return vals, found != nil
+}
+
+// segmentRank orders the kinds of route segments from most to least
+// specific, for choosing between routes that match the same path. a `:name'
+// segment matches a single segment of a path and a `*name' segment one or
+// more, and either is optional with a trailing `?', in which case it may
+// match nothing, along with the slash before it.
+type segmentRank int
+
+const (
+	staticSegment   segmentRank = iota // /docs
+	singleSegment                      // /:name
+	optionalSegment                    // /:name?
+	restSegment                        // /*name, one or more segments
+	optionalRest                       // /*name?, zero or more segments
+)
+
+func rankSegment(sub string) segmentRank {
+	var rank segmentRank
+	switch {
+	case strings.HasPrefix(sub, ":"):
+		rank = singleSegment
+	case strings.HasPrefix(sub, "*"):
+		rank = restSegment
+	default:
+		return staticSegment
+	}
+	if strings.HasSuffix(sub, "?") {
+		rank++
+	}
+	return rank
+}
+
+// HTTPError is an error that responds to a request with an HTTP status code,
+// and the error page for the code, if the app has one.
+type HTTPError struct {
+	// Code is the HTTP status code.
+	Code int
+	// Message describes the error, and may be shown to users by error pages.
+	Message string
+	// Err is the error that caused this one, if any.
+	Err error
+}
+
+func (e *HTTPError) Error() string {
+	if e.Message == "" {
+		return http.StatusText(e.Code)
+	}
+	return e.Message
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+// Error returns an error for a handler to return that responds to the request
+// with the HTTP status code, like 403 Forbidden, and the message.
+func Error(code int, message string) error {
+	return &HTTPError{Code: code, Message: message}
+}
+
+// httpError returns the HTTPError for the response to a request that failed
+// with err: the one err wraps, or else a 500 Internal Server Error.
+func httpError(err error) *HTTPError {
+	var e *HTTPError
+	if !errors.As(err, &e) {
+		return &HTTPError{Code: http.StatusInternalServerError, Message: http.StatusText(http.StatusInternalServerError), Err: err}
+	}
+	if e == err {
+		return e
+	}
+	// keep the context err adds
+	return &HTTPError{Code: e.Code, Message: e.Message, Err: err}
+}
+
+var ErrNotFound = Error(http.StatusNotFound, "page not found")
+
+// ErrBadRequest is returned when a request is malformed, for example when a
+// query parameter declared with ^query has an invalid value.
+var ErrBadRequest = Error(http.StatusBadRequest, "bad request")
+
+// ErrMethodNotAllowed is returned when a page has handlers for specific HTTP
+// methods, and the request's method isn't one of them.
+var ErrMethodNotAllowed = Error(http.StatusMethodNotAllowed, "method not allowed")
+
+// MethodOverride enables overriding the method of a POST request with the
+// value of its `_method' form field, so that plain HTML forms can make PUT,
+// PATCH, and DELETE requests. set it to true in an init function in app/pkg
+// to opt in.
+var MethodOverride = false
+
+// StreamPages enables streaming pages to the client as they render. the
+// layout's output up to where it outputs the page's contents is flushed right
+// away, and the contents are written to the client as they render, rather
+// than the whole response being sent when the page is done. set it to true in
+// an init function in app/pkg to opt in.
+var StreamPages = false
+
+// ErrorLog is where the errors that ^try blocks recover from are logged. if
+// nil, they are logged with the log package's standard logger.
+var ErrorLog *log.Logger
+
+type ctxKey struct{}
+
+func Respond(w http.ResponseWriter, r *http.Request) error {
+	routeMatch := getRouteFromPath(r.URL.Path)
+	if routeMatch.response == routeNotFound && r.URL.RawPath != "" {
+		// a dynamic segment may contain an encoded slash
+		routeMatch = getRouteFromPath(r.URL.EscapedPath())
+	}
+	switch routeMatch.response {
+	case routeNotFound:
+		return ErrNotFound
+	case redirectTrailingSlash:
+		http.Redirect(w, r, routeMatch.route.path, http.StatusMovedPermanently)
+		return nil
+	case routeFound:
+		route := routeMatch.route
+		if MethodOverride {
+			r = overrideMethod(r)
+		}
+		if route.methods != nil {
+			allow := allowedMethods(route.methods)
+			if r.Method == http.MethodOptions {
+				w.Header().Set("Allow", strings.Join(allow, ", "))
+				w.WriteHeader(http.StatusNoContent)
+				return nil
+			}
+			if !containsString(allow, r.Method) {
+				w.Header().Set("Allow", strings.Join(allow, ", "))
+				return fmt.Errorf("%s %s: %w", r.Method, r.URL.Path, ErrMethodNotAllowed)
+			}
+		}
+		params, err := routeParams(route, r.URL)
+		if err != nil {
+			return err
+		}
+		if route.role == routePartial {
+			w.Header().Set("Pushup-Partial", "true")
+		}
+		// NOTE(paulsmith): since we totally control the Respond() method on
+		// the component interface, we probably should pass the params to
+		// Respond instead of wrapping the request object with context values.
+		ctx := context.WithValue(r.Context(), ctxKey{}, params)
+		ctx = context.WithValue(ctx, layoutKey{}, new(layoutOverride))
+		ctx = context.WithValue(ctx, statusKey{}, new(int))
+		r = r.WithContext(ctx)
+		if err := route.responder.Respond(w, r); err != nil {
+			var resp Response
+			if errors.As(err, &resp) {
+				return resp.respond(w, r)
+			}
+			return err
+		}
+		return nil
+	default:
+		panic("unhandled route match response")
+	}
+}
+
+// allowedMethods returns the methods a route with handlers for methods allows,
+// including the methods that are handled automatically.
+func allowedMethods(methods []string) []string {
+	allow := make([]string, 0, len(methods)+2)
+	for _, m := range methods {
+		allow = append(allow, m)
+		if m == http.MethodGet {
+			allow = append(allow, http.MethodHead)
+		}
+	}
+	return append(allow, http.MethodOptions)
+}
+
+// overrideMethod returns the request with the method from the `_method' form
+// field of a POST request, if it is one that HTML forms can't make.
+func overrideMethod(r *http.Request) *http.Request {
+	if r.Method != http.MethodPost {
+		return r
+	}
+	switch m := strings.ToUpper(r.PostFormValue("_method")); m {
+	case http.MethodPut, http.MethodPatch, http.MethodDelete:
+		r = r.WithContext(r.Context())
+		r.Method = m
+	}
+	return r
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// errorPage is a page like `_404.up' that renders the responses with its status
+// code to the requests for URL paths under its directory.
+type errorPage struct {
+	prefix    string
+	segments  []string
+	code      int
+	responder Responder
+}
+
+var errorPages []*errorPage
+
+// addErrorPage adds an error page for the status code, in the pages directory
+// with the route prefix, like "/admin" ("" for the pages directory itself).
+func addErrorPage(prefix string, code int, responder Responder) {
+	var segments []string
+	if prefix != "" {
+		segments = strings.Split(strings.TrimPrefix(prefix, "/"), "/")
+	}
+	errorPages = append(errorPages, &errorPage{
+		prefix:    prefix,
+		segments:  segments,
+		code:      code,
+		responder: responder,
+	})
+}
+
+// matches reports whether the URL path is under the error page's directory.
+func (p *errorPage) matches(path string) bool {
+	if !strings.HasPrefix(path, "/") {
+		return false
+	}
+	parts := strings.Split(path[1:], "/")
+	for i, seg := range p.segments {
+		switch rankSegment(seg) {
+		case staticSegment:
+			if i >= len(parts) || parts[i] != seg {
+				return false
+			}
+		case singleSegment:
+			if i >= len(parts) || parts[i] == "" {
+				return false
+			}
+		default:
+			// optional and rest segments match what's left of the path
+			return true
+		}
+	}
+	return true
+}
+
+// findErrorPage returns the error page for the status code in the directory
+// nearest to the URL path, or nil if there is none.
+func findErrorPage(path string, code int) *errorPage {
+	var found *errorPage
+	for _, p := range errorPages {
+		if p.code != code || !p.matches(path) {
+			continue
+		}
+		if found == nil || strings.Count(p.prefix, "/") > strings.Count(found.prefix, "/") {
+			found = p
+		}
+	}
+	return found
+}
+
+type errorKey struct{}
+
+// GetError returns the error an error page is rendering the response for, or
+// nil outside of an error page.
+func GetError(r *http.Request) *HTTPError {
+	e, _ := r.Context().Value(errorKey{}).(*HTTPError)
+	return e
+}
+
+// RespondWithError responds to a request that failed with err, with the
+// status code of the HTTPError it wraps or else 500 Internal Server Error.
+// the response is rendered by the app's error page for the status code, like
+// `app/pages/_404.up', from the directory nearest to the request's URL path.
+// without one, or if it fails, the response is plain text, and the error page's
+// error is returned. if the response has already started, as when part of a
+// streamed page was sent before it failed, err is only logged, since an error
+// response can't be sent anymore. a response is only known to have started if
+// w was wrapped by TrackResponse.
+func RespondWithError(w http.ResponseWriter, r *http.Request, err error) error {
+	if responseStarted(w) {
+		logError(fmt.Errorf("%s %s: response already started: %w", r.Method, r.URL.Path, err))
+		return nil
+	}
+	e := httpError(err)
+	var pageErr error
+	if page := findErrorPage(r.URL.Path, e.Code); page != nil {
+		if pageErr = renderErrorPage(w, r, page, e); pageErr == nil {
+			return nil
+		}
+		pageErr = fmt.Errorf("error page for %d: %w", e.Code, pageErr)
+	}
+	if e.Code == http.StatusNotFound {
+		http.NotFound(w, r)
+	} else {
+		http.Error(w, http.StatusText(e.Code), e.Code)
+	}
+	return pageErr
+}
+
+// startedWriter records whether the response has started, that is, whether
+// its header or any of its body has been written.
+type startedWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *startedWriter) WriteHeader(code int) {
+	w.started = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *startedWriter) Write(p []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap returns the wrapped writer, for http.ResponseController.
+func (w *startedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// startedFlushWriter is a startedWriter for a writer that can flush, so that
+// wrapping a writer doesn't change whether pages stream to it.
+type startedFlushWriter struct {
+	*startedWriter
+}
+
+func (w startedFlushWriter) Flush() {
+	w.started = true
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// TrackResponse wraps w to record whether the response has started, so that
+// RespondWithError doesn't write an error response into a response that
+// already started. pass the wrapped writer to both Respond and
+// RespondWithError.
+func TrackResponse(w http.ResponseWriter) http.ResponseWriter {
+	sw := &startedWriter{ResponseWriter: w}
+	if _, ok := w.(http.Flusher); ok {
+		return startedFlushWriter{sw}
+	}
+	return sw
+}
+
+// responseStarted reports whether the response to w, wrapped by
+// TrackResponse, has started.
+func responseStarted(w http.ResponseWriter) bool {
+	switch w := w.(type) {
+	case *startedWriter:
+		return w.started
+	case startedFlushWriter:
+		return w.started
+	}
+	return false
+}
+
+// renderErrorPage renders an error page. the page is buffered, so that the
+// plain text error can still be written if it fails.
+func renderErrorPage(w http.ResponseWriter, r *http.Request, page *errorPage, e *HTTPError) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	status := e.Code
+	ctx := context.WithValue(r.Context(), ctxKey{}, map[string]string{})
+	ctx = context.WithValue(ctx, layoutKey{}, new(layoutOverride))
+	ctx = context.WithValue(ctx, statusKey{}, &status)
+	ctx = context.WithValue(ctx, errorKey{}, e)
+	r = r.WithContext(ctx)
+	bw := &bufferedResponseWriter{header: make(http.Header)}
+	if err := page.responder.Respond(bw, r); err != nil {
+		var resp Response
+		if !errors.As(err, &resp) {
+			return err
+		}
+		if err := resp.respond(bw, r); err != nil {
+			return err
+		}
+	}
+	bw.writeTo(w)
+	return nil
+}
+
+// bufferedResponseWriter holds a response until it is written to another
+// http.ResponseWriter.
+type bufferedResponseWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponseWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponseWriter) Write(p []byte) (int, error) {
+	if b.code == 0 {
+		b.code = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponseWriter) WriteHeader(code int) {
+	if b.code == 0 {
+		b.code = code
+	}
+}
+
+func (b *bufferedResponseWriter) writeTo(w http.ResponseWriter) {
+	for k, v := range b.header {
+		w.Header()[k] = v
+	}
+	if b.code != 0 {
+		w.WriteHeader(b.code)
+	}
+	//nolint:errcheck
+	w.Write(b.body.Bytes())
+}
+
+// middlewares are the HTTP middleware of pages directories, from their
+// `_middleware.go' files, keyed by the directory's slash-separated path
+// relative to the pages directory ("." for the pages directory itself).
+var middlewares = make(map[string]func(http.Handler) http.Handler)
+
+func addMiddleware(dir string, mw func(http.Handler) http.Handler) {
+	middlewares[dir] = mw
+}
+
+// dirResponder responds with a page or partial through the middleware of the
+// pages directory it is in and of the directories enclosing that one.
+type dirResponder struct {
+	dir       string
+	responder Responder
+	once      sync.Once
+	handler   http.Handler
+}
+
+// withMiddleware returns a Responder for a page or partial in dir that runs
+// the directory's middleware before responding.
+func withMiddleware(dir string, responder Responder) Responder {
+	return &dirResponder{dir: dir, responder: responder}
+}
+
+// respondErrKey is the context key of the error slot that the innermost
+// handler of a middleware chain reports the responder's error in.
+type respondErrKey struct{}
+
+func (d *dirResponder) methods() []string {
+	if mr, ok := d.responder.(methodResponder); ok {
+		return mr.methods()
+	}
+	return nil
+}
+
+func (d *dirResponder) Respond(w http.ResponseWriter, r *http.Request) error {
+	// middleware is registered by init functions, so the chain can't be
+	// composed until the first request
+	d.once.Do(func() { d.handler = d.chain() })
+	if d.handler == nil {
+		return d.responder.Respond(w, r)
+	}
+	var err error
+	d.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), respondErrKey{}, &err)))
+	return err
+}
+
+// chain composes the middleware of the directory and its parents around the
+// responder, the outermost directory's first, or returns nil if there is none.
+func (d *dirResponder) chain() http.Handler {
+	var mws []func(http.Handler) http.Handler
+	for dir := d.dir; ; dir = path.Dir(dir) {
+		if mw, ok := middlewares[dir]; ok {
+			mws = append(mws, mw)
+		}
+		if dir == "." || dir == "/" {
+			break
+		}
+	}
+	if len(mws) == 0 {
+		return nil
+	}
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := d.responder.Respond(w, r)
+		if errp, ok := r.Context().Value(respondErrKey{}).(*error); ok {
+			*errp = err
+		}
+	})
+	// mws is ordered innermost first
+	for _, mw := range mws {
+		h = mw(h)
+	}
+	return h
+}
+
+type routeMatchResponse int
+
+const (
+	routeNotFound routeMatchResponse = iota
+	redirectTrailingSlash
+	routeFound
+)
+
+type routeMatch struct {
+	response routeMatchResponse
+	route    *route
+}
+
+func getRouteFromPath(path string) routeMatch {
+	if r, _ := routes.lookup(path); r != nil {
+		return routeMatch{response: routeFound, route: r}
+	}
+	// check trailing slash
+	if len(path) > 1 && path[len(path)-1] == '/' {
+		lessSlash := path[:len(path)-1]
+		if r, _ := routes.lookup(lessSlash); r != nil {
+			return routeMatch{
+				response: redirectTrailingSlash,
+				route:    &route{path: lessSlash},
+			}
+		}
+	}
+	return routeMatch{response: routeNotFound, route: nil}
+}
+
+// routeParams returns the values of the dynamic segments of the route in the
+// URL path. the values are taken from the escaped path and then decoded, so
+// that a segment may contain an encoded slash.
+func routeParams(route *route, u *url.URL) (map[string]string, error) {
+	vals, ok := route.match(u.EscapedPath())
+	if !ok {
+		// the route matched the decoded path, which has no escapes to undo
+		vals, _ = route.match(u.Path)
+		return zipMap(route.slugs, vals), nil
+	}
+	params := zipMap(route.slugs, vals)
+	for slug, val := range params {
+		unescaped, err := url.PathUnescape(val)
+		if err != nil {
+			return nil, fmt.Errorf("%w: route parameter %q: %v", ErrNotFound, slug, err)
+		}
+		params[slug] = unescaped
+	}
+	return params, nil
+}
+
+// getParam returns the value of the dynamic route segment, or the empty
+// string if the route has no such segment.
+func getParam(r *http.Request, slug string) string {
+	params, _ := r.Context().Value(ctxKey{}).(map[string]string)
+	return params[slug]
+}
+
+// bindRouteParam parses the value of the dynamic route segment into dst, for
+// a page's ^param declaration. a value that doesn't parse as dst's type means
+// the route doesn't match, so the error wraps ErrNotFound. an optional
+// segment that is absent leaves dst with its default value, and a rest
+// segment may be bound to a []string of its segments.
+func bindRouteParam(r *http.Request, slug string, dst any) error {
+	s := getParam(r, slug)
+	if s == "" {
+		return nil
+	}
+	if segments, ok := dst.(*[]string); ok {
+		*segments = strings.Split(s, "/")
+		return nil
+	}
+	if err := parseParamValue(s, dst); err != nil {
+		return fmt.Errorf("%w: route parameter %q: %v", ErrNotFound, slug, err)
+	}
+	return nil
+}
+
+// bindQueryParam parses the value of the query parameter into dst, for a
+// page's ^query declaration. a missing or empty value leaves dst with its
+// default value. an invalid value is an error wrapping ErrBadRequest. a
+// []string gets all the values of a repeated parameter.
+func bindQueryParam(r *http.Request, name string, dst any) error {
+	if values, ok := dst.(*[]string); ok {
+		if vs := r.URL.Query()[name]; len(vs) > 0 {
+			*values = vs
+		}
+		return nil
+	}
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return nil
+	}
+	if err := parseParamValue(s, dst); err != nil {
+		return fmt.Errorf("%w: query parameter %q: %v", ErrBadRequest, name, err)
+	}
+	return nil
+}
+
+// parseParamValue parses s into dst, which is a pointer to one of the types
+// that parameters may be declared as.
+func parseParamValue(s string, dst any) error {
+	var err error
+	switch dst := dst.(type) {
+	case *string:
+		*dst = s
+	case *int:
+		*dst, err = strconv.Atoi(s)
+	case *int64:
+		*dst, err = strconv.ParseInt(s, 10, 64)
+	case *uint:
+		var u uint64
+		u, err = strconv.ParseUint(s, 10, 0)
+		*dst = uint(u)
+	case *float64:
+		*dst, err = strconv.ParseFloat(s, 64)
+	case *bool:
+		// "on" is what a checkbox without a value attribute submits
+		if s == "on" {
+			*dst = true
+		} else {
+			*dst, err = strconv.ParseBool(s)
+		}
+	default:
+		panic(fmt.Sprintf("internal error: unsupported parameter type %T", dst))
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q", s)
+	}
+	return nil
+}
+
+// routeURL returns the URL path of the route with its dynamic segments filled
+// in by args, in order, for the generated URL builders. the values are
+// percent-encoded, except for the slashes between the segments of a rest
+// parameter. an optional segment whose value is a nil pointer or empty is
+// left out.
+func routeURL(route string, args ...any) string {
+	var b strings.Builder
+	for _, seg := range strings.Split(strings.TrimPrefix(route, "/"), "/") {
+		if !strings.HasPrefix(seg, ":") && !strings.HasPrefix(seg, "*") {
+			b.WriteString("/" + seg)
+			continue
+		}
+		if len(args) == 0 {
+			panic(fmt.Sprintf("internal error: missing value for route %s parameter %s", route, seg))
+		}
+		val := formatParamValue(args[0], seg[0] == '*')
+		args = args[1:]
+		if val == "" && strings.HasSuffix(seg, "?") {
+			continue
+		}
+		b.WriteString("/" + val)
+	}
+	if b.Len() == 0 {
+		return "/"
+	}
+	return b.String()
+}
+
+// formatParamValue formats the value of a route parameter as a segment of a
+// URL path, the inverse of parseParamValue. the value of a rest parameter may
+// be a string or a []string of its segments. the value of an optional
+// parameter is a pointer, and a nil pointer is empty.
+func formatParamValue(v any, rest bool) string {
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return ""
+		}
+		return formatParamValue(rv.Elem().Interface(), rest)
+	}
+	var s string
+	switch v := v.(type) {
+	case string:
+		if !rest {
+			return url.PathEscape(v)
+		}
+		return formatParamValue(strings.Split(v, "/"), rest)
+	case []string:
+		segments := make([]string, len(v))
+		for i := range v {
+			segments[i] = url.PathEscape(v[i])
+		}
+		return strings.Join(segments, "/")
+	case int:
+		s = strconv.Itoa(v)
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	case uint:
+		s = strconv.FormatUint(uint64(v), 10)
+	case float64:
+		s = strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		s = strconv.FormatBool(v)
+	default:
+		panic(fmt.Sprintf("internal error: unsupported parameter type %T", v))
+	}
+	return url.PathEscape(s)
+}
+
+type layout interface {
+	Respond(w http.ResponseWriter, req *http.Request, sections *layoutSections) error
+}
+
+var layouts = make(map[string]layout)
+
+// ErrLayoutNotFound is returned when rendering a page whose layout, chosen by
+// its ^layout directive or by SetLayout, does not exist.
+var ErrLayoutNotFound = errors.New("layout not found")
+
+// getLayout returns the layout with the given name. the empty name and "!"
+// select no layout, so the page's contents are sent as-is.
+func getLayout(name string) (layout, error) {
+	if name == "" || name == "!" {
+		return new(nilLayout), nil
+	}
+	l, ok := layouts[name]
+	if !ok {
+		names := make([]string, 0, len(layouts))
+		for n := range layouts {
+			names = append(names, strconv.Quote(n))
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("%w: %q (known layouts: %s)", ErrLayoutNotFound, name, strings.Join(names, ", "))
+	}
+	return l, nil
+}
+
+type layoutKey struct{}
+
+// layoutOverride holds the layout chosen for a request by SetLayout.
+type layoutOverride struct {
+	name string
+	set  bool
+}
+
+// SetLayout chooses the layout to render a page's contents in for this
+// request, taking precedence over the page's ^layout directive. It is meant
+// to be called from a page's ^handler block. The empty name or "!" renders
+// the page with no layout.
+func SetLayout(r *http.Request, name string) {
+	if o, ok := r.Context().Value(layoutKey{}).(*layoutOverride); ok {
+		o.name = name
+		o.set = true
+	}
+}
+
+// layoutForRequest returns the name of the layout set for the request by
+// SetLayout, if any, otherwise the name from the page's ^layout directive.
+func layoutForRequest(r *http.Request, name string) string {
+	if o, ok := r.Context().Value(layoutKey{}).(*layoutOverride); ok && o.set {
+		return o.name
+	}
+	return name
+}
+
+// Response is an outcome of a page's handler other than rendering the page,
+// like a redirect. A handler returns one in place of an error, and Pushup
+// writes it to the client instead of the page.
+type Response interface {
+	error
+	respond(w http.ResponseWriter, r *http.Request) error
+}
+
+type redirectResponse struct {
+	url  string
+	code int
+}
+
+// Redirect returns a Response that redirects the client to url with the
+// status code, which should be in the 3xx range.
+func Redirect(url string, code int) Response {
+	return &redirectResponse{url: url, code: code}
+}
+
+func (resp *redirectResponse) Error() string {
+	return fmt.Sprintf("redirect to %s", resp.url)
+}
+
+func (resp *redirectResponse) respond(w http.ResponseWriter, r *http.Request) error {
+	http.Redirect(w, r, resp.url, resp.code)
+	return nil
+}
+
+type jsonResponse struct {
+	code int
+	v    any
+}
+
+// JSON returns a Response that encodes v as JSON, with the status code.
+func JSON(code int, v any) Response {
+	return &jsonResponse{code: code, v: v}
+}
+
+func (resp *jsonResponse) Error() string {
+	return "JSON response"
+}
+
+func (resp *jsonResponse) respond(w http.ResponseWriter, r *http.Request) error {
+	// encode before writing anything, so an error can still be responded
+	// with
+	b, err := json.Marshal(resp.v)
+	if err != nil {
+		return fmt.Errorf("encoding JSON response: %w", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.code)
+	//nolint:errcheck
+	w.Write(append(b, '\n'))
+	return nil
+}
+
+type renderPageResponse struct {
+	path string
+}
+
+// RenderPage returns a Response that renders the page for the URL path in
+// place of the requested one, without redirecting the client. The page is
+// rendered as for a GET request, running its handlers.
+func RenderPage(path string) Response {
+	return &renderPageResponse{path: path}
+}
+
+func (resp *renderPageResponse) Error() string {
+	return fmt.Sprintf("render page %s", resp.path)
+}
+
+// maxRenderPages limits how many pages may render another in place of
+// themselves for a request, so that a loop of them fails.
+const maxRenderPages = 10
 
-var routes routeList
+type renderDepthKey struct{}
 
-type routeRole int
+func (resp *renderPageResponse) respond(w http.ResponseWriter, r *http.Request) error {
+	depth, _ := r.Context().Value(renderDepthKey{}).(int)
+	if depth >= maxRenderPages {
+		return fmt.Errorf("rendering page %s: more than %d pages rendered in place of others", resp.path, maxRenderPages)
+	}
+	r = r.Clone(context.WithValue(r.Context(), renderDepthKey{}, depth+1))
+	r.URL.Path = resp.path
+	r.URL.RawPath = ""
+	if r.Method != http.MethodHead {
+		r.Method = http.MethodGet
+	}
+	return Respond(w, r)
+}
 
-const (
-	routePage routeRole = iota
-	routePartial
-)
+type haltResponse struct{}
 
-func (r *routeList) add(path string, responder Responder, role routeRole) {
-	*r = append(*r, newRoute(path, responder, role))
+// Halt returns a Response that stops responding to the request without
+// rendering the page, for a handler that has written the response itself.
+func Halt() Response {
+	return haltResponse{}
 }
 
-type route struct {
-	path      string
-	regex     *regexp.Regexp
-	slugs     []string
-	responder Responder
-	role      routeRole
+func (haltResponse) Error() string {
+	return "halt"
 }
 
-func newRoute(path string, responder Responder, role routeRole) *route {
-	p := regexPatFromRoute(path)
-	result := new(route)
-	result.path = path
-	result.regex = regexp.MustCompile("^" + p.pat + "$")
-	result.slugs = p.slugs
-	result.responder = responder
-	result.role = role
-	return result
+func (haltResponse) respond(w http.ResponseWriter, r *http.Request) error {
+	return nil
 }
 
-type routePat struct {
-	pat   string
-	slugs []string
+type statusKey struct{}
+
+// SetStatus sets the HTTP status code of the response to a request, for a
+// page that renders with a status other than 200 OK. It is meant to be called
+// from a page's ^handler block.
+func SetStatus(r *http.Request, code int) {
+	if s, ok := r.Context().Value(statusKey{}).(*int); ok {
+		*s = code
+	}
 }
 
-// regexPatFromRoute produces a regular expression from a route string,
-// replacing slugs with capture groups and retaining the slugs so that HTTP
-// handlers can retrieve paramaters by slug name.
-func regexPatFromRoute(route string) routePat {
-	const match = "([^/]+)"
-	pathsubs := strings.Split(route, "/")
-	var out []string
-	var slugs []string
-	for _, sub := range pathsubs {
-		if strings.HasPrefix(sub, ":") {
-			out = append(out, match)
-			slugs = append(slugs, sub[1:])
-		} else {
-			out = append(out, sub)
-		}
+// writeStatus writes the status code set by SetStatus, if any, before a page
+// starts rendering.
+func writeStatus(w http.ResponseWriter, r *http.Request) {
+	if s, ok := r.Context().Value(statusKey{}).(*int); ok && *s != 0 {
+		w.WriteHeader(*s)
 	}
-	return routePat{strings.Join(out, "/"), slugs}
 }
 
-var ErrNotFound = errors.New("page not found")
+// layoutSections gives a layout access to the sections of the page, or of the
+// child layout, that it wraps. a section is rendered on the request's
+// goroutine when the layout first outputs it, and then remembered, so that a
+// layout and its parent layout may both output it. a section the layout
+// doesn't output is never rendered.
+type layoutSections struct {
+	sections map[string]*layoutSection
 
-type ctxKey struct{}
+	// w is the response, for the layout that streams to it. see streamTo.
+	w http.ResponseWriter
 
-func Respond(w http.ResponseWriter, r *http.Request) error {
-	routeMatch := getRouteFromPath(r.URL.Path)
-	switch routeMatch.response {
-	case routeNotFound:
-		return ErrNotFound
-	case redirectTrailingSlash:
-		http.Redirect(w, r, routeMatch.route.path, http.StatusMovedPermanently)
-		return nil
-	case routeFound:
-		route := routeMatch.route
-		matches := route.regex.FindStringSubmatch(r.URL.Path)
-		params := zipMap(route.slugs, matches[1:])
-		if route.role == routePartial {
-			w.Header().Set("Pushup-Partial", "true")
-		}
-		// NOTE(paulsmith): since we totally control the Respond() method on
-		// the component interface, we probably should pass the params to
-		// Respond instead of wrapping the request object with context values.
-		ctx := context.WithValue(r.Context(), ctxKey{}, params)
-		if err := route.responder.Respond(w, r.WithContext(ctx)); err != nil {
-			return err
-		}
-		return nil
-	default:
-		panic("unhandled route match response")
+	// child is the sections of the child layout whose contents these
+	// sections' contents are, if any.
+	child *layoutSections
+
+	// deferred are the page's deferred sections among the sections, and
+	// stream is shared by the layouts wrapping the page, so that any of them
+	// may output placeholders for the deferred sections.
+	deferred map[string]*deferredSection
+	stream   *deferredStream
+}
+
+type deferredSection struct {
+	render   func(io.Writer)
+	fallback func(io.Writer)
+}
+
+// deferredStream is the response deferred sections are streamed to after the
+// layouts, and the placeholders output for them so far.
+type deferredStream struct {
+	w       http.ResponseWriter
+	pending []deferredPlaceholder
+}
+
+type deferredPlaceholder struct {
+	id      string
+	section *deferredSection
+}
+
+type layoutSection struct {
+	render func(io.Writer)
+	done   bool
+	html   template.HTML
+}
+
+func newLayoutSections() *layoutSections {
+	return &layoutSections{sections: make(map[string]*layoutSection), stream: new(deferredStream)}
+}
+
+// add adds a section, rendered by render when it is first output.
+func (s *layoutSections) add(name string, render func(io.Writer)) {
+	s.sections[name] = &layoutSection{render: render}
+}
+
+// addDeferred adds a section declared with `^section name defer'. a layout
+// streaming to the client doesn't wait for it, but outputs a placeholder with
+// its fallback markup, if any, and the section is streamed after the layout
+// with an inline script that swaps it into its placeholder. it's rendered in
+// order like any other section for clients that wait for the whole response
+// anyway, like htmx, or that can't be streamed to.
+func (s *layoutSections) addDeferred(r *http.Request, name string, render func(io.Writer), fallback func(io.Writer)) {
+	s.add(name, render)
+	if !r.ProtoAtLeast(1, 1) || r.Header.Get("HX-Request") == "true" {
+		return
+	}
+	if s.deferred == nil {
+		s.deferred = make(map[string]*deferredSection)
 	}
+	s.deferred[name] = &deferredSection{render: render, fallback: fallback}
 }
 
-func mostSpecificMatch(routes []*route, path string) *route {
-	if len(routes) == 1 {
-		return routes[0]
+// streamTo makes the page's contents stream to w when StreamPages is enabled.
+// it's called by the layout that writes to the response, and not to its
+// parent layout. its child layouts stream the contents too, when it outputs
+// them to the response. deferred sections stream to w whichever layout
+// outputs them.
+func (s *layoutSections) streamTo(w http.ResponseWriter) {
+	if StreamPages {
+		s.w = w
+		s.stream.w = w
 	}
+}
 
-	most := routes[0]
+// defined reports whether the section was set by the page or a child layout.
+func (s *layoutSections) defined(name string) bool {
+	_, ok := s.sections[name]
+	return ok
+}
 
-	for _, route := range routes[1:] {
-		if len(route.slugs) < len(most.slugs) {
-			most = route
+// output returns the section, rendering it the first time. an undefined
+// section is empty. streamed contents are written to the response as they
+// render, after flushing the layout's output so far, and so are empty where
+// they are output, and aren't remembered.
+func (s *layoutSections) output(name string) template.HTML {
+	sec, ok := s.sections[name]
+	if !ok {
+		return ""
+	}
+	if html, ok := s.placeholder(name); ok {
+		return html
+	}
+	if sec.done {
+		return sec.html
+	}
+	sec.done = true
+	if s.w != nil && name == "contents" {
+		if s.child != nil {
+			// the child layout writes straight to the response, so it
+			// streams the page's contents too
+			s.child.w = s.w
 		}
+		flushOutput(s.w)
+		sec.render(s.w)
+		return ""
 	}
+	b := getBuffer()
+	defer putBuffer(b)
+	sec.render(b)
+	sec.html = template.HTML(b.String())
+	return sec.html
+}
 
-	return most
+// placeholder returns the markup output in place of a deferred section, with
+// its fallback, and marks the section to be streamed after the layouts into
+// the placeholder. each placeholder has its own id, since a section may be
+// output more than once. sections are only deferred when streaming to the
+// client.
+func (s *layoutSections) placeholder(name string) (template.HTML, bool) {
+	sec, ok := s.deferred[name]
+	if !ok {
+		return "", false
+	}
+	if _, ok := s.stream.w.(http.Flusher); !ok {
+		return "", false
+	}
+	id := "pushup-deferred-" + name
+	if n := s.stream.count(sec); n > 0 {
+		id = fmt.Sprintf("%s-%d", id, n+1)
+	}
+	s.stream.pending = append(s.stream.pending, deferredPlaceholder{id: id, section: sec})
+	b := getBuffer()
+	defer putBuffer(b)
+	if sec.fallback != nil {
+		sec.fallback(b)
+	}
+	return template.HTML(fmt.Sprintf(`<pushup-deferred id="%s">%s</pushup-deferred>`, id, b)), true
 }
 
-type routeMatchResponse int
+// count returns the number of placeholders output for the section so far.
+func (d *deferredStream) count(sec *deferredSection) int {
+	var n int
+	for _, p := range d.pending {
+		if p.section == sec {
+			n++
+		}
+	}
+	return n
+}
 
-const (
-	routeNotFound routeMatchResponse = iota
-	redirectTrailingSlash
-	routeFound
-)
+// the script that swaps a streamed deferred section into its placeholder
+const deferredSwapScript = `<script>(function(t,p){if(p){p.replaceWith(t.content)}t.remove()})(document.getElementById("%[1]s-content"),document.getElementById("%[1]s"))</script>`
 
-type routeMatch struct {
-	response routeMatchResponse
-	route    *route
+// streamDeferred renders the deferred sections the layouts output
+// placeholders for, and writes each to w as soon as it's rendered. a section
+// output more than once is rendered once, and sent for each placeholder.
+func (s *layoutSections) streamDeferred(w io.Writer) {
+	if len(s.stream.pending) == 0 {
+		return
+	}
+	// the rest of the layout goes out before rendering the sections
+	flushOutput(w)
+	rendered := make(map[*deferredSection]string)
+	for _, p := range s.stream.pending {
+		html, ok := rendered[p.section]
+		if !ok {
+			b := getBuffer()
+			p.section.render(b)
+			html = b.String()
+			putBuffer(b)
+			rendered[p.section] = html
+		}
+		fmt.Fprintf(w, `<template id="%s-content">%s</template>`, p.id, html)
+		fmt.Fprintf(w, deferredSwapScript, p.id)
+		flushOutput(w)
+	}
 }
 
-func getRouteFromPath(path string) routeMatch {
-	var matchedRoutes []*route
+// forParent returns the sections a layout passes to its parent layout: its
+// own contents and sections, plus the sections it was given that it doesn't
+// override, which are rendered when the parent outputs them. the deferred
+// sections it doesn't override stay deferred, streamed to the same response.
+func (s *layoutSections) forParent(contents func(io.Writer), own map[string]func(io.Writer)) *layoutSections {
+	parent := newLayoutSections()
+	parent.stream = s.stream
+	parent.child = s
+	for name := range s.sections {
+		name := name
+		parent.add(name, func(w io.Writer) {
+			io.WriteString(w, string(s.output(name)))
+		})
+	}
+	for name, sec := range s.deferred {
+		if _, ok := own[name]; ok || name == "contents" {
+			continue
+		}
+		if parent.deferred == nil {
+			parent.deferred = make(map[string]*deferredSection)
+		}
+		parent.deferred[name] = sec
+	}
+	for name, render := range own {
+		parent.add(name, render)
+	}
+	parent.add("contents", contents)
+	return parent
+}
 
-	for _, r := range routes {
-		if r.regex.MatchString(path) {
-			matchedRoutes = append(matchedRoutes, r)
+// respondWithLayout renders a page's sections with its layout, and then its
+// deferred sections. a panic while rendering is returned as an error.
+func respondWithLayout(l layout, w http.ResponseWriter, req *http.Request, sections *layoutSections) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic rendering page: %v", r)
 		}
+	}()
+	if err := l.Respond(w, req, sections); err != nil {
+		return fmt.Errorf("responding with layout: %w", err)
 	}
+	sections.streamDeferred(w)
+	return nil
+}
 
-	if len(matchedRoutes) == 0 {
-		// check trailing slash
-		if path[len(path)-1] == '/' {
-			lessSlash := path[:len(path)-1]
-			for _, r := range routes {
-				if r.regex.MatchString(lessSlash) {
-					return routeMatch{
-						response: redirectTrailingSlash,
-						route:    &route{path: lessSlash},
-					}
+// tryRender renders a ^try block to w. the block is rendered to a buffer
+// first, so that if it panics none of its output is sent, and the panic is
+// logged with pos, the position of the block in its .up file, and returned as
+// an error for the ^catch block to render in its place.
+func tryRender(w io.Writer, pos string, render func(io.Writer)) (err error) {
+	b := getBuffer()
+	defer putBuffer(b)
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				if e, ok := r.(error); ok {
+					err = fmt.Errorf("%s: panic: %w", pos, e)
+				} else {
+					err = fmt.Errorf("%s: panic: %v", pos, r)
 				}
 			}
-		}
+		}()
+		render(b)
+	}()
+	if err != nil {
+		logError(err)
+		return err
 	}
+	b.WriteTo(w)
+	return nil
+}
 
-	if len(matchedRoutes) == 0 {
-		return routeMatch{response: routeNotFound, route: nil}
+// logError logs an error to ErrorLog, or to the standard logger without one.
+func logError(err error) {
+	if ErrorLog != nil {
+		ErrorLog.Print(err)
+	} else {
+		log.Print(err)
 	}
+}
 
-	return routeMatch{response: routeFound, route: mostSpecificMatch(matchedRoutes, path)}
+// buffers for rendering sections are pooled, since every page renders some
+var bufferPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
 }
 
-func getParam(r *http.Request, slug string) string {
-	params := r.Context().Value(ctxKey{}).(map[string]string)
-	return params[slug]
+func putBuffer(b *bytes.Buffer) {
+	b.Reset()
+	bufferPool.Put(b)
 }
 
-type layout interface {
-	Respond(w http.ResponseWriter, req *http.Request, sections map[string]chan template.HTML) error
+// flushOutput sends what has been rendered to w so far on its way to the
+// client, at a ^flush or before a layout outputs the page's contents. it does
+// nothing unless StreamPages is enabled, or if w is buffered.
+func flushOutput(w io.Writer) {
+	if !StreamPages {
+		return
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
 }
 
-var layouts = make(map[string]layout)
+type layoutChainKey struct{}
 
-func getLayout(name string) layout {
-	if name == "" {
-		return new(nilLayout)
+// getParentLayout returns the parent of the named layout. the returned request
+// records the chain of layouts wrapping the page, so that layouts whose
+// ^layout directives form a cycle fail with an error instead of recursing
+// forever.
+func getParentLayout(req *http.Request, name string, parent string) (layout, *http.Request, error) {
+	chain, _ := req.Context().Value(layoutChainKey{}).([]string)
+	chain = append(chain[:len(chain):len(chain)], name)
+	for _, n := range chain {
+		if n == parent {
+			return nil, nil, fmt.Errorf("layout cycle: %s -> %s", strings.Join(chain, " -> "), parent)
+		}
 	}
-	l, ok := layouts[name]
-	if !ok {
-		panic("couldn't find layout " + name)
+	l, err := getLayout(parent)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parent of layout %q: %w", name, err)
 	}
-	return l
+	return l, req.WithContext(context.WithValue(req.Context(), layoutChainKey{}, chain)), nil
 }
 
 type nilLayout int
 
-func (l *nilLayout) Respond(w http.ResponseWriter, req *http.Request, sections map[string]chan template.HTML) error {
-	select {
-	case contents := <-sections["contents"]:
-		printEscaped(w, contents)
-	case <-req.Context().Done():
-	}
+func (l *nilLayout) Respond(w http.ResponseWriter, req *http.Request, sections *layoutSections) error {
+	sections.streamTo(w)
+	printEscaped(w, sections.output("contents"))
 	return nil
 }
 
 func Admin(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	fmt.Fprintf(w, "<h1>Routes</h1>\n<ul>\n")
-	for _, route := range routes {
+	for _, route := range routes.all {
 		fmt.Fprintf(w, "\t<li>%s</li>\n", route.path)
 	}
 	fmt.Fprintf(w, "</ul>\n")
@@ -226,26 +1434,462 @@ func zipMap[K comparable, V any](ks []K, vs []V) map[K]V {
 	return m
 }
 
+// HTMLRenderer is implemented by types that control how they are rendered
+// when they are the value of an expression in a Pushup page. RenderHTML writes
+// the value as HTML to w; it is trusted and not escaped when output in HTML
+// text. elsewhere, like in attribute values, the HTML is escaped for the
+// context.
+//
+// user types don't need to import this package to implement it, any type
+// with a RenderHTML method of this signature satisfies it.
+type HTMLRenderer interface {
+	RenderHTML(w io.Writer) error
+}
+
+// renderHTML renders the value to w, panicking on error. the panic is
+// recovered by the generated page code and returned as an error from the
+// page's Respond method.
+func renderHTML(w io.Writer, r HTMLRenderer) {
+	if err := r.RenderHTML(w); err != nil {
+		panic(fmt.Errorf("rendering %T: %w", r, err))
+	}
+}
+
+// printEscaped prints the value to w, escaped for HTML text.
 func printEscaped(w io.Writer, val any) {
 	switch val := val.(type) {
-	case string:
-		//nolint:errcheck
-		io.WriteString(w, template.HTMLEscapeString(val))
-	case fmt.Stringer:
-		//nolint:errcheck
-		io.WriteString(w, template.HTMLEscapeString(val.String()))
-	case []byte:
-		template.HTMLEscape(w, val)
-	case int:
-		//nolint:errcheck
-		io.WriteString(w, strconv.Itoa(val))
+	case HTMLRenderer:
+		renderHTML(w, val)
 	case template.HTML:
 		//nolint:errcheck
 		io.WriteString(w, string(val))
+	case []byte:
+		template.HTMLEscape(w, val)
 	default:
 		//nolint:errcheck
-		io.WriteString(w, template.HTMLEscapeString(fmt.Sprint(val)))
+		io.WriteString(w, template.HTMLEscapeString(stringify(val)))
+	}
+}
+
+// printRaw prints the value to w without escaping, for ^raw(...).
+func printRaw(w io.Writer, val any) {
+	if r, ok := val.(HTMLRenderer); ok {
+		renderHTML(w, r)
+		return
+	}
+	//nolint:errcheck
+	io.WriteString(w, stringify(val))
+}
+
+// printEscapedWith prints the value to w after applying the escapers in order.
+// it is used for values output in contexts other than HTML text, like
+// attribute values, URLs, JS, and CSS, where the Pushup compiler determines
+// the escapers from the context.
+func printEscapedWith(w io.Writer, val any, escapers ...func(any) string) {
+	var s string
+	for i, escaper := range escapers {
+		if i == 0 {
+			s = escaper(val)
+		} else {
+			s = escaper(s)
+		}
+	}
+	//nolint:errcheck
+	io.WriteString(w, s)
+}
+
+// filterFailsafe is output in place of values that are unsafe in the context
+// they appear in. it is the same as html/template's, to make it easy to search
+// for.
+const filterFailsafe = "ZgotmplZ"
+
+// stringify returns the string form of a value to be output. common types
+// are formatted directly, without going through fmt.
+func stringify(val any) string {
+	switch val := val.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case template.HTML:
+		return string(val)
+	case template.HTMLAttr:
+		return string(val)
+	case template.URL:
+		return string(val)
+	case template.JS:
+		return string(val)
+	case template.JSStr:
+		return string(val)
+	case template.CSS:
+		return string(val)
+	case []byte:
+		return string(val)
+	case bool:
+		return strconv.FormatBool(val)
+	case int:
+		return strconv.Itoa(val)
+	case int8:
+		return strconv.FormatInt(int64(val), 10)
+	case int16:
+		return strconv.FormatInt(int64(val), 10)
+	case int32:
+		return strconv.FormatInt(int64(val), 10)
+	case int64:
+		return strconv.FormatInt(val, 10)
+	case uint:
+		return strconv.FormatUint(uint64(val), 10)
+	case uint8:
+		return strconv.FormatUint(uint64(val), 10)
+	case uint16:
+		return strconv.FormatUint(uint64(val), 10)
+	case uint32:
+		return strconv.FormatUint(uint64(val), 10)
+	case uint64:
+		return strconv.FormatUint(val, 10)
+	case uintptr:
+		return strconv.FormatUint(uint64(val), 10)
+	case float32:
+		return strconv.FormatFloat(float64(val), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(val, 'g', -1, 64)
+	case time.Time:
+		return val.Format(time.RFC3339)
+	case HTMLRenderer:
+		var b strings.Builder
+		renderHTML(&b, val)
+		return b.String()
+	case fmt.Stringer:
+		return val.String()
+	case error:
+		return val.Error()
+	}
+	// pointers are followed to the value they point to, with nil pointers
+	// output as empty, like a nil value
+	if rv := reflect.ValueOf(val); rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return ""
+		}
+		return stringify(rv.Elem().Interface())
+	}
+	return fmt.Sprint(val)
+}
+
+// escapeHTMLAttr escapes a value in a quoted attribute value. HTML is not
+// trusted in an attribute and is escaped like any other string.
+func escapeHTMLAttr(val any) string {
+	return template.HTMLEscapeString(stringify(val))
+}
+
+// escapeHTMLNospace escapes a value in an unquoted attribute value, where
+// whitespace and other characters would end the value.
+func escapeHTMLNospace(val any) string {
+	s := stringify(val)
+	if s == "" {
+		return filterFailsafe
+	}
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case 0:
+			b.WriteString("&#xfffd;")
+		case '\t', '\n', '\f', '\r', ' ', '"', '\'', '+', '=', '`':
+			fmt.Fprintf(&b, "&#%d;", r)
+		case '&':
+			b.WriteString("&amp;")
+		case '<':
+			b.WriteString("&lt;")
+		case '>':
+			b.WriteString("&gt;")
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// escapeHTMLAttrName filters a value used as (part of) an attribute name. the
+// name must be plain, it can't introduce an attribute whose value is a URL,
+// JS, or CSS, since the compiler wouldn't have escaped the value as such.
+func escapeHTMLAttrName(val any) string {
+	if attr, ok := val.(template.HTMLAttr); ok {
+		return string(attr)
+	}
+	s := strings.ToLower(stringify(val))
+	if !isPlainAttrName(s) {
+		return filterFailsafe
+	}
+	if name := attrContentName(s); strings.HasPrefix(name, "on") || name == "style" || isURLAttrName(name) {
+		return filterFailsafe
+	}
+	return s
+}
+
+// attrContentName returns the part of the lowercase attribute name that
+// decides the kind of content of its value, like the compiler does: the name
+// without a "data-" prefix, and then without a namespace prefix like
+// "xlink:". the value of an xmlns attribute, with or without a prefix, is a
+// URL.
+func attrContentName(name string) string {
+	name = strings.TrimPrefix(name, "data-")
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		if name[:i] == "xmlns" {
+			return "xmlns"
+		}
+		name = name[i+1:]
+	}
+	return name
+}
+
+func isURLAttrName(name string) bool {
+	switch name {
+	case "action", "background", "cite", "codebase", "formaction", "href",
+		"icon", "longdesc", "manifest", "poster", "src", "srcset", "usemap",
+		"xmlns":
+		return true
+	}
+	return strings.Contains(name, "src") || strings.Contains(name, "uri") || strings.Contains(name, "url")
+}
+
+// printCondAttr prints a conditional attribute to w, with a leading space,
+// depending on the value: nothing if the value is false, nil, or empty, the
+// name alone if the value is true, otherwise the name and the value escaped
+// with the escapers.
+func printCondAttr(w io.Writer, name string, val any, escapers ...func(any) string) {
+	if b, ok := val.(bool); ok {
+		if b {
+			//nolint:errcheck
+			io.WriteString(w, " "+name)
+		}
+		return
+	}
+	if stringify(val) == "" {
+		return
+	}
+	//nolint:errcheck
+	io.WriteString(w, " "+name+`="`)
+	printEscapedWith(w, val, escapers...)
+	//nolint:errcheck
+	io.WriteString(w, `"`)
+}
+
+// printSpreadAttrs prints the entries of the map as attributes to w, in
+// order by name. names in static are of attributes already in the start tag,
+// which take precedence. values are treated as in conditional attributes, and
+// escaped according to the kind of attribute. invalid names are skipped.
+func printSpreadAttrs[V any](w io.Writer, attrs map[string]V, static ...string) {
+	seen := make(map[string]bool, len(static)+len(attrs))
+	for _, name := range static {
+		seen[name] = true
+	}
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lower := strings.ToLower(name)
+		if seen[lower] || !isPlainAttrName(lower) {
+			continue
+		}
+		seen[lower] = true
+		printCondAttr(w, lower, attrs[name], attrValueEscapers(lower)...)
+	}
+}
+
+// attrValueEscapers returns the escapers for the value of the attribute,
+// according to the kind of content of the value.
+func attrValueEscapers(name string) []func(any) string {
+	name = attrContentName(name)
+	switch {
+	case strings.HasPrefix(name, "on"):
+		return []func(any) string{escapeJSVal, escapeHTMLAttr}
+	case name == "style":
+		return []func(any) string{filterCSS, escapeHTMLAttr}
+	case isURLAttrName(name):
+		return []func(any) string{filterURL, normalizeURL, escapeHTMLAttr}
+	}
+	return []func(any) string{escapeHTMLAttr}
+}
+
+// isPlainAttrName reports whether the lowercase name is safe to output as an
+// attribute name.
+func isPlainAttrName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !('a' <= r && r <= 'z' || '0' <= r && r <= '9' || r == '-' || r == '_' || r == ':') {
+			return false
+		}
+	}
+	return true
+}
+
+// filterURL filters a value at the start of a URL attribute value, replacing
+// URLs with unsafe schemes like "javascript:" with a failsafe. template.URL
+// values are trusted.
+func filterURL(val any) string {
+	if u, ok := val.(template.URL); ok {
+		return string(u)
+	}
+	s := stringify(val)
+	if i := strings.IndexAny(s, ":/?#"); i >= 0 && s[i] == ':' {
+		switch strings.ToLower(s[:i]) {
+		case "http", "https", "mailto":
+		default:
+			return "#" + filterFailsafe
+		}
+	}
+	return s
+}
+
+// normalizeURL percent-encodes the characters of a value in a URL that are
+// not allowed in URLs, leaving reserved characters and existing escapes alone.
+func normalizeURL(val any) string {
+	return processURL(stringify(val), true)
+}
+
+// escapeURL percent-encodes a value in the query or fragment of a URL.
+func escapeURL(val any) string {
+	return processURL(stringify(val), false)
+}
+
+func processURL(s string, norm bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '!', '#', '$', '&', '*', '+', ',', '/', ':', ';', '=', '?', '@', '[', ']':
+			if norm {
+				b.WriteByte(c)
+				continue
+			}
+		case '-', '.', '_', '~':
+			b.WriteByte(c)
+			continue
+		case '%':
+			if norm {
+				b.WriteByte(c)
+				continue
+			}
+		default:
+			if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+				b.WriteByte(c)
+				continue
+			}
+		}
+		fmt.Fprintf(&b, "%%%02x", c)
+	}
+	return b.String()
+}
+
+// escapeJSVal converts a value in JS code to a JS value, by encoding it as
+// JSON. template.JS values are trusted.
+func escapeJSVal(val any) string {
+	switch v := val.(type) {
+	case template.JS:
+		return string(v)
+	case template.JSStr:
+		return `"` + string(v) + `"`
+	case json.Marshaler:
+	case fmt.Stringer:
+		val = v.String()
+	}
+	b, err := json.Marshal(val)
+	if err != nil {
+		// the error message is not output, it could contain "*/"
+		return " /* could not marshal value to JSON */null "
+	}
+	// pad with spaces so the value can't join with adjacent tokens, like
+	// turning a division into a comment
+	return " " + string(b) + " "
+}
+
+// escapeJSStr escapes a value in a JS string, template literal, or comment.
+// template.JSStr values are trusted.
+func escapeJSStr(val any) string {
+	if s, ok := val.(template.JSStr); ok {
+		return string(s)
+	}
+	s := stringify(val)
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r < ' ', r == '\u2028', r == '\u2029':
+			fmt.Fprintf(&b, `\u%04x`, r)
+		case strings.ContainsRune("\"'`\\/<>&=+$", r):
+			fmt.Fprintf(&b, `\u%04x`, r)
+		default:
+			b.WriteRune(r)
+		}
 	}
+	return b.String()
+}
+
+// escapeJSRegexp escapes a value in a JS regular expression literal, so that
+// it matches itself literally.
+func escapeJSRegexp(val any) string {
+	s := stringify(val)
+	if s == "" {
+		// keep the literal from becoming a "//" comment
+		return "(?:)"
+	}
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r < ' ', r == '\u2028', r == '\u2029':
+			fmt.Fprintf(&b, `\u%04x`, r)
+		case strings.ContainsRune("\"'`\\/<>&=+$", r):
+			fmt.Fprintf(&b, `\u%04x`, r)
+		case strings.ContainsRune(".*?^|()[]{}-", r):
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// filterCSS filters a value in CSS, replacing values that could change the
+// meaning of the stylesheet with a failsafe. template.CSS values are trusted.
+func filterCSS(val any) string {
+	if css, ok := val.(template.CSS); ok {
+		return string(css)
+	}
+	s := stringify(val)
+	for _, r := range s {
+		switch r {
+		case 0, '"', '\'', '(', ')', '/', ';', '@', '[', '\\', ']', '`', '{', '}', '<', '>', '!':
+			return filterFailsafe
+		}
+	}
+	lower := strings.ToLower(s)
+	if strings.Contains(lower, "expression") || strings.Contains(lower, "mozbinding") {
+		return filterFailsafe
+	}
+	return s
+}
+
+// escapeCSS escapes a value in a CSS string or comment.
+func escapeCSS(val any) string {
+	s := stringify(val)
+	var b strings.Builder
+	for i, r := range s {
+		switch r {
+		case 0, '\t', '\n', '\f', '\r', '"', '&', '\'', '(', ')', '+', '/', ':', ';', '<', '>', '\\', '{', '}', '*':
+			fmt.Fprintf(&b, `\%x`, r)
+			// a hex digit or space following the escape would be taken
+			// as part of it
+			if next := i + utf8.RuneLen(r); next < len(s) && strings.IndexByte("0123456789abcdefABCDEF \t\n\f\r", s[next]) >= 0 {
+				b.WriteByte(' ')
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
 }
 
 // {{if .EmbedStatic}}
@@ -274,7 +1918,10 @@ func GetStaticContents(path string) []byte {
 	return data
 }
 
-//go:embed src
+// the all: prefix embeds page sources named with a leading underscore, like
+// `_404.up', too
+//
+//go:embed all:src
 var source embed.FS
 
 // GetPageSource gets the source code of the Pushup page at the path. Assumes
@@ -309,81 +1956,36 @@ func displayPartialHere(mainRoute string, partialPath string, requestPath string
 	} else {
 		path = mainRoute + partialPath
 	}
-	match := getRouteFromPath(path)
-	if match.response == routeFound {
-		return matchURLPathSegmentPrefix(match.route.regex, requestPath)
+	if route, ok := routes.byPath[path]; ok {
+		return matchURLPathSegmentPrefix(route, requestPath)
 	}
 	panic("internal error: unexpected path")
 }
 
 // matchURLPathSegmentPrefix reports whether a string in the form of a URL
-// path matches as a prefix of a regex that is potentially shorter (in terms
+// path matches as a prefix of a route that is potentially longer (in terms
 // of number of URL path segments) than the string.
-func matchURLPathSegmentPrefix(re *regexp.Regexp, s string) bool {
-	res := re.String()
-	// strip off matching start of string
-	if res[0] == '^' {
-		res = res[1:]
-	}
-	// strip off matching end of string
-	if res[len(res)-1] == '$' {
-		res = res[:len(res)-1]
-	}
-	var reSegments []string
-	var state int
-	const (
-		stateStart int = iota
-		stateInCapture
-	)
-	var accum []rune
-	for _, r := range res {
-		switch state {
-		case stateStart:
-			if r == '/' {
-				if len(accum) > 0 {
-					reSegments = append(reSegments, string(accum))
-					accum = accum[:0]
-				}
-			} else if r == '(' {
-				state = stateInCapture
-			} else {
-				accum = append(accum, r)
-			}
-		case stateInCapture:
-			if r == ')' {
-				if len(accum) > 0 {
-					reSegments = append(reSegments, string(accum))
-					accum = accum[:0]
-					state = stateStart
-				}
-			} else {
-				accum = append(accum, r)
-			}
-		default:
-			panic("unhandled state")
-		}
+func matchURLPathSegmentPrefix(route *route, s string) bool {
+	var segments, parts []string
+	if p := strings.Trim(route.path, "/"); p != "" {
+		segments = strings.Split(p, "/")
 	}
-	if len(accum) > 0 {
-		reSegments = append(reSegments, string(accum))
+	if s = strings.Trim(s, "/"); s != "" {
+		parts = strings.Split(s, "/")
 	}
-	var segments []string
-	s = strings.Trim(s, "/")
-	if s != "" {
-		segments = strings.Split(s, "/")
-	}
-	for i := 0; i < min(len(reSegments), len(segments)); i++ {
-		reseg := reSegments[i]
-		seg := segments[i]
-		if !regexp.MustCompile(reseg).MatchString(seg) {
+	for i, part := range parts {
+		if i == len(segments) {
 			return false
 		}
+		switch rankSegment(segments[i]) {
+		case staticSegment:
+			if part != segments[i] {
+				return false
+			}
+		case restSegment, optionalRest:
+			// the rest of the string is matched by the segment
+			return true
+		}
 	}
-	return len(segments) <= len(reSegments)
-}
-
-func min(a int, b int) int {
-	if a < b {
-		return a
-	}
-	return b
+	return true
 }
@@ -1,95 +1,156 @@
 package build
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
 	"net/http"
-	"regexp"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 )
 
-func TestRegexPatFromRoute(t *testing.T) {
+func TestRouteTreeLookup(t *testing.T) {
 	tests := []struct {
-		route string
-		want  routePat
+		routes []string
+		path   string
+		want   int
+		vals   []string
 	}{
 		{
+			[]string{"/"},
 			"/",
-			routePat{"/", nil},
+			0,
+			nil,
 		},
 		{
-			"/foo",
-			routePat{"/foo", nil},
+			[]string{"/:id", "/new"},
+			"/new",
+			1,
+			nil,
 		},
 		{
-			"/:foo",
-			routePat{"/([^/]+)", []string{"foo"}},
+			[]string{"/new", "/:id"},
+			"/42",
+			1,
+			[]string{"42"},
 		},
 		{
-			"/:foo/bar",
-			routePat{"/([^/]+)/bar", []string{"foo"}},
+			[]string{"/:name/:thing1/:thing2", "/:name/foo/baz"},
+			"/foo/bar/baz",
+			0,
+			[]string{"foo", "bar", "baz"},
 		},
 		{
-			"/foo/:bar",
-			routePat{"/foo/([^/]+)", []string{"bar"}},
+			[]string{"/:name/:thing1/:thing2", "/:name/bar/baz"},
+			"/foo/bar/baz",
+			1,
+			[]string{"foo"},
 		},
 		{
-			"/foo/:bar/:quux",
-			routePat{"/foo/([^/]+)/([^/]+)", []string{"bar", "quux"}},
+			[]string{"/docs/*path", "/docs/:page", "/docs/intro"},
+			"/docs/intro",
+			2,
+			nil,
 		},
 		{
-			"/:foo/bar/:quux",
-			routePat{"/([^/]+)/bar/([^/]+)", []string{"foo", "quux"}},
+			[]string{"/docs/*path", "/docs/:page", "/docs/intro"},
+			"/docs/guide",
+			1,
+			[]string{"guide"},
 		},
-	}
-
-	for _, test := range tests {
-		t.Run("", func(t *testing.T) {
-			got := regexPatFromRoute(test.route)
-			diff := cmp.Diff(test.want, got, cmp.AllowUnexported(routePat{}))
-			if diff != "" {
-				t.Errorf("(-want, +got)\n%s", diff)
-			}
-		})
-	}
-}
-
-func TestMostSpecificMatch(t *testing.T) {
-	tests := []struct {
-		routes []*route
-		path   string
-		want   int
-	}{
 		{
-			[]*route{
-				newRoute("/", nil, routePage),
-			},
-			"/",
+			[]string{"/docs/*path", "/docs/:page", "/docs/intro"},
+			"/docs/guide/install",
 			0,
+			[]string{"guide/install"},
 		},
 		{
-			[]*route{
-				newRoute("/:id", nil, routePage),
-				newRoute("/new", nil, routePage),
-			},
-			"/new",
+			[]string{"/docs/*path", "/docs/:page/edit"},
+			"/docs/intro/edit",
 			1,
+			[]string{"intro"},
 		},
 		{
-			[]*route{
-				newRoute("/:name/:thing1/:thing2", nil, routePage),
-				newRoute("/:name/foo/baz", nil, routePage),
-			},
-			"/foo/bar/baz",
+			[]string{"/archive/:year?", "/archive/:year", "/*path?"},
+			"/archive/2020",
+			1,
+			[]string{"2020"},
+		},
+		{
+			[]string{"/archive/:year?", "/archive/:year", "/*path?"},
+			"/archive",
+			0,
+			[]string{""},
+		},
+		{
+			[]string{"/archive", "/archive/:year?"},
+			"/archive",
 			1,
+			[]string{""},
+		},
+		{
+			[]string{"/files/*path?/edit"},
+			"/files/a/edit/edit",
+			0,
+			[]string{"a/edit"},
+		},
+		{
+			[]string{"/files/*path?/edit"},
+			"/files/edit",
+			0,
+			[]string{""},
+		},
+		{
+			[]string{"/people/", "/people/:id"},
+			"/people/",
+			0,
+			nil,
+		},
+		{
+			[]string{"/about", "/:id", "/*path"},
+			"/about/",
+			-1,
+			nil,
+		},
+		{
+			[]string{"/:id", "/*path"},
+			"/a//b",
+			-1,
+			nil,
 		},
 	}
 
 	for _, test := range tests {
-		t.Run("", func(t *testing.T) {
-			got := mostSpecificMatch(test.routes, test.path)
-			if want := test.routes[test.want]; want != got {
-				t.Errorf("want %v, got %v", want, got)
+		t.Run(test.path, func(t *testing.T) {
+			var tree routeTree
+			for _, r := range test.routes {
+				tree.add(r, nil, routePage)
+			}
+			got, vals := tree.lookup(test.path)
+			if test.want < 0 {
+				if got != nil {
+					t.Fatalf("want no match, got %s", got.path)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatalf("want %s, got no match", test.routes[test.want])
+			}
+			if want := tree.all[test.want]; want != got {
+				t.Errorf("want %s, got %s", want.path, got.path)
+			}
+			if diff := cmp.Diff(test.vals, vals); diff != "" {
+				t.Errorf("values (-want +got):\n%s", diff)
 			}
 		})
 	}
@@ -109,7 +170,7 @@ func TestIsPartialRoute(t *testing.T) {
 		routes = oldRoutes
 	}()
 	dummy := new(dummyPage)
-	routes = routeList{}
+	routes = routeTree{}
 	routes.add("/sports/leagues/", dummy, routePage)
 	routes.add("/sports/leagues/teams", dummy, routePartial)
 	routes.add("/fruits/:name/", dummy, routePage)
@@ -140,7 +201,7 @@ func TestDisplayPartialHere(t *testing.T) {
 		routes = oldRoutes
 	}()
 	dummy := new(dummyPage)
-	routes = routeList{}
+	routes = routeTree{}
 	routes.add("/sports/", dummy, routePage)
 	routes.add("/sports/leagues", dummy, routePartial)
 	routes.add("/dyn/:name", dummy, routePage)
@@ -181,28 +242,1136 @@ func TestDisplayPartialHere(t *testing.T) {
 }
 
 func TestMatchURLPathSegmentPrefix(t *testing.T) {
-	const segmatch = `([^/]+)`
-	tests := []struct {
-		re   string
-		url  string
-		want bool
-	}{
-		{re: "/", url: "/", want: true},
-		{re: "/", url: "/foo", want: false},
-		{re: "/", url: "/foo/bar", want: false},
-		{re: "/", url: "/foo/bar/", want: false},
-		{re: "/foo/bar", url: "/foo", want: true},
-		{re: "/foo/bar", url: "/foo/bar", want: true},
-		{re: "/dyn/" + segmatch + "/", url: "/dyn/world/", want: true},
-		{re: "/dyn/" + segmatch + "/", url: "/dyn/world/extra", want: false},
-		{re: "/dyn/" + segmatch + "/extra", url: "/dyn/world/something/else", want: false},
+	tests := []struct {
+		route string
+		url   string
+		want  bool
+	}{
+		{route: "/", url: "/", want: true},
+		{route: "/", url: "/foo", want: false},
+		{route: "/", url: "/foo/bar", want: false},
+		{route: "/", url: "/foo/bar/", want: false},
+		{route: "/foo/bar", url: "/foo", want: true},
+		{route: "/foo/bar", url: "/foo/bar", want: true},
+		{route: "/foo/bar", url: "/xfoox", want: false},
+		{route: "/dyn/:name/", url: "/dyn/world/", want: true},
+		{route: "/dyn/:name/", url: "/dyn/world/extra", want: false},
+		{route: "/dyn/:name/extra", url: "/dyn/world/something/else", want: false},
+		{route: "/docs/*path/edit", url: "/docs/a/b/c", want: true},
 	}
 	for _, test := range tests {
 		t.Run("", func(t *testing.T) {
-			got := matchURLPathSegmentPrefix(regexp.MustCompile(test.re), test.url)
+			got := matchURLPathSegmentPrefix(newRoute(test.route, nil, routePartial), test.url)
 			if test.want != got {
 				t.Errorf("want %t, got %t", test.want, got)
 			}
 		})
 	}
 }
+
+func TestEscapers(t *testing.T) {
+	tests := []struct {
+		name    string
+		escaper func(any) string
+		val     any
+		want    string
+	}{
+		{"attr", escapeHTMLAttr, `"><script>`, "&#34;&gt;&lt;script&gt;"},
+		{"attr html not trusted", escapeHTMLAttr, template.HTML(`" onclick="x`), "&#34; onclick=&#34;x"},
+		{"nospace", escapeHTMLNospace, "a b=c", "a&#32;b&#61;c"},
+		{"nospace empty", escapeHTMLNospace, "", "ZgotmplZ"},
+		{"attr name", escapeHTMLAttrName, "Title", "title"},
+		{"attr name event handler", escapeHTMLAttrName, "onclick", "ZgotmplZ"},
+		{"attr name url", escapeHTMLAttrName, "href", "ZgotmplZ"},
+		{"attr name namespaced url", escapeHTMLAttrName, "xlink:href", "ZgotmplZ"},
+		{"attr name namespaced event handler", escapeHTMLAttrName, "foo:onclick", "ZgotmplZ"},
+		{"attr name namespaced style", escapeHTMLAttrName, "x:style", "ZgotmplZ"},
+		{"attr name xmlns", escapeHTMLAttrName, "xmlns:svg", "ZgotmplZ"},
+		{"attr name namespaced plain", escapeHTMLAttrName, "xml:lang", "xml:lang"},
+		{"attr name trusted", escapeHTMLAttrName, template.HTMLAttr("onclick"), "onclick"},
+		{"url filter", filterURL, "javascript:alert(1)", "#ZgotmplZ"},
+		{"url filter ok", filterURL, "https://example.com/", "https://example.com/"},
+		{"url filter relative", filterURL, "/a:b", "/a:b"},
+		{"url filter trusted", filterURL, template.URL("javascript:void(0)"), "javascript:void(0)"},
+		{"url normalize", normalizeURL, "/a b/%20?x=<y>", "/a%20b/%20?x=%3cy%3e"},
+		{"url escape", escapeURL, "a&b=c d", "a%26b%3dc%20d"},
+		{"js val string", escapeJSVal, "</script>", ` "\u003c/script\u003e" `},
+		{"js val int", escapeJSVal, 42, " 42 "},
+		{"js val struct", escapeJSVal, struct{ A []int }{[]int{1, 2}}, ` {"A":[1,2]} `},
+		{"js val trusted", escapeJSVal, template.JS("f()"), "f()"},
+		{"js str", escapeJSStr, `it's "</script>"`, `it\u0027s \u0022\u003c\u002fscript\u003e\u0022`},
+		{"js str trusted", escapeJSStr, template.JSStr(`\n`), `\n`},
+		{"js regexp", escapeJSRegexp, `a.b/'</script>`, `a\.b\u002f\u0027\u003c\u002fscript\u003e`},
+		{"js regexp empty", escapeJSRegexp, "", "(?:)"},
+		{"css filter", filterCSS, "#fff", "#fff"},
+		{"css filter unsafe", filterCSS, "red; background: url(x)", "ZgotmplZ"},
+		{"css filter expression", filterCSS, "expression", "ZgotmplZ"},
+		{"css filter trusted", filterCSS, template.CSS("url(x.png)"), "url(x.png)"},
+		{"css str", escapeCSS, `a"b`, `a\22 b`},
+		{"css str no space needed", escapeCSS, `"x`, `\22x`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.escaper(tt.val); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintEscapedWith(t *testing.T) {
+	var b strings.Builder
+	printEscapedWith(&b, template.URL("javascript:x()"), filterURL, normalizeURL, escapeHTMLAttr)
+	if got, want := b.String(), "javascript:x%28%29"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+type renderer struct {
+	html string
+	err  error
+}
+
+func (r renderer) RenderHTML(w io.Writer) error {
+	if r.err != nil {
+		return r.err
+	}
+	_, err := io.WriteString(w, r.html)
+	return err
+}
+
+func TestStringify(t *testing.T) {
+	n := 7
+	var nilPtr *int
+	tests := []struct {
+		val  any
+		want string
+	}{
+		{nil, ""},
+		{"x", "x"},
+		{true, "true"},
+		{int8(-8), "-8"},
+		{uint64(64), "64"},
+		{float32(1.5), "1.5"},
+		{3.25, "3.25"},
+		{1e21, "1e+21"},
+		{time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC), "2023-01-02T03:04:05Z"},
+		{time.Second, "1s"},
+		{errors.New("oops"), "oops"},
+		{&n, "7"},
+		{nilPtr, ""},
+		{renderer{html: "<b>hi</b>"}, "<b>hi</b>"},
+		{[]int{1, 2}, "[1 2]"},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			if got := stringify(tt.val); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintEscapedRenderer(t *testing.T) {
+	var b strings.Builder
+	printEscaped(&b, renderer{html: "<b>hi</b>"})
+	printEscaped(&b, "<b>")
+	printRaw(&b, "<i>")
+	if got, want := b.String(), "<b>hi</b>&lt;b&gt;<i>"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	b.Reset()
+	printEscapedWith(&b, renderer{html: `<b title="x">`}, escapeHTMLAttr)
+	if got, want := b.String(), "&lt;b title=&#34;x&#34;&gt;"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	defer func() {
+		r := recover()
+		if err, ok := r.(error); !ok || !strings.Contains(err.Error(), "oops") {
+			t.Errorf("expected panic with rendering error, got %v", r)
+		}
+	}()
+	printEscaped(&b, renderer{err: errors.New("oops")})
+}
+
+func TestPrintCondAttr(t *testing.T) {
+	tests := []struct {
+		val  any
+		want string
+	}{
+		{true, " checked"},
+		{false, ""},
+		{nil, ""},
+		{"", ""},
+		{`a "b"`, ` checked="a &#34;b&#34;"`},
+		{3, ` checked="3"`},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			var b strings.Builder
+			printCondAttr(&b, "checked", tt.val, escapeHTMLAttr)
+			if got := b.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintSpreadAttrs(t *testing.T) {
+	var b strings.Builder
+	printSpreadAttrs(&b, map[string]any{
+		"id":          "dup",
+		"ID":          "dup",
+		"disabled":    true,
+		"hidden":      false,
+		"title":       `"hi"`,
+		"href":        "javascript:alert(1)",
+		"onclick":     "alert(1)",
+		"bad name":    "x",
+		"data-weight": 1.5,
+	}, "id")
+	want := ` data-weight="1.5" disabled href="#ZgotmplZ" onclick=" &#34;alert(1)&#34; " title="&#34;hi&#34;"`
+	if got := b.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// namespaced attributes are escaped by the name without the namespace
+	b.Reset()
+	printSpreadAttrs(&b, map[string]any{
+		"xlink:href":  "javascript:alert(1)",
+		"svg:href":    "javascript:alert(1)",
+		"xmlns:xlink": "javascript:alert(1)",
+		"foo:onclick": "alert(1)",
+		"xml:lang":    "en",
+	})
+	want = ` foo:onclick=" &#34;alert(1)&#34; " svg:href="#ZgotmplZ" xlink:href="#ZgotmplZ" xml:lang="en" xmlns:xlink="#ZgotmplZ"`
+	if got := b.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	b.Reset()
+	type attrs map[string]string
+	printSpreadAttrs(&b, attrs{"class": "a"})
+	if got, want := b.String(), ` class="a"`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestGetLayout(t *testing.T) {
+	defer func(saved map[string]layout) { layouts = saved }(layouts)
+	layouts = map[string]layout{"default": new(nilLayout), "main": new(nilLayout)}
+
+	for _, name := range []string{"", "!", "main"} {
+		if _, err := getLayout(name); err != nil {
+			t.Errorf("getLayout(%q): unexpected error: %v", name, err)
+		}
+	}
+
+	_, err := getLayout("print")
+	if !errors.Is(err, ErrLayoutNotFound) {
+		t.Fatalf("expected ErrLayoutNotFound, got %v", err)
+	}
+	if got, want := err.Error(), `layout not found: "print" (known layouts: "default", "main")`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSetLayout(t *testing.T) {
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// without the context set up by Respond, SetLayout is a no-op
+	SetLayout(req, "print")
+	if got := layoutForRequest(req, "default"); got != "default" {
+		t.Errorf("got %q, want %q", got, "default")
+	}
+
+	req = req.WithContext(context.WithValue(req.Context(), layoutKey{}, new(layoutOverride)))
+	if got := layoutForRequest(req, "default"); got != "default" {
+		t.Errorf("got %q, want %q", got, "default")
+	}
+	SetLayout(req, "")
+	if got := layoutForRequest(req, "default"); got != "" {
+		t.Errorf("got %q, want %q", got, "")
+	}
+}
+
+// renderString returns a function that renders a section as s, and counts
+// how many times it is rendered in n.
+func renderString(s string, n *int) func(io.Writer) {
+	return func(w io.Writer) {
+		*n++
+		io.WriteString(w, s)
+	}
+}
+
+func TestLayoutSections(t *testing.T) {
+	var titles, footers, sidebars int
+	s := newLayoutSections()
+	s.add("title", renderString("Users", &titles))
+	s.add("footer", renderString("bye", &footers))
+	s.add("sidebar", renderString("<nav></nav>", &sidebars))
+
+	if !s.defined("title") || s.defined("aside") {
+		t.Errorf("defined: unexpected result")
+	}
+	// a section may be output more than once, but is rendered once
+	for i := 0; i < 2; i++ {
+		if got := s.output("title"); got != "Users" {
+			t.Errorf("got %q, want %q", got, "Users")
+		}
+	}
+	if titles != 1 {
+		t.Errorf("title rendered %d times, want 1", titles)
+	}
+	if got := s.output("aside"); got != "" {
+		t.Errorf("undefined section: got %q, want empty", got)
+	}
+
+	var contents int
+	parent := s.forParent(renderString("<p>hi</p>", &contents), map[string]func(io.Writer){"title": renderString("Admin: Users", new(int))})
+	want := map[string]template.HTML{"contents": "<p>hi</p>", "title": "Admin: Users", "footer": "bye"}
+	for name, html := range want {
+		if got := parent.output(name); got != html {
+			t.Errorf("parent section %q: got %q, want %q", name, got, html)
+		}
+	}
+	if footers != 1 || contents != 1 {
+		t.Errorf("footer rendered %d times, contents %d times, want 1", footers, contents)
+	}
+	// a section no layout outputs is never rendered
+	if sidebars != 0 {
+		t.Errorf("sidebar rendered %d times, want 0", sidebars)
+	}
+}
+
+func TestStreamSections(t *testing.T) {
+	defer func(saved bool) { StreamPages = saved }(StreamPages)
+
+	tests := []struct {
+		stream   bool
+		want     template.HTML
+		wantBody string
+	}{
+		{false, "<p>one</p><p>two</p>", "<head>"},
+		{true, "", "<head><p>one</p><p>two</p>"},
+	}
+	for _, tt := range tests {
+		StreamPages = tt.stream
+		rec := httptest.NewRecorder()
+		s := newLayoutSections()
+		s.add("contents", func(w io.Writer) {
+			io.WriteString(w, "<p>one</p>")
+			flushOutput(w)
+			io.WriteString(w, "<p>two</p>")
+		})
+		s.streamTo(rec)
+		io.WriteString(rec, "<head>")
+		if got := s.output("contents"); got != tt.want {
+			t.Errorf("stream %v: got %q, want %q", tt.stream, got, tt.want)
+		}
+		if got := rec.Body.String(); got != tt.wantBody {
+			t.Errorf("stream %v: body: got %q, want %q", tt.stream, got, tt.wantBody)
+		}
+		if rec.Flushed != tt.stream {
+			t.Errorf("stream %v: flushed %v", tt.stream, rec.Flushed)
+		}
+	}
+}
+
+func TestStreamSectionsNestedLayout(t *testing.T) {
+	defer func(saved bool) { StreamPages = saved }(StreamPages)
+	StreamPages = true
+
+	req := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+	var atFlush string
+	s := newLayoutSections()
+	s.add("contents", func(w io.Writer) {
+		io.WriteString(w, "<p>one</p>")
+		flushOutput(w)
+		atFlush = rec.Body.String()
+		io.WriteString(w, "<p>two</p>")
+	})
+	root := layoutFunc(func(w http.ResponseWriter, req *http.Request, sections *layoutSections) error {
+		sections.streamTo(w)
+		io.WriteString(w, "<head>")
+		printEscaped(w, sections.output("contents"))
+		return nil
+	})
+	child := layoutFunc(func(w http.ResponseWriter, req *http.Request, sections *layoutSections) error {
+		return root.Respond(w, req, sections.forParent(func(w io.Writer) {
+			io.WriteString(w, "<nav>")
+			printEscaped(w, sections.output("contents"))
+			io.WriteString(w, "</nav>")
+		}, nil))
+	})
+	if err := respondWithLayout(child, rec, req, s); err != nil {
+		t.Fatal(err)
+	}
+	if want := "<head><nav><p>one</p>"; atFlush != want {
+		t.Errorf("at flush: got %q, want %q", atFlush, want)
+	}
+	if got, want := rec.Body.String(), "<head><nav><p>one</p><p>two</p></nav>"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDeferredSections(t *testing.T) {
+	defer func(saved bool) { StreamPages = saved }(StreamPages)
+	StreamPages = true
+
+	respond := func(req *http.Request) string {
+		rec := httptest.NewRecorder()
+		s := newLayoutSections()
+		s.add("title", renderString("Home", new(int)))
+		s.addDeferred(req, "recs", renderString("<ul></ul>", new(int)), renderString("<p>loading</p>", new(int)))
+		s.streamTo(rec)
+		printEscaped(rec, s.output("title"))
+		printEscaped(rec, s.output("recs"))
+		io.WriteString(rec, "</html>")
+		s.streamDeferred(rec)
+		return rec.Body.String()
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	want := `Home<pushup-deferred id="pushup-deferred-recs"><p>loading</p></pushup-deferred></html>` +
+		`<template id="pushup-deferred-recs-content"><ul></ul></template>` + fmt.Sprintf(deferredSwapScript, "pushup-deferred-recs")
+	if got := respond(req); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// htmx waits for the whole response, so it gets sections in order
+	req.Header.Set("HX-Request", "true")
+	if got, want := respond(req), "Home<ul></ul></html>"; got != want {
+		t.Errorf("htmx: got %q, want %q", got, want)
+	}
+}
+
+func TestDeferredSectionsNestedLayout(t *testing.T) {
+	defer func(saved bool) { StreamPages = saved }(StreamPages)
+	StreamPages = true
+
+	var recs int
+	req := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+	s := newLayoutSections()
+	s.add("contents", renderString("<p>hi</p>", new(int)))
+	s.addDeferred(req, "recs", renderString("<ul></ul>", &recs), renderString("<p>loading</p>", new(int)))
+	root := layoutFunc(func(w http.ResponseWriter, req *http.Request, sections *layoutSections) error {
+		sections.streamTo(w)
+		printEscaped(w, sections.output("contents"))
+		printEscaped(w, sections.output("recs"))
+		return nil
+	})
+	child := layoutFunc(func(w http.ResponseWriter, req *http.Request, sections *layoutSections) error {
+		return root.Respond(w, req, sections.forParent(func(w io.Writer) {
+			printEscaped(w, sections.output("recs"))
+			printEscaped(w, sections.output("contents"))
+		}, nil))
+	})
+	if err := respondWithLayout(child, rec, req, s); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `<pushup-deferred id="pushup-deferred-recs"><p>loading</p></pushup-deferred><p>hi</p>` +
+		`<pushup-deferred id="pushup-deferred-recs-2"><p>loading</p></pushup-deferred>` +
+		`<template id="pushup-deferred-recs-content"><ul></ul></template>` + fmt.Sprintf(deferredSwapScript, "pushup-deferred-recs") +
+		`<template id="pushup-deferred-recs-2-content"><ul></ul></template>` + fmt.Sprintf(deferredSwapScript, "pushup-deferred-recs-2")
+	if got := rec.Body.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if recs != 1 {
+		t.Errorf("deferred section rendered %d times, want 1", recs)
+	}
+}
+
+// layoutFunc is a layout implemented by a function.
+type layoutFunc func(w http.ResponseWriter, req *http.Request, sections *layoutSections) error
+
+func (f layoutFunc) Respond(w http.ResponseWriter, req *http.Request, sections *layoutSections) error {
+	return f(w, req, sections)
+}
+
+func TestRespondWithLayout(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	l := layoutFunc(func(w http.ResponseWriter, req *http.Request, sections *layoutSections) error {
+		printEscaped(w, sections.output("title"))
+		printEscaped(w, sections.output("contents"))
+		return nil
+	})
+
+	s := newLayoutSections()
+	s.add("contents", func(w io.Writer) { panic("oops") })
+	s.add("title", renderString("Home", new(int)))
+	err := respondWithLayout(l, httptest.NewRecorder(), req, s)
+	if err == nil || err.Error() != "panic rendering page: oops" {
+		t.Errorf("panic in contents: got %v", err)
+	}
+
+	s = newLayoutSections()
+	s.add("contents", renderString("<p>hi</p>", new(int)))
+	s.add("title", func(w io.Writer) { panic("oops") })
+	if err := respondWithLayout(l, httptest.NewRecorder(), req, s); err == nil {
+		t.Errorf("panic in section: expected error")
+	}
+
+	errLayout := layoutFunc(func(w http.ResponseWriter, req *http.Request, sections *layoutSections) error {
+		return ErrLayoutNotFound
+	})
+	if err := respondWithLayout(errLayout, httptest.NewRecorder(), req, newLayoutSections()); !errors.Is(err, ErrLayoutNotFound) {
+		t.Errorf("layout error: got %v", err)
+	}
+}
+
+func TestTryRender(t *testing.T) {
+	var buf strings.Builder
+	var n int
+	if err := tryRender(&buf, "page.up:1", renderString("<p>ok</p>", &n)); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if got := buf.String(); got != "<p>ok</p>" {
+		t.Errorf("expected %q, got %q", "<p>ok</p>", got)
+	}
+
+	saveLog := ErrorLog
+	var logged strings.Builder
+	ErrorLog = log.New(&logged, "", 0)
+	defer func() { ErrorLog = saveLog }()
+
+	buf.Reset()
+	err := tryRender(&buf, "page.up:7", func(w io.Writer) {
+		io.WriteString(w, "<p>partial")
+		panic("boom")
+	})
+	if want := "page.up:7: panic: boom"; err == nil || err.Error() != want {
+		t.Errorf("expected error %q, got %v", want, err)
+	}
+	if got := buf.String(); got != "" {
+		t.Errorf("expected no output from a failed block, got %q", got)
+	}
+	if want := "page.up:7: panic: boom\n"; logged.String() != want {
+		t.Errorf("expected log %q, got %q", want, logged.String())
+	}
+
+	cause := errors.New("db down")
+	err = tryRender(&buf, "page.up:9", func(io.Writer) { panic(cause) })
+	if !errors.Is(err, cause) {
+		t.Errorf("expected error to wrap %v, got %v", cause, err)
+	}
+}
+
+// BenchmarkRespondWithLayout renders a page like the generated code does: its
+// contents and three sections, one of which the layout doesn't output. it
+// reports the goroutines running while the layout renders, besides the
+// benchmark's own.
+func BenchmarkRespondWithLayout(b *testing.B) {
+	req := httptest.NewRequest("GET", "/", nil)
+	items := []string{"Ag", "Na", "C", "Fe", "Cu"}
+	var goroutines int
+	base := runtime.NumGoroutine()
+	l := layoutFunc(func(w http.ResponseWriter, req *http.Request, sections *layoutSections) error {
+		io.WriteString(w, "<!DOCTYPE html>\n<title>")
+		printEscaped(w, sections.output("title"))
+		io.WriteString(w, "</title>\n<main>")
+		printEscaped(w, sections.output("contents"))
+		io.WriteString(w, "</main>\n<footer>")
+		printEscaped(w, sections.output("footer"))
+		io.WriteString(w, "</footer>\n")
+		if n := runtime.NumGoroutine() - base; n > goroutines {
+			goroutines = n
+		}
+		return nil
+	})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sections := newLayoutSections()
+		sections.add("contents", func(w io.Writer) {
+			io.WriteString(w, "<ul>")
+			for _, item := range items {
+				io.WriteString(w, "<li>")
+				printEscaped(w, item)
+				io.WriteString(w, "</li>")
+			}
+			io.WriteString(w, "</ul>")
+		})
+		sections.add("title", func(w io.Writer) {
+			printEscaped(w, "Elements")
+		})
+		sections.add("footer", func(w io.Writer) {
+			io.WriteString(w, "<p>bye</p>")
+		})
+		sections.add("sidebar", func(w io.Writer) {
+			io.WriteString(w, "<nav></nav>")
+		})
+		if err := respondWithLayout(l, httptest.NewRecorder(), req, sections); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(goroutines), "goroutines/op")
+}
+
+func TestGetParentLayout(t *testing.T) {
+	defer func(saved map[string]layout) { layouts = saved }(layouts)
+	layouts = map[string]layout{"default": new(nilLayout), "admin": new(nilLayout)}
+
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, req, err = getParentLayout(req, "admin", "default")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, _, err = getParentLayout(req, "default", "admin")
+	if got, want := fmt.Sprint(err), "layout cycle: admin -> default -> admin"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	_, _, err = getParentLayout(req, "default", "nonesuch")
+	if !errors.Is(err, ErrLayoutNotFound) {
+		t.Errorf("expected ErrLayoutNotFound, got %v", err)
+	}
+}
+
+func TestRouteParams(t *testing.T) {
+	tests := []struct {
+		route string
+		url   string
+		want  map[string]string
+	}{
+		{"/album/:id", "/album/42", map[string]string{"id": "42"}},
+		{"/files/:name", "/files/a%2Fb%20c", map[string]string{"name": "a/b c"}},
+		{"/café/:id", "/caf%C3%A9/1", map[string]string{"id": "1"}},
+		{"/docs/*path", "/docs/a/b%20c/d", map[string]string{"path": "a/b c/d"}},
+		{"/archive/:year?", "/archive", map[string]string{"year": ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			route := newRoute(tt.route, nil, routePage)
+			_, okPath := route.match(u.Path)
+			_, okEscaped := route.match(u.EscapedPath())
+			if !okPath && !okEscaped {
+				t.Fatalf("route %s doesn't match %s", tt.route, u)
+			}
+			got, err := routeParams(route, u)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseParamValue(t *testing.T) {
+	var (
+		s string
+		i int
+		u uint
+		f float64
+		b bool
+	)
+	tests := []struct {
+		in      string
+		dst     any
+		want    any
+		wantErr bool
+	}{
+		{"hello", &s, "hello", false},
+		{"-3", &i, -3, false},
+		{"x", &i, 0, true},
+		{"-3", &u, uint(0), true},
+		{"1.5", &f, 1.5, false},
+		{"on", &b, true, false},
+		{"false", &b, false, false},
+		{"yes", &b, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			err := parseParamValue(tt.in, tt.dst)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := reflect.ValueOf(tt.dst).Elem().Interface(); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBindQueryParam(t *testing.T) {
+	req, err := http.NewRequest("GET", "/?page=3&bad=x&empty=", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, missing, empty := 1, 1, 1
+	for name, dst := range map[string]*int{"page": &page, "missing": &missing, "empty": &empty} {
+		if err := bindQueryParam(req, name, dst); err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+	if page != 3 || missing != 1 || empty != 1 {
+		t.Errorf("got page=%d missing=%d empty=%d", page, missing, empty)
+	}
+	var bad int
+	if err := bindQueryParam(req, "bad", &bad); !errors.Is(err, ErrBadRequest) {
+		t.Errorf("expected ErrBadRequest, got %v", err)
+	}
+}
+
+func TestBindRouteParam(t *testing.T) {
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(context.WithValue(req.Context(), ctxKey{}, map[string]string{"path": "a/b/c", "year": ""}))
+
+	var path []string
+	if err := bindRouteParam(req, "path", &path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"a", "b", "c"}, path); diff != "" {
+		t.Errorf("(-want +got):\n%s", diff)
+	}
+
+	year := 2024
+	if err := bindRouteParam(req, "year", &year); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if year != 2024 {
+		t.Errorf("absent optional segment: got %d, want default 2024", year)
+	}
+
+	var n int
+	if err := bindRouteParam(req, "path", &n); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestRouteURL(t *testing.T) {
+	year, month, emptyTag := 2024, 0, ""
+	tests := []struct {
+		route string
+		args  []any
+		want  string
+	}{
+		{"/", nil, "/"},
+		{"/crud/", nil, "/crud/"},
+		{"/crud/album/:id", []any{42}, "/crud/album/42"},
+		{"/people/:name", []any{"Ada Lovelace/2"}, "/people/Ada%20Lovelace%2F2"},
+		{"/projects/:pid/users/:uid", []any{"a", "b"}, "/projects/a/users/b"},
+		{"/archive/:year?", []any{""}, "/archive"},
+		{"/archive/:year?", []any{2024}, "/archive/2024"},
+		{"/archive/:year?", []any{(*int)(nil)}, "/archive"},
+		{"/archive/:year?/:month?", []any{&year, &month}, "/archive/2024/0"},
+		{"/tags/:tag?", []any{&emptyTag}, "/tags"},
+		{"/docs/*path", []any{"a b/c"}, "/docs/a%20b/c"},
+		{"/docs/*path", []any{[]string{"a", "b/c"}}, "/docs/a/b%2Fc"},
+		{"/files/*path?/edit", []any{[]string(nil)}, "/files/edit"},
+		{"/:on", []any{true}, "/true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.route, func(t *testing.T) {
+			if got := routeURL(tt.route, tt.args...); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+type responderFunc func(http.ResponseWriter, *http.Request) error
+
+func (f responderFunc) Respond(w http.ResponseWriter, r *http.Request) error {
+	return f(w, r)
+}
+
+func TestWithMiddleware(t *testing.T) {
+	defer func(saved map[string]func(http.Handler) http.Handler) { middlewares = saved }(middlewares)
+	middlewares = make(map[string]func(http.Handler) http.Handler)
+
+	var calls []string
+	mark := func(name string) func(http.Handler) http.Handler {
+		return func(h http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls = append(calls, name)
+				h.ServeHTTP(w, r)
+			})
+		}
+	}
+	addMiddleware(".", mark("root"))
+	addMiddleware("admin", mark("admin"))
+	addMiddleware("admin/users", mark("users"))
+	addMiddleware("blocked", func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls = append(calls, "blocked")
+		})
+	})
+
+	errPage := errors.New("page error")
+	page := responderFunc(func(w http.ResponseWriter, r *http.Request) error {
+		calls = append(calls, "page")
+		return errPage
+	})
+
+	tests := []struct {
+		dir       string
+		wantCalls []string
+		wantErr   error
+	}{
+		{".", []string{"root", "page"}, errPage},
+		{"about", []string{"root", "page"}, errPage},
+		{"admin/users/$id", []string{"root", "admin", "users", "page"}, errPage},
+		{"admin/(reports)", []string{"root", "admin", "page"}, errPage},
+		{"blocked", []string{"root", "blocked"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dir, func(t *testing.T) {
+			calls = nil
+			req, err := http.NewRequest("GET", "/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = withMiddleware(tt.dir, page).Respond(nil, req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("want error %v, got %v", tt.wantErr, err)
+			}
+			if diff := cmp.Diff(tt.wantCalls, calls); diff != "" {
+				t.Errorf("(-want, +got)\n%s", diff)
+			}
+		})
+	}
+}
+
+type methodsPage struct {
+	dummyPage
+}
+
+func (p *methodsPage) methods() []string {
+	return []string{"GET", "POST"}
+}
+
+func TestRespondMethods(t *testing.T) {
+	defer func(saved routeTree) { routes = saved }(routes)
+	routes = routeTree{}
+	routes.add("/any", withMiddleware(".", new(dummyPage)), routePage)
+	routes.add("/form", withMiddleware(".", new(methodsPage)), routePage)
+
+	tests := []struct {
+		method    string
+		path      string
+		wantErr   error
+		wantCode  int
+		wantAllow string
+	}{
+		{"DELETE", "/any", nil, 200, ""},
+		{"GET", "/form", nil, 200, ""},
+		{"HEAD", "/form", nil, 200, ""},
+		{"POST", "/form", nil, 200, ""},
+		{"DELETE", "/form", ErrMethodNotAllowed, 200, "GET, HEAD, POST, OPTIONS"},
+		{"OPTIONS", "/form", nil, 204, "GET, HEAD, POST, OPTIONS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			w := httptest.NewRecorder()
+			err := Respond(w, req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("want error %v, got %v", tt.wantErr, err)
+			}
+			if w.Code != tt.wantCode {
+				t.Errorf("want status %d, got %d", tt.wantCode, w.Code)
+			}
+			if got := w.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("want Allow %q, got %q", tt.wantAllow, got)
+			}
+		})
+	}
+}
+
+func TestOverrideMethod(t *testing.T) {
+	tests := []struct {
+		method string
+		form   string
+		want   string
+	}{
+		{"POST", "_method=DELETE", "DELETE"},
+		{"POST", "_method=put", "PUT"},
+		{"POST", "_method=PATCH&name=x", "PATCH"},
+		{"POST", "_method=GET", "POST"},
+		{"POST", "name=x", "POST"},
+		{"GET", "_method=DELETE", "GET"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.form, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/", strings.NewReader(tt.form))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if got := overrideMethod(req).Method; got != tt.want {
+				t.Errorf("want %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRespondResponses(t *testing.T) {
+	defer func(saved routeTree) { routes = saved }(routes)
+	routes = routeTree{}
+	page := func(f func(w http.ResponseWriter, r *http.Request) error) Responder {
+		return responderFunc(func(w http.ResponseWriter, r *http.Request) error {
+			if err := f(w, r); err != nil {
+				return err
+			}
+			writeStatus(w, r)
+			fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+			return nil
+		})
+	}
+	routes.add("/redirect", page(func(w http.ResponseWriter, r *http.Request) error {
+		return Redirect("/login", http.StatusSeeOther)
+	}), routePage)
+	routes.add("/json", page(func(w http.ResponseWriter, r *http.Request) error {
+		return JSON(http.StatusCreated, map[string]int{"id": 1})
+	}), routePage)
+	routes.add("/bad-json", page(func(w http.ResponseWriter, r *http.Request) error {
+		return JSON(http.StatusOK, func() {})
+	}), routePage)
+	routes.add("/status", page(func(w http.ResponseWriter, r *http.Request) error {
+		SetStatus(r, http.StatusUnprocessableEntity)
+		return nil
+	}), routePage)
+	routes.add("/render", page(func(w http.ResponseWriter, r *http.Request) error {
+		return RenderPage("/status")
+	}), routePage)
+	routes.add("/loop", page(func(w http.ResponseWriter, r *http.Request) error {
+		return RenderPage("/loop")
+	}), routePage)
+	routes.add("/halt", page(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusAccepted)
+		return Halt()
+	}), routePage)
+
+	tests := []struct {
+		method   string
+		path     string
+		wantCode int
+		wantBody string
+		wantErr  bool
+		header   string
+		want     string
+	}{
+		{"POST", "/redirect", 303, "", false, "Location", "/login"},
+		{"GET", "/json", 201, "{\"id\":1}\n", false, "Content-Type", "application/json"},
+		{"GET", "/bad-json", 200, "", true, "Content-Type", ""},
+		{"GET", "/status", 422, "GET /status", false, "", ""},
+		{"POST", "/render", 422, "GET /status", false, "", ""},
+		{"GET", "/loop", 200, "", true, "", ""},
+		{"GET", "/halt", 202, "", false, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			w := httptest.NewRecorder()
+			err := Respond(w, req)
+			if tt.wantErr != (err != nil) {
+				t.Errorf("want error %v, got %v", tt.wantErr, err)
+			}
+			if w.Code != tt.wantCode {
+				t.Errorf("want status %d, got %d", tt.wantCode, w.Code)
+			}
+			if got := w.Body.String(); tt.wantBody != "" && got != tt.wantBody {
+				t.Errorf("want body %q, got %q", tt.wantBody, got)
+			}
+			if tt.header != "" {
+				if got := w.Header().Get(tt.header); got != tt.want {
+					t.Errorf("want %s %q, got %q", tt.header, tt.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPError(t *testing.T) {
+	tests := []struct {
+		err     error
+		code    int
+		message string
+	}{
+		{ErrNotFound, 404, "page not found"},
+		{fmt.Errorf("binding: %w", ErrBadRequest), 400, "bad request"},
+		{Error(http.StatusForbidden, "members only"), 403, "members only"},
+		{Error(http.StatusConflict, ""), 409, ""},
+		{errors.New("database is down"), 500, "Internal Server Error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			e := httpError(tt.err)
+			if e.Code != tt.code || e.Message != tt.message {
+				t.Errorf("want %d %q, got %d %q", tt.code, tt.message, e.Code, e.Message)
+			}
+			if !errors.Is(e, tt.err) {
+				t.Errorf("expected %v to wrap %v", e, tt.err)
+			}
+		})
+	}
+}
+
+func TestRespondWithError(t *testing.T) {
+	defer func(saved []*errorPage) { errorPages = saved }(errorPages)
+	errorPages = nil
+	page := func(name string) Responder {
+		return responderFunc(func(w http.ResponseWriter, r *http.Request) error {
+			writeStatus(w, r)
+			e := GetError(r)
+			fmt.Fprintf(w, "%s: %d %s", name, e.Code, e.Message)
+			return nil
+		})
+	}
+	addErrorPage("", 404, page("root"))
+	addErrorPage("/admin", 404, page("admin"))
+	addErrorPage("/docs/:id", 403, page("doc"))
+	addErrorPage("", 500, responderFunc(func(w http.ResponseWriter, r *http.Request) error {
+		fmt.Fprint(w, "partial output")
+		return errors.New("error page failed")
+	}))
+
+	tests := []struct {
+		path        string
+		err         error
+		wantCode    int
+		wantBody    string
+		wantPageErr bool
+	}{
+		{"/nonesuch", ErrNotFound, 404, "root: 404 page not found", false},
+		{"/admin", ErrNotFound, 404, "admin: 404 page not found", false},
+		{"/admin/users/1", ErrNotFound, 404, "admin: 404 page not found", false},
+		{"/administrator", ErrNotFound, 404, "root: 404 page not found", false},
+		{"/docs/7/edit", Error(403, "read only"), 403, "doc: 403 read only", false},
+		{"/docs", Error(403, "read only"), 403, "Forbidden\n", false},
+		{"/", errors.New("boom"), 500, "Internal Server Error\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			w := httptest.NewRecorder()
+			err := RespondWithError(w, req, tt.err)
+			if tt.wantPageErr != (err != nil) {
+				t.Errorf("want error page error %v, got %v", tt.wantPageErr, err)
+			}
+			if w.Code != tt.wantCode {
+				t.Errorf("want status %d, got %d", tt.wantCode, w.Code)
+			}
+			if got := w.Body.String(); got != tt.wantBody {
+				t.Errorf("want body %q, got %q", tt.wantBody, got)
+			}
+		})
+	}
+}
+
+func TestRespondWithErrorAfterStreaming(t *testing.T) {
+	defer func(saved bool) { StreamPages = saved }(StreamPages)
+	StreamPages = true
+	saveLog := ErrorLog
+	var logged strings.Builder
+	ErrorLog = log.New(&logged, "", 0)
+	defer func() { ErrorLog = saveLog }()
+
+	page := responderFunc(func(w http.ResponseWriter, r *http.Request) error {
+		io.WriteString(w, "<head>")
+		flushOutput(w)
+		return errors.New("boom")
+	})
+	req := httptest.NewRequest("GET", "/slow", nil)
+	rec := httptest.NewRecorder()
+	w := TrackResponse(rec)
+	err := page.Respond(w, req)
+	if err == nil {
+		t.Fatal("expected page error")
+	}
+	if err := RespondWithError(w, req, err); err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+	if !rec.Flushed {
+		t.Error("expected the tracked writer to flush")
+	}
+	if rec.Code != 200 {
+		t.Errorf("want status 200, got %d", rec.Code)
+	}
+	if got := rec.Body.String(); got != "<head>" {
+		t.Errorf("want body %q, got %q", "<head>", got)
+	}
+	if want := "GET /slow: response already started: boom\n"; logged.String() != want {
+		t.Errorf("want log %q, got %q", want, logged.String())
+	}
+
+	// before anything is written, the error response is sent as usual
+	rec = httptest.NewRecorder()
+	if err := RespondWithError(TrackResponse(rec), req, errors.New("boom")); err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+	if rec.Code != 500 {
+		t.Errorf("want status 500, got %d", rec.Code)
+	}
+}
+
+// benchmarkRoutes adds n groups of routes of every kind, like the pages of a
+// large app, and returns paths that match them.
+func benchmarkRoutes(n int) []string {
+	dummy := new(dummyPage)
+	for i := 0; i < n; i++ {
+		routes.add(fmt.Sprintf("/section%d/", i), dummy, routePage)
+		routes.add(fmt.Sprintf("/section%d/new", i), dummy, routePage)
+		routes.add(fmt.Sprintf("/section%d/:id", i), dummy, routePage)
+		routes.add(fmt.Sprintf("/section%d/:id/edit", i), dummy, routePage)
+		routes.add(fmt.Sprintf("/section%d/:id/comments", i), dummy, routePartial)
+		routes.add(fmt.Sprintf("/docs%d/*path", i), dummy, routePage)
+	}
+	return []string{
+		"/section0/",
+		fmt.Sprintf("/section%d/new", n/2),
+		fmt.Sprintf("/section%d/42/edit", n-1),
+		fmt.Sprintf("/docs%d/guide/install/linux", n-1),
+		"/nonesuch/path",
+	}
+}
+
+func BenchmarkGetRouteFromPath(b *testing.B) {
+	defer func(saved routeTree) { routes = saved }(routes)
+	for _, n := range []int{10, 100, 500} {
+		routes = routeTree{}
+		paths := benchmarkRoutes(n)
+		for _, path := range paths {
+			b.Run(fmt.Sprintf("routes=%d%s", len(routes.all), path), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					getRouteFromPath(path)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkRespondRoute(b *testing.B) {
+	defer func(saved routeTree) { routes = saved }(routes)
+	routes = routeTree{}
+	benchmarkRoutes(500)
+	req := httptest.NewRequest("GET", "/section499/42/edit", nil)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := Respond(httptest.NewRecorder(), req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
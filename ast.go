@@ -56,6 +56,10 @@ func walk(v visitor, n node) {
 		// no children
 	case *nodeGoCode:
 		// no children
+	case *nodeCondAttr:
+		walk(v, n.value)
+	case *nodeSpreadAttrs:
+		walk(v, n.value)
 	case *nodeIf:
 		walk(v, n.cond)
 		walk(v, n.then)
@@ -65,10 +69,26 @@ func walk(v visitor, n node) {
 	case *nodeFor:
 		walk(v, n.clause)
 		walk(v, n.block)
+		if n.alt != nil {
+			walk(v, n.alt)
+		}
+	case *nodeSwitch:
+		walk(v, n.tag)
+		for _, c := range n.cases {
+			walk(v, c)
+		}
+	case *nodeCase:
+		if n.list != nil {
+			walk(v, n.list)
+		}
+		walk(v, n.block)
 	case *nodeBlock:
 		walkNodeList(v, n.nodes)
 	case *nodeSection:
 		walk(v, n.block)
+		if n.fallback != nil {
+			walk(v, n.fallback)
+		}
 	case *nodeImport:
 		// no children
 	case *nodeLayout:
@@ -77,6 +97,21 @@ func walk(v visitor, n node) {
 		walkNodeList(v, n)
 	case *nodePartial:
 		walk(v, n.block)
+	case *nodeComponent:
+		if n.children != nil {
+			walk(v, n.children)
+		}
+	case *nodeProp:
+		// no children
+	case *nodeParam:
+		// no children
+	case *nodeFlush:
+		// no children
+	case *nodeTry:
+		walk(v, n.block)
+		if n.catch != nil {
+			walk(v, n.catch)
+		}
 	default:
 		panic(fmt.Sprintf("unhandled type %T", n))
 	}
@@ -95,12 +130,42 @@ var _ node = (*nodeLiteral)(nil)
 type nodeGoStrExpr struct {
 	expr string
 	pos  span
+	// escapers are the names of the runtime escaper functions to apply to
+	// the value, set by contextual auto-escaping. empty means HTML text.
+	escapers []string
+	// raw is true if the value is output without escaping, via ^raw(...)
+	raw bool
 }
 
 func (e nodeGoStrExpr) Pos() span { return e.pos }
 
 var _ node = (*nodeGoStrExpr)(nil)
 
+// nodeCondAttr is an HTML attribute whose presence depends on the value of a
+// Go expression, written `name=^?expr' in a start tag.
+type nodeCondAttr struct {
+	name  string
+	value *nodeGoStrExpr
+	pos   span
+}
+
+func (e nodeCondAttr) Pos() span { return e.pos }
+
+var _ node = (*nodeCondAttr)(nil)
+
+// nodeSpreadAttrs is a set of HTML attributes from the entries of a map,
+// written `^attrs(expr)' in a start tag. static holds the names of the other
+// attributes of the tag, which take precedence over those in the map.
+type nodeSpreadAttrs struct {
+	value  *nodeGoStrExpr
+	static []string
+	pos    span
+}
+
+func (e nodeSpreadAttrs) Pos() span { return e.pos }
+
+var _ node = (*nodeSpreadAttrs)(nil)
+
 type goCodeContext int
 
 const (
@@ -110,8 +175,11 @@ const (
 
 type nodeGoCode struct {
 	context goCodeContext
-	code    string
-	pos     span
+	// method is the HTTP method of a handler declared for one method, like
+	// `^handler POST {', or empty for a handler of every method.
+	method string
+	code   string
+	pos    span
 }
 
 func (e nodeGoCode) Pos() span { return e.pos }
@@ -128,19 +196,58 @@ func (e nodeIf) Pos() span { return e.cond.pos }
 
 var _ node = (*nodeIf)(nil)
 
+// nodeFor is a syntax tree node representing a `^for' loop. alt is the
+// optional `^else' block, output if the loop body was never executed.
 type nodeFor struct {
 	clause *nodeGoCode
 	block  *nodeBlock
+	alt    *nodeBlock
 }
 
 func (e nodeFor) Pos() span { return e.clause.pos }
 
-type nodeSection struct {
-	name  string
+var _ node = (*nodeFor)(nil)
+
+// nodeSwitch is a syntax tree node representing a `^switch' statement. tag
+// holds everything between the `switch' keyword and the opening brace, which
+// may be an optional simple statement and/or tag expression, or be empty.
+type nodeSwitch struct {
+	tag   *nodeGoCode
+	pos   span
+	cases []*nodeCase
+}
+
+func (e nodeSwitch) Pos() span { return e.pos }
+
+var _ node = (*nodeSwitch)(nil)
+
+// nodeCase is a single `^case' or `^default' clause in a `^switch'
+// statement. list is nil for the default clause.
+type nodeCase struct {
+	list  *nodeGoCode
 	pos   span
 	block *nodeBlock
 }
 
+func (e nodeCase) Pos() span { return e.pos }
+
+// isDefault reports whether the clause is the `^default' clause.
+func (e nodeCase) isDefault() bool { return e.list == nil }
+
+var _ node = (*nodeCase)(nil)
+
+// nodeSection is a syntax tree node representing a `^section' of a page or
+// layout. a deferred section, declared with `^section name defer', isn't
+// waited for by a streaming layout, which outputs the optional fallback block
+// in its place until it's done.
+type nodeSection struct {
+	name     string
+	pos      span
+	block    *nodeBlock
+	deferred bool
+	fallback *nodeBlock
+}
+
 func (e nodeSection) Pos() span { return e.pos }
 
 var _ node = (*nodeSection)(nil)
@@ -157,6 +264,87 @@ func (e nodePartial) Pos() span { return e.pos }
 
 var _ node = (*nodePartial)(nil)
 
+// nodeComponent is a syntax tree node representing an invocation of a
+// component, either with a capitalized tag like `<Card title=^t>' or with the
+// `^component' keyword. args is the list of keyed elements of the component's
+// props composite literal, e.g., `title: t'.
+type nodeComponent struct {
+	name     string
+	args     string
+	children *nodeBlock
+	pos      span
+}
+
+func (e nodeComponent) Pos() span { return e.pos }
+
+var _ node = (*nodeComponent)(nil)
+
+// nodeProp is a syntax tree node representing a `^prop' declaration of a
+// typed input to a component.
+type nodeProp struct {
+	name string
+	typ  string
+	pos  span
+}
+
+func (e nodeProp) Pos() span { return e.pos }
+
+var _ node = (*nodeProp)(nil)
+
+type paramKind int
+
+const (
+	routeParam paramKind = iota
+	queryParam
+)
+
+func (k paramKind) String() string {
+	if k == queryParam {
+		return "query"
+	}
+	return "param"
+}
+
+// nodeParam is a syntax tree node representing a typed parameter of a page,
+// either a `^param' declaration of a dynamic route segment or a `^query'
+// declaration of a query string value. dflt is the optional Go expression of
+// a query parameter's default value.
+type nodeParam struct {
+	kind paramKind
+	name string
+	typ  string
+	dflt string
+	pos  span
+}
+
+func (e nodeParam) Pos() span { return e.pos }
+
+var _ node = (*nodeParam)(nil)
+
+// nodeFlush is a syntax tree node representing a `^flush' point, where the
+// output rendered so far is sent on to the client when pages are streamed.
+type nodeFlush struct {
+	pos span
+}
+
+func (e nodeFlush) Pos() span { return e.pos }
+
+var _ node = (*nodeFlush)(nil)
+
+// nodeTry is a syntax tree node representing a `^try' error boundary. if
+// rendering block panics, its output is discarded and the optional `^catch'
+// block is output in its place, with the error bound to errVar if it's named.
+type nodeTry struct {
+	pos    span
+	block  *nodeBlock
+	errVar string
+	catch  *nodeBlock
+}
+
+func (e nodeTry) Pos() span { return e.pos }
+
+var _ node = (*nodeTry)(nil)
+
 // nodeBlock represents a block of nodes, i.e., a sequence of nodes that
 // appear in order in the source syntax.
 type nodeBlock struct {
@@ -193,8 +381,12 @@ func (e nodeImport) Pos() span { return e.pos }
 
 var _ node = (*nodeImport)(nil)
 
+// nodeLayout is a syntax tree node representing a `^layout' directive. expr
+// is set instead of name for the `^layout(expr)' form, whose Go string
+// expression selects the layout at request time.
 type nodeLayout struct {
 	name string
+	expr string
 	pos  span
 }
 
@@ -8,6 +8,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"unicode"
@@ -21,23 +22,67 @@ type importDecl struct {
 type layout struct {
 	imports []importDecl
 	nodes   []node
+
+	// parent is the name of the layout this layout is wrapped in, set by a
+	// `^layout' directive, or parentExpr for the `^layout(expr)' form. the
+	// zero values mean the layout has no parent.
+	parent     string
+	parentExpr string
+	parentPos  span
+
+	// sections are the layout's own sections, passed to its parent layout.
+	// a layout without a parent outputs its sections in place.
+	sections map[string]*nodeBlock
+}
+
+// hasParent reports whether the layout is wrapped in another layout.
+func (l *layout) hasParent() bool {
+	return l.parent != "" || l.parentExpr != ""
 }
 
 func newLayoutFromTree(tree *syntaxTree) (*layout, error) {
-	layout := &layout{}
-	n := 0
-	var f inspector = func(e node) bool {
+	layout := &layout{sections: make(map[string]*nodeBlock)}
+	layoutSet := false
+	for _, e := range tree.nodes {
 		switch e := e.(type) {
 		case *nodeImport:
 			layout.imports = append(layout.imports, e.decl)
+		case *nodeProp:
+			return nil, fmt.Errorf(transSymStr + "prop is only allowed in components")
+		case *nodeParam:
+			return nil, fmt.Errorf("%s%s is only allowed in pages", transSymStr, e.kind)
+		case *nodeSection:
+			if e.deferred {
+				return nil, fmt.Errorf("deferred sections are only allowed in pages")
+			}
+			layout.nodes = append(layout.nodes, e)
+		case *nodeLayout:
+			if layoutSet {
+				return nil, fmt.Errorf("layout already set")
+			}
+			if e.expr != "" {
+				layout.parentExpr = e.expr
+				layout.parentPos = e.pos
+			} else if e.name != "!" {
+				layout.parent = e.name
+			}
+			layoutSet = true
 		default:
 			layout.nodes = append(layout.nodes, e)
-			n++
 		}
-		return false
 	}
-	inspect(nodeList(tree.nodes), f)
-	layout.nodes = layout.nodes[:n]
+	if layout.hasParent() {
+		n := 0
+		for _, e := range layout.nodes {
+			if sec, ok := e.(*nodeSection); ok {
+				layout.sections[sec.name] = sec.block
+			} else {
+				layout.nodes[n] = e
+				n++
+			}
+		}
+		layout.nodes = layout.nodes[:n]
+	}
 	return layout, nil
 }
 
@@ -77,6 +122,40 @@ func newLayoutCodeGen(layout *layout, pfile projectFile, source string) *layoutC
 	return l
 }
 
+// forIteratedVar returns the name of the variable that tracks whether the body
+// of a `^for' loop with an `^else' block executed at least once.
+func forIteratedVar(e *nodeFor) string {
+	return fmt.Sprintf("__pushup_iterated%d", e.clause.pos.start)
+}
+
+// printExprCall returns a call to the runtime that prints the value of the
+// expression to w, escaped for the context the expression appears in.
+func printExprCall(w string, e *nodeGoStrExpr) string {
+	if e.raw {
+		return fmt.Sprintf("printRaw(%s, %s)", w, e.expr)
+	}
+	if len(e.escapers) == 0 {
+		return fmt.Sprintf("printEscaped(%s, %s)", w, e.expr)
+	}
+	return fmt.Sprintf("printEscapedWith(%s, %s, %s)", w, e.expr, strings.Join(e.escapers, ", "))
+}
+
+// condAttrCall returns a call to the runtime that prints the conditional
+// attribute to w, depending on the value of its expression.
+func condAttrCall(w string, e *nodeCondAttr) string {
+	return fmt.Sprintf("printCondAttr(%s, %s, %s, %s)", w, strconv.Quote(e.name), e.value.expr, strings.Join(e.value.escapers, ", "))
+}
+
+// spreadAttrsCall returns a call to the runtime that prints the attributes in
+// the map of the expression to w.
+func spreadAttrsCall(w string, e *nodeSpreadAttrs) string {
+	args := []string{w, e.value.expr}
+	for _, name := range e.static {
+		args = append(args, strconv.Quote(name))
+	}
+	return fmt.Sprintf("printSpreadAttrs(%s)", strings.Join(args, ", "))
+}
+
 func lineCount(s string) int {
 	return strings.Count(s, "\n") + 1
 }
@@ -109,6 +188,12 @@ func (g *layoutCodeGen) emitLineDirective(n int) {
 	g.bodyPrintf("//line %s:%d\n", g.pfile.relpath(), n)
 }
 
+// nodePosString returns the position of e in the .up file, for messages
+// about it at runtime.
+func (g *layoutCodeGen) nodePosString(e node) string {
+	return fmt.Sprintf("%s:%d", g.pfile.relpath(), g.lineNo(e.Pos()))
+}
+
 func (g *layoutCodeGen) generate() {
 	nodes := g.layout.nodes
 	g.genNode(nodeList(nodes))
@@ -132,7 +217,15 @@ func (g *layoutCodeGen) genNode(n node) {
 			return false
 		case *nodeGoStrExpr:
 			g.nodeLineNo(e)
-			g.bodyPrintf("printEscaped(%s, %s)\n", g.ioWriterVar, e.expr)
+			g.bodyPrintf("%s\n", printExprCall(g.ioWriterVar, e))
+		case *nodeCondAttr:
+			g.nodeLineNo(e)
+			g.bodyPrintf("%s\n", condAttrCall(g.ioWriterVar, e))
+			return false
+		case *nodeSpreadAttrs:
+			g.nodeLineNo(e)
+			g.bodyPrintf("%s\n", spreadAttrsCall(g.ioWriterVar, e))
+			return false
 		case *nodeGoCode:
 			if e.context != inlineGoCode {
 				panic(fmt.Sprintf("internal error: expected inlineGoCode, got %v", e.context))
@@ -164,9 +257,37 @@ func (g *layoutCodeGen) genNode(n node) {
 			}
 			return false
 		case *nodeFor:
+			if e.alt == nil {
+				g.bodyPrintf("for %s {\n", e.clause.code)
+				f(e.block)
+				g.bodyPrintf("}\n")
+				return false
+			}
+			iterated := forIteratedVar(e)
+			g.bodyPrintf("{\n")
+			g.bodyPrintf("%s := false\n", iterated)
 			g.bodyPrintf("for %s {\n", e.clause.code)
+			g.bodyPrintf("%s = true\n", iterated)
 			f(e.block)
 			g.bodyPrintf("}\n")
+			g.bodyPrintf("if !%s {\n", iterated)
+			f(e.alt)
+			g.bodyPrintf("}\n")
+			g.bodyPrintf("}\n")
+			return false
+		case *nodeSwitch:
+			g.nodeLineNo(e)
+			g.bodyPrintf("switch %s {\n", e.tag.code)
+			for _, c := range e.cases {
+				g.nodeLineNo(c)
+				if c.isDefault() {
+					g.bodyPrintf("default:\n")
+				} else {
+					g.bodyPrintf("case %s:\n", c.list.code)
+				}
+				f(c.block)
+			}
+			g.bodyPrintf("}\n")
 			return false
 		case *nodeBlock:
 			f(nodeList(e.nodes))
@@ -174,9 +295,62 @@ func (g *layoutCodeGen) genNode(n node) {
 		case *nodeSection:
 			f(e.block)
 			return false
+		case *nodeComponent:
+			g.nodeLineNo(e)
+			g.bodyPrintf("{\n")
+			args := e.args
+			if e.children != nil {
+				g.used("bytes", "html/template")
+				buf := fmt.Sprintf("__pushup_children%d", e.pos.start)
+				g.bodyPrintf("%s := new(bytes.Buffer)\n", buf)
+				save := g.ioWriterVar
+				g.ioWriterVar = buf
+				f(e.children)
+				g.ioWriterVar = save
+				args = joinComponentArgs(args, "children: template.HTML("+buf+".String())")
+			}
+			g.nodeLineNo(e)
+			g.bodyPrintf("%s(%s, req, %s{%s})\n", componentFuncName(e.name), g.ioWriterVar, componentPropsTypename(e.name), args)
+			g.bodyPrintf("}\n")
+			return false
+		case *nodeProp:
+			// nothing to do, props are declared in the component's function
+			// signature
 		case *nodePartial:
 			// FIXME(paulsmith): prune these out in newLayoutFromTree
 			panic("partials are not allowed in layouts")
+		case *nodeTry:
+			g.used("io")
+			g.nodeLineNo(e)
+			save := g.ioWriterVar
+			g.ioWriterVar = fmt.Sprintf("__pushup_try%d", e.pos.start)
+			call := fmt.Sprintf("tryRender(%s, %q, func(%s io.Writer) {\n", save, g.nodePosString(e), g.ioWriterVar)
+			switch {
+			case e.catch == nil:
+				g.bodyPrintf("%s", call)
+			case e.errVar == "":
+				g.bodyPrintf("if %s", call)
+			default:
+				g.bodyPrintf("if %s := %s", e.errVar, call)
+			}
+			f(e.block)
+			g.ioWriterVar = save
+			switch {
+			case e.catch == nil:
+				g.bodyPrintf("})\n")
+			case e.errVar == "":
+				g.bodyPrintf("}) != nil {\n")
+			default:
+				g.bodyPrintf("}); %s != nil {\n", e.errVar)
+			}
+			if e.catch != nil {
+				f(e.catch)
+				g.bodyPrintf("}\n")
+			}
+			return false
+		case *nodeFlush:
+			g.nodeLineNo(e)
+			g.bodyPrintf("flushOutput(%s)\n", g.ioWriterVar)
 		case *nodeLayout:
 			// nothing to do
 		case *nodeImport:
@@ -230,22 +404,54 @@ func genCodeLayout(g *layoutCodeGen) ([]byte, error) {
 	g.bodyPrintf("  layouts[\"%s\"] = new(%s)\n", layoutName(g.pfile.relpath()), typename)
 	g.bodyPrintf("}\n\n")
 
-	g.used("net/http", "html/template")
-	g.bodyPrintf("func (%s *%s) Respond(w http.ResponseWriter, req *http.Request, sections map[string]chan template.HTML) error {\n", methodReceiverName, typename)
+	g.used("net/http")
+	g.bodyPrintf("func (%s *%s) Respond(w http.ResponseWriter, req *http.Request, sections *layoutSections) error {\n", methodReceiverName, typename)
 
 	// sections support
-	g.used("html/template")
 	g.bodyPrintf(`
-sectionDefined := func(name string) bool {
-	_, ok := sections[name]
-	return ok
-}
+sectionDefined := sections.defined
 _ = sectionDefined
-
-outputSection := func(name string) template.HTML {
-	return <-sections[name]
-}
+outputSection := sections.output
+_ = outputSection
 `)
+	if !g.layout.hasParent() {
+		g.bodyPrintf("sections.streamTo(w)\n")
+	}
+
+	// a layout with a parent passes its contents and its own sections to the
+	// parent as functions that render them when the parent outputs them,
+	// along with the sections of the page (or child layout) it doesn't
+	// override. the parent is resolved first so that an unknown layout fails
+	// before any output.
+	save := g.ioWriterVar
+	if g.layout.hasParent() {
+		parentName := strconv.Quote(g.layout.parent)
+		if g.layout.parentExpr != "" {
+			if g.lineDirectivesEnabled {
+				g.emitLineDirective(g.lineNo(g.layout.parentPos))
+			}
+			parentName = g.layout.parentExpr
+		}
+		g.bodyPrintf("parent, req, err := getParentLayout(req, %s, %s)\n", strconv.Quote(layoutName(g.pfile.relpath())), parentName)
+		g.bodyPrintf("if err != nil {\n")
+		g.bodyPrintf("  return err\n")
+		g.bodyPrintf("}\n")
+		g.used("io")
+		g.bodyPrintf("__pushup_own := make(map[string]func(io.Writer))\n")
+		g.ioWriterVar = "__pushup_w"
+		// in a fixed order, so that the generated code is the same every build
+		names := make([]string, 0, len(g.layout.sections))
+		for name := range g.layout.sections {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			g.bodyPrintf("__pushup_own[%s] = func(%s io.Writer) {\n", strconv.Quote(name), g.ioWriterVar)
+			g.genNode(g.layout.sections[name])
+			g.bodyPrintf("}\n")
+		}
+		g.bodyPrintf("return parent.Respond(w, req, sections.forParent(func(%s io.Writer) {\n", g.ioWriterVar)
+	}
 
 	// Make a new scope for the user's code block and HTML. This will help (but not fully prevent)
 	// name collisions with the surrounding code.
@@ -258,7 +464,181 @@ outputSection := func(name string) template.HTML {
 	g.bodyPrintf("// End user Go code and HTML\n")
 	g.bodyPrintf("}\n")
 
-	g.bodyPrintf("return nil\n")
+	if g.layout.hasParent() {
+		g.bodyPrintf("}, __pushup_own))\n")
+		g.ioWriterVar = save
+	} else {
+		g.bodyPrintf("return nil\n")
+	}
+	g.bodyPrintf("}\n")
+
+	g.outPrintf("import (\n")
+	for decl, ok := range g.imports {
+		if ok {
+			if decl.pkgName != "" {
+				g.outPrintf("%s ", decl.pkgName)
+			}
+			g.outPrintf("%s\n", decl.path)
+		}
+	}
+	g.outPrintf(")\n\n")
+
+	raw, err := io.ReadAll(io.MultiReader(&g.outb, &g.bodyb))
+	if err != nil {
+		return nil, fmt.Errorf("reading all buffers: %w", err)
+	}
+
+	formatted, err := format.Source(raw)
+	if err != nil {
+		return nil, fmt.Errorf("gofmt the generated code: %w", err)
+	}
+
+	return formatted, nil
+}
+
+// component represents a Pushup component that has been parsed and is ready
+// for code generation. a component is a reusable piece of markup with typed
+// props, which is compiled to a Go function that pages, layouts, and other
+// components can call.
+type component struct {
+	imports []importDecl
+	props   []*nodeProp
+	nodes   []node
+}
+
+func newComponentFromTree(tree *syntaxTree) (*component, error) {
+	comp := &component{}
+	seen := make(map[string]bool)
+	var err error
+	var f inspector
+	f = func(e node) bool {
+		switch e := e.(type) {
+		case *nodeImport:
+			comp.imports = append(comp.imports, e.decl)
+		case *nodeProp:
+			if e.name == "children" {
+				err = fmt.Errorf("prop name %q is reserved for a component's child content", e.name)
+			} else if seen[e.name] {
+				err = fmt.Errorf("prop %q already declared", e.name)
+			}
+			seen[e.name] = true
+			comp.props = append(comp.props, e)
+		case *nodeLayout:
+			err = fmt.Errorf("layouts are not allowed in components")
+		case *nodeParam:
+			err = fmt.Errorf("%s%s is only allowed in pages", transSymStr, e.kind)
+		case *nodeSection:
+			err = fmt.Errorf("sections are not allowed in components")
+		case *nodePartial:
+			err = fmt.Errorf("partials are not allowed in components")
+		case *nodeGoCode:
+			if e.context == handlerGoCode {
+				err = fmt.Errorf("handlers are not allowed in components")
+			} else {
+				comp.nodes = append(comp.nodes, e)
+			}
+		case nodeList:
+			for _, x := range e {
+				f(x)
+			}
+		default:
+			comp.nodes = append(comp.nodes, e)
+		}
+		return false
+	}
+	inspect(nodeList(tree.nodes), f)
+	if err != nil {
+		return nil, err
+	}
+	return comp, nil
+}
+
+// componentCodeGen generates the Go code for a component. the body of a
+// component has the same shape as a layout's, so it reuses the layout code
+// generator for it.
+type componentCodeGen struct {
+	*layoutCodeGen
+	component *component
+}
+
+func newComponentCodeGen(comp *component, pfile projectFile, source string) *componentCodeGen {
+	return &componentCodeGen{
+		layoutCodeGen: newLayoutCodeGen(&layout{imports: comp.imports, nodes: comp.nodes}, pfile, source),
+		component:     comp,
+	}
+}
+
+// componentName returns the name by which pages and layouts invoke the
+// component, e.g., "Card" for app/components/card.up.
+func componentName(pfile projectFile) string {
+	relpath := pfile.relpath()
+	return typenameFromPath(strings.TrimSuffix(relpath, filepath.Ext(relpath)))
+}
+
+// componentFuncName returns the name of the generated Go function that renders
+// the named component.
+func componentFuncName(name string) string {
+	return "render" + name + "Component"
+}
+
+// componentPropsTypename returns the name of the generated Go struct type that
+// holds the props of the named component.
+func componentPropsTypename(name string) string {
+	return name + "ComponentProps"
+}
+
+func joinComponentArgs(args ...string) string {
+	var nonempty []string
+	for _, a := range args {
+		if a != "" {
+			nonempty = append(nonempty, a)
+		}
+	}
+	return strings.Join(nonempty, ", ")
+}
+
+func genCodeComponent(g *componentCodeGen) ([]byte, error) {
+	// FIXME(paulsmith): need way to specify this as user
+	packageName := "build"
+
+	g.outPrintf("// this file is mechanically generated, do not edit!\n")
+	g.outPrintf("// version: ")
+	printVersion(&g.outb)
+	g.outPrintf("\n")
+	g.outPrintf("package %s\n\n", packageName)
+
+	name := componentName(g.pfile)
+
+	// the props struct. the Go compiler type-checks the props at the call
+	// sites in pages and layouts, which are composite literals of this type.
+	g.used("html/template")
+	g.bodyPrintf("type %s struct {\n", componentPropsTypename(name))
+	for _, prop := range g.component.props {
+		g.nodeLineNo(prop)
+		g.bodyPrintf("%s %s\n", prop.name, prop.typ)
+	}
+	g.bodyPrintf("children template.HTML\n")
+	g.bodyPrintf("}\n\n")
+
+	g.used("io", "net/http")
+	g.bodyPrintf("func %s(w io.Writer, req *http.Request, props %s) {\n", componentFuncName(name), componentPropsTypename(name))
+	for _, prop := range g.component.props {
+		g.bodyPrintf("%s := props.%s\n", prop.name, prop.name)
+		g.bodyPrintf("_ = %s\n", prop.name)
+	}
+	g.bodyPrintf("children := props.children\n")
+	g.bodyPrintf("_ = children\n")
+
+	// Make a new scope for the user's code block and HTML. This will help (but not fully prevent)
+	// name collisions with the surrounding code.
+	g.bodyPrintf("\n// Begin user Go code and HTML\n")
+	g.bodyPrintf("{\n")
+
+	g.generate()
+
+	// Close the scope we started for the user code and HTML.
+	g.bodyPrintf("// End user Go code and HTML\n")
+	g.bodyPrintf("}\n")
 	g.bodyPrintf("}\n")
 
 	g.outPrintf("import (\n")
@@ -288,11 +668,25 @@ outputSection := func(name string) template.HTML {
 // page represents a Pushup page that has been parsed and is ready for code
 // generation.
 type page struct {
-	layout   string
-	imports  []importDecl
-	handler  *nodeGoCode
-	nodes    []node
-	sections map[string]*nodeBlock
+	layout string
+	// layoutExpr is the Go expression of a `^layout(expr)' directive, which
+	// selects the layout at request time instead of layout.
+	layoutExpr string
+	layoutPos  span
+	imports    []importDecl
+	handler    *nodeGoCode
+	params     []*nodeParam
+	nodes      []node
+	sections   map[string]*nodeBlock
+
+	// deferred are the sections declared with `^section name defer', which
+	// a streaming layout doesn't wait for.
+	deferred map[string]*nodeSection
+
+	// methodHandlers are the handlers declared for one HTTP method each, in
+	// the order of the source. a page with any responds only to their
+	// methods.
+	methodHandlers []*nodeGoCode
 
 	// partials is a list of all top-level inline partials in this page.
 	partials []*partial
@@ -304,6 +698,9 @@ type partial struct {
 	name     string
 	parent   *partial
 	children []*partial
+	// section is the block of the section the partial is declared in, if
+	// any, since sections aren't among the page's nodes
+	section *nodeBlock
 }
 
 // urlpath produces the URL path segment for the partial. this takes in to
@@ -318,15 +715,32 @@ func (p *partial) urlpath() string {
 	return strings.Join(segments, "/")
 }
 
+// paramTypeNames are the Go types a `^param' or `^query' may be declared as.
+var paramTypeNames = []string{"string", "int", "int64", "uint", "float64", "bool", "[]string"}
+
+var paramTypes = func() map[string]bool {
+	m := make(map[string]bool)
+	for _, name := range paramTypeNames {
+		m[name] = true
+	}
+	return m
+}()
+
 // newPageFromTree produces a page which is the main prepared object for code
 // generation. this requires walking the syntax tree and reorganizing things
 // somewhat to make them easier to access. some node types are encountered
 // sequentially in the source file, but need to be reorganized for access in
-// the code generator.
-func newPageFromTree(tree *syntaxTree) (*page, error) {
+// the code generator. source is the page's source, for the positions of
+// errors, and defaultLayout is the layout of a page without a `^layout'
+// directive.
+func newPageFromTree(tree *syntaxTree, source string, defaultLayout string) (*page, error) {
 	page := &page{
-		layout:   "default",
+		layout:   defaultLayout,
 		sections: make(map[string]*nodeBlock),
+		deferred: make(map[string]*nodeSection),
+	}
+	if page.layout == "!" {
+		page.layout = ""
 	}
 
 	layoutSet := false
@@ -345,17 +759,32 @@ func newPageFromTree(tree *syntaxTree) (*page, error) {
 			page.imports = append(page.imports, e.decl)
 		case *nodeLayout:
 			if layoutSet {
-				err = fmt.Errorf("layout already set as %q", page.layout)
+				if page.layoutExpr != "" {
+					err = fmt.Errorf("layout already set as (%s)", page.layoutExpr)
+				} else {
+					err = fmt.Errorf("layout already set as %q", page.layout)
+				}
 				return false
 			}
-			if e.name == "!" {
+			if e.expr != "" {
+				page.layoutExpr = e.expr
+				page.layoutPos = e.pos
+			} else if e.name == "!" {
 				page.layout = ""
 			} else {
 				page.layout = e.name
 			}
 			layoutSet = true
 		case *nodeGoCode:
-			if e.context == handlerGoCode {
+			if e.context == handlerGoCode && e.method != "" {
+				for _, h := range page.methodHandlers {
+					if h.method == e.method {
+						err = fmt.Errorf("only one %s handler per page can be defined", e.method)
+						return false
+					}
+				}
+				page.methodHandlers = append(page.methodHandlers, e)
+			} else if e.context == handlerGoCode {
 				if page.handler != nil {
 					err = fmt.Errorf("only one handler per page can be defined")
 					return false
@@ -371,6 +800,24 @@ func newPageFromTree(tree *syntaxTree) (*page, error) {
 			}
 		case *nodeSection:
 			page.sections[e.name] = e.block
+			if e.deferred {
+				page.deferred[e.name] = e
+			}
+		case *nodeProp:
+			err = fmt.Errorf(transSymStr + "prop is only allowed in components")
+			return false
+		case *nodeParam:
+			if !paramTypes[e.typ] {
+				err = syntaxErrorAt(source, e.pos, "unsupported type %s for %s%s %s, must be one of %s", e.typ, transSymStr, e.kind, e.name, strings.Join(paramTypeNames, ", "))
+				return false
+			}
+			for _, prev := range page.params {
+				if prev.name == e.name {
+					err = syntaxErrorAt(source, e.pos, "parameter %q already declared", e.name)
+					return false
+				}
+			}
+			page.params = append(page.params, e)
 		default:
 			tree.nodes[n] = e
 			n++
@@ -389,6 +836,7 @@ func newPageFromTree(tree *syntaxTree) (*page, error) {
 	// traversal of the tree is slightly different than the pass above.
 	{
 		var currentPartial *partial
+		var currentSection *nodeBlock
 		var f inspector
 		f = func(e node) bool {
 			switch e := e.(type) {
@@ -412,15 +860,34 @@ func newPageFromTree(tree *syntaxTree) (*page, error) {
 				return false
 			case *nodeFor:
 				f(e.block)
+				if e.alt != nil {
+					f(e.alt)
+				}
+				return false
+			case *nodeSwitch:
+				for _, c := range e.cases {
+					f(c.block)
+				}
+				return false
+			case *nodeComponent:
+				if e.children != nil {
+					f(e.children)
+				}
 				return false
 			case *nodeBlock:
 				f(nodeList(e.nodes))
 				return false
+			case *nodeTry:
+				f(e.block)
+				if e.catch != nil {
+					f(e.catch)
+				}
+				return false
 			case *nodeSection:
 				f(e.block)
 				return false
 			case *nodePartial:
-				p := &partial{node: e, name: e.name, parent: currentPartial}
+				p := &partial{node: e, name: e.name, parent: currentPartial, section: currentSection}
 				if currentPartial != nil {
 					currentPartial.children = append(currentPartial.children, p)
 				}
@@ -438,6 +905,22 @@ func newPageFromTree(tree *syntaxTree) (*page, error) {
 			return false
 		}
 		inspect(nodeList(page.nodes), f)
+		// the sections were removed from the tree by the pass above, but may
+		// declare partials too. in a fixed order, so that the generated code
+		// is the same every build
+		names := make([]string, 0, len(page.sections))
+		for name := range page.sections {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			currentSection = page.sections[name]
+			f(currentSection)
+			if sec, ok := page.deferred[name]; ok && sec.fallback != nil {
+				currentSection = sec.fallback
+				f(currentSection)
+			}
+		}
 	}
 
 	return page, nil
@@ -496,6 +979,12 @@ func (g *pageCodeGen) emitLineDirective(n int) {
 	g.bodyPrintf("//line %s:%d\n", g.pfile.relpath(), n)
 }
 
+// nodePosString returns the position of e in the .up file, for messages
+// about it at runtime.
+func (g *pageCodeGen) nodePosString(e node) string {
+	return fmt.Sprintf("%s:%d", g.pfile.relpath(), g.lineNo(e.Pos()))
+}
+
 func (g *pageCodeGen) outPrintf(format string, args ...any) {
 	fmt.Fprintf(&g.outb, format, args...)
 }
@@ -526,7 +1015,15 @@ func (g *pageCodeGen) genNode(n node) {
 			return false
 		case *nodeGoStrExpr:
 			g.nodeLineNo(e)
-			g.bodyPrintf("printEscaped(%s, %s)\n", g.ioWriterVar, e.expr)
+			g.bodyPrintf("%s\n", printExprCall(g.ioWriterVar, e))
+		case *nodeCondAttr:
+			g.nodeLineNo(e)
+			g.bodyPrintf("%s\n", condAttrCall(g.ioWriterVar, e))
+			return false
+		case *nodeSpreadAttrs:
+			g.nodeLineNo(e)
+			g.bodyPrintf("%s\n", spreadAttrsCall(g.ioWriterVar, e))
+			return false
 		case *nodeGoCode:
 			if e.context != inlineGoCode {
 				panic("internal error: expected inlineGoCode")
@@ -557,9 +1054,37 @@ func (g *pageCodeGen) genNode(n node) {
 			}
 			return false
 		case *nodeFor:
+			if e.alt == nil {
+				g.bodyPrintf("for %s {\n", e.clause.code)
+				f(e.block)
+				g.bodyPrintf("}\n")
+				return false
+			}
+			iterated := forIteratedVar(e)
+			g.bodyPrintf("{\n")
+			g.bodyPrintf("%s := false\n", iterated)
 			g.bodyPrintf("for %s {\n", e.clause.code)
+			g.bodyPrintf("%s = true\n", iterated)
 			f(e.block)
 			g.bodyPrintf("}\n")
+			g.bodyPrintf("if !%s {\n", iterated)
+			f(e.alt)
+			g.bodyPrintf("}\n")
+			g.bodyPrintf("}\n")
+			return false
+		case *nodeSwitch:
+			g.nodeLineNo(e)
+			g.bodyPrintf("switch %s {\n", e.tag.code)
+			for _, c := range e.cases {
+				g.nodeLineNo(c)
+				if c.isDefault() {
+					g.bodyPrintf("default:\n")
+				} else {
+					g.bodyPrintf("case %s:\n", c.list.code)
+				}
+				f(c.block)
+			}
+			g.bodyPrintf("}\n")
 			return false
 		case *nodeBlock:
 			f(nodeList(e.nodes))
@@ -567,9 +1092,59 @@ func (g *pageCodeGen) genNode(n node) {
 		case *nodeSection:
 			f(e.block)
 			return false
+		case *nodeComponent:
+			g.nodeLineNo(e)
+			g.bodyPrintf("{\n")
+			args := e.args
+			if e.children != nil {
+				g.used("bytes", "html/template")
+				buf := fmt.Sprintf("__pushup_children%d", e.pos.start)
+				g.bodyPrintf("%s := new(bytes.Buffer)\n", buf)
+				save := g.ioWriterVar
+				g.ioWriterVar = buf
+				f(e.children)
+				g.ioWriterVar = save
+				args = joinComponentArgs(args, "children: template.HTML("+buf+".String())")
+			}
+			g.nodeLineNo(e)
+			g.bodyPrintf("%s(%s, req, %s{%s})\n", componentFuncName(e.name), g.ioWriterVar, componentPropsTypename(e.name), args)
+			g.bodyPrintf("}\n")
+			return false
 		case *nodePartial:
 			f(e.block)
 			return false
+		case *nodeTry:
+			g.used("io")
+			g.nodeLineNo(e)
+			save := g.ioWriterVar
+			g.ioWriterVar = fmt.Sprintf("__pushup_try%d", e.pos.start)
+			call := fmt.Sprintf("tryRender(%s, %q, func(%s io.Writer) {\n", save, g.nodePosString(e), g.ioWriterVar)
+			switch {
+			case e.catch == nil:
+				g.bodyPrintf("%s", call)
+			case e.errVar == "":
+				g.bodyPrintf("if %s", call)
+			default:
+				g.bodyPrintf("if %s := %s", e.errVar, call)
+			}
+			f(e.block)
+			g.ioWriterVar = save
+			switch {
+			case e.catch == nil:
+				g.bodyPrintf("})\n")
+			case e.errVar == "":
+				g.bodyPrintf("}) != nil {\n")
+			default:
+				g.bodyPrintf("}); %s != nil {\n", e.errVar)
+			}
+			if e.catch != nil {
+				f(e.catch)
+				g.bodyPrintf("}\n")
+			}
+			return false
+		case *nodeFlush:
+			g.nodeLineNo(e)
+			g.bodyPrintf("flushOutput(%s)\n", g.ioWriterVar)
 		case *nodeLayout:
 			// nothing to do
 		case *nodeImport:
@@ -582,6 +1157,98 @@ func (g *pageCodeGen) genNode(n node) {
 
 // NOTE(paulsmith): per DOM spec, "In tree order is preorder, depth-first traversal of a tree."
 
+// genHandlers emits the code of the page's handlers. the handler of every
+// method comes first, so that the variables it declares are in scope for the
+// handlers of single methods as well as the page's markup. the router has
+// already turned away requests with other methods.
+func (g *pageCodeGen) genHandlers() {
+	if h := g.page.handler; h != nil {
+		g.genHandler(h)
+	}
+	if len(g.page.methodHandlers) == 0 {
+		return
+	}
+	g.bodyPrintf("switch req.Method {\n")
+	for _, h := range g.page.methodHandlers {
+		if h.method == "GET" {
+			g.bodyPrintf("case \"GET\", \"HEAD\":\n")
+		} else {
+			g.bodyPrintf("case %s:\n", strconv.Quote(h.method))
+		}
+		g.genHandler(h)
+	}
+	g.bodyPrintf("}\n")
+}
+
+func (g *pageCodeGen) genHandler(h *nodeGoCode) {
+	srcLineNo := g.lineNo(h.Pos())
+	lines := strings.Split(h.code, "\n")
+	for _, line := range lines {
+		if g.lineDirectivesEnabled {
+			g.emitLineDirective(srcLineNo)
+		}
+		g.bodyPrintf("  %s\n", line)
+		srcLineNo++
+	}
+}
+
+// genMethods emits the methods() method of a page or partial's type, which
+// tells the router the HTTP methods the page has handlers for.
+func (g *pageCodeGen) genMethods(typename string) {
+	if len(g.page.methodHandlers) == 0 {
+		return
+	}
+	methods := make([]string, len(g.page.methodHandlers))
+	for i, h := range g.page.methodHandlers {
+		methods[i] = strconv.Quote(h.method)
+	}
+	g.bodyPrintf("func (%s *%s) methods() []string {\n", methodReceiverName, typename)
+	g.bodyPrintf("  return []string{%s}\n", strings.Join(methods, ", "))
+	g.bodyPrintf("}\n\n")
+}
+
+// genParams declares the page's `^param' and `^query' parameters as local
+// variables, parsed from the request. it comes before the handler so that the
+// handler can use them.
+func (g *pageCodeGen) genParams() {
+	for _, p := range g.page.params {
+		if g.lineDirectivesEnabled {
+			g.emitLineDirective(g.lineNo(p.Pos()))
+		}
+		if p.dflt != "" {
+			g.bodyPrintf("var %s %s = %s\n", p.name, p.typ, p.dflt)
+		} else {
+			g.bodyPrintf("var %s %s\n", p.name, p.typ)
+		}
+		bind := "bindRouteParam"
+		if p.kind == queryParam {
+			bind = "bindQueryParam"
+		}
+		g.bodyPrintf("if err := %s(req, %s, &%s); err != nil {\n", bind, strconv.Quote(p.name), p.name)
+		g.bodyPrintf("  return err\n")
+		g.bodyPrintf("}\n")
+	}
+}
+
+// routeSlug is a dynamic segment of a route.
+type routeSlug struct {
+	rest     bool
+	optional bool
+}
+
+// routeSlugs returns the dynamic segments of a route by name, e.g., "id" for
+// "/album/:id".
+func routeSlugs(route string) map[string]routeSlug {
+	slugs := make(map[string]routeSlug)
+	for _, seg := range strings.Split(route, "/") {
+		if strings.HasPrefix(seg, ":") || strings.HasPrefix(seg, "*") {
+			name := strings.TrimSuffix(seg[1:], "?")
+			slugs[name] = routeSlug{rest: seg[0] == '*', optional: strings.HasSuffix(seg, "?")}
+		}
+	}
+	return slugs
+}
+
 func (g *pageCodeGen) genNodePartial(n node, p *partial) {
 	var f inspector
 	var state int
@@ -620,13 +1287,39 @@ func (g *pageCodeGen) genNodePartial(n node, p *partial) {
 			case *nodeGoStrExpr:
 				if state == stateInPartialScope {
 					g.nodeLineNo(n)
-					g.bodyPrintf("printEscaped(%s, %s)\n", g.ioWriterVar, n.expr)
+					g.bodyPrintf("%s\n", printExprCall(g.ioWriterVar, n))
+				}
+			case *nodeCondAttr:
+				if state == stateInPartialScope {
+					g.nodeLineNo(n)
+					g.bodyPrintf("%s\n", condAttrCall(g.ioWriterVar, n))
+				}
+				return false
+			case *nodeSpreadAttrs:
+				if state == stateInPartialScope {
+					g.nodeLineNo(n)
+					g.bodyPrintf("%s\n", spreadAttrsCall(g.ioWriterVar, n))
 				}
+				return false
 			case *nodeFor:
 				if state == stateInPartialScope {
+					if n.alt == nil {
+						g.bodyPrintf("for %s {\n", n.clause.code)
+						f(n.block)
+						g.bodyPrintf("}\n")
+						return false
+					}
+					iterated := forIteratedVar(n)
+					g.bodyPrintf("{\n")
+					g.bodyPrintf("%s := false\n", iterated)
 					g.bodyPrintf("for %s {\n", n.clause.code)
+					g.bodyPrintf("%s = true\n", iterated)
 					f(n.block)
 					g.bodyPrintf("}\n")
+					g.bodyPrintf("if !%s {\n", iterated)
+					f(n.alt)
+					g.bodyPrintf("}\n")
+					g.bodyPrintf("}\n")
 				}
 				return false
 			case *nodeIf:
@@ -640,6 +1333,45 @@ func (g *pageCodeGen) genNodePartial(n node, p *partial) {
 					g.bodyPrintf("}\n")
 				}
 				return false
+			case *nodeSwitch:
+				g.nodeLineNo(n)
+				g.bodyPrintf("switch %s {\n", n.tag.code)
+				for _, c := range n.cases {
+					g.nodeLineNo(c)
+					if c.isDefault() {
+						g.bodyPrintf("default:\n")
+					} else {
+						g.bodyPrintf("case %s:\n", c.list.code)
+					}
+					f(c.block)
+				}
+				g.bodyPrintf("}\n")
+				return false
+			case *nodeComponent:
+				if state != stateInPartialScope {
+					// look for partials in the children
+					if n.children != nil {
+						f(n.children)
+					}
+					return false
+				}
+				g.nodeLineNo(n)
+				g.bodyPrintf("{\n")
+				args := n.args
+				if n.children != nil {
+					g.used("bytes", "html/template")
+					buf := fmt.Sprintf("__pushup_children%d", n.pos.start)
+					g.bodyPrintf("%s := new(bytes.Buffer)\n", buf)
+					save := g.ioWriterVar
+					g.ioWriterVar = buf
+					f(n.children)
+					g.ioWriterVar = save
+					args = joinComponentArgs(args, "children: template.HTML("+buf+".String())")
+				}
+				g.nodeLineNo(n)
+				g.bodyPrintf("%s(%s, req, %s{%s})\n", componentFuncName(n.name), g.ioWriterVar, componentPropsTypename(n.name), args)
+				g.bodyPrintf("}\n")
+				return false
 			case *nodeGoCode:
 				if n.context != inlineGoCode {
 					panic("internal error: expected inlineGoCode")
@@ -653,6 +1385,42 @@ func (g *pageCodeGen) genNodePartial(n node, p *partial) {
 					g.bodyPrintf("%s\n", line)
 					srcLineNo++
 				}
+			case *nodeTry:
+				// Go code in the blocks is emitted outside of the partial's
+				// scope too, so it must be guarded all the same
+				g.used("io")
+				g.nodeLineNo(n)
+				save := g.ioWriterVar
+				g.ioWriterVar = fmt.Sprintf("__pushup_try%d", n.pos.start)
+				call := fmt.Sprintf("tryRender(%s, %q, func(%s io.Writer) {\n", save, g.nodePosString(n), g.ioWriterVar)
+				switch {
+				case n.catch == nil:
+					g.bodyPrintf("%s", call)
+				case n.errVar == "":
+					g.bodyPrintf("if %s", call)
+				default:
+					g.bodyPrintf("if %s := %s", n.errVar, call)
+				}
+				f(n.block)
+				g.ioWriterVar = save
+				switch {
+				case n.catch == nil:
+					g.bodyPrintf("})\n")
+				case n.errVar == "":
+					g.bodyPrintf("}) != nil {\n")
+				default:
+					g.bodyPrintf("}); %s != nil {\n", n.errVar)
+				}
+				if n.catch != nil {
+					f(n.catch)
+					g.bodyPrintf("}\n")
+				}
+				return false
+			case *nodeFlush:
+				if state == stateInPartialScope {
+					g.nodeLineNo(n)
+					g.bodyPrintf("flushOutput(%s)\n", g.ioWriterVar)
+				}
 			case nodeList:
 				for _, x := range n {
 					f(x)
@@ -670,6 +1438,29 @@ func (g *pageCodeGen) genNodePartial(n node, p *partial) {
 	inspect(n, f)
 }
 
+// errorPageStatus reports whether the Pushup page is an error page, named for
+// the HTTP status code of the responses it renders, like `_404.up', and
+// returns the code.
+func errorPageStatus(relpath string) (int, bool) {
+	file := filepath.Base(relpath)
+	base := strings.TrimSuffix(file, filepath.Ext(file))
+	if len(base) != 4 || base[0] != '_' {
+		return 0, false
+	}
+	code, err := strconv.Atoi(base[1:])
+	if err != nil || code < 400 || code > 599 {
+		return 0, false
+	}
+	return code, true
+}
+
+// errorPagePrefix returns the route prefix of the URL paths an error page
+// renders responses for, the route of its directory without the trailing
+// slash.
+func errorPagePrefix(relpath string) string {
+	return strings.TrimSuffix(routeForPage(filepath.Join(filepath.Dir(relpath), "index"+upFileExt)), "/")
+}
+
 // routeForPage produces the URL path route from the name of the Pushup page.
 // relpath is the path to the Pushup file, relative to its containing app
 // directory in the Pushup project (so that part should not be part of the
@@ -686,11 +1477,15 @@ func routeForPage(relpath string) string {
 	if base != "index" {
 		dirs = append(dirs, base)
 	}
-	for i := range dirs {
-		if strings.HasPrefix(dirs[i], "$") {
-			dirs[i] = ":" + dirs[i][1:]
+	var segments []string
+	for _, dir := range dirs {
+		// route group directories organize pages without adding a segment
+		if isRouteGroup(dir) {
+			continue
 		}
+		segments = append(segments, routeSegment(dir))
 	}
+	dirs = segments
 	route = "/" + strings.Join(dirs, "/")
 	if base == "index" && route[len(route)-1] != '/' {
 		// indexes always have a trailing slash
@@ -699,6 +1494,36 @@ func routeForPage(relpath string) string {
 	return route
 }
 
+// isRouteGroup reports whether the name of a pages directory is a route group,
+// like `(marketing)', which is left out of the routes of the pages in it.
+func isRouteGroup(name string) bool {
+	return len(name) > 2 && name[0] == '(' && name[len(name)-1] == ')'
+}
+
+// routeSegment converts a file or directory name to a route segment. a name
+// starting with `$' is a dynamic segment: `$name' matches a single segment,
+// `$...name' one or more segments, and wrapped in brackets, `$[name]' or
+// `$[...name]', the segment is optional.
+func routeSegment(name string) string {
+	if !strings.HasPrefix(name, "$") {
+		return name
+	}
+	name = name[1:]
+	optional := false
+	if strings.HasPrefix(name, "[") && strings.HasSuffix(name, "]") {
+		name = name[1 : len(name)-1]
+		optional = true
+	}
+	seg := ":" + name
+	if strings.HasPrefix(name, "...") {
+		seg = "*" + name[3:]
+	}
+	if optional {
+		seg += "?"
+	}
+	return seg
+}
+
 func routeForPartial(relpath string, partialUrlpath string) string {
 	prefix := strings.TrimSuffix(relpath, filepath.Ext(relpath))
 	if filepath.Base(prefix) == "index" {
@@ -730,6 +1555,39 @@ func genCodePage(g *pageCodeGen) ([]byte, error) {
 		typ  string
 	}
 
+	// error pages aren't routed to, so have no route parameters or partials
+	code, isErrorPage := errorPageStatus(g.pfile.relpath())
+	if isErrorPage {
+		for _, p := range g.page.params {
+			if p.kind == routeParam {
+				return nil, syntaxErrorAt(g.source, p.pos, "%sparam is not allowed in error pages", transSymStr)
+			}
+		}
+		if len(g.page.partials) > 0 {
+			return nil, fmt.Errorf("partials are not allowed in error pages")
+		}
+	}
+
+	// route parameters must have a matching dynamic segment in the path
+	{
+		slugs := routeSlugs(routeForPage(g.pfile.relpath()))
+		for _, p := range g.page.params {
+			if p.kind != routeParam {
+				continue
+			}
+			slug, ok := slugs[p.name]
+			switch {
+			case !ok:
+				return nil, syntaxErrorAt(g.source, p.pos, "%sparam %s has no matching $%s segment in the page's path %s",
+					transSymStr, p.name, p.name, g.pfile.relpath())
+			case p.dflt != "" && !slug.optional:
+				return nil, syntaxErrorAt(g.source, p.pos, "%sparam %s can't have a default value, its segment is not optional", transSymStr, p.name)
+			case p.typ == "[]string" && !slug.rest:
+				return nil, syntaxErrorAt(g.source, p.pos, "%sparam %s can only be a []string for a $...%s rest segment", transSymStr, p.name, p.name)
+			}
+		}
+	}
+
 	// main page
 	{
 		typename := generatedTypename(g.pfile, upFilePage)
@@ -747,6 +1605,8 @@ func genCodePage(g *pageCodeGen) ([]byte, error) {
 		g.bodyPrintf("  return %#v\n", os.Args)
 		g.bodyPrintf("}\n\n")
 
+		g.genMethods(typename)
+
 		g.used("net/http")
 		g.bodyPrintf("func (%s *%s) Respond(w http.ResponseWriter, req *http.Request) error {\n", methodReceiverName, typename)
 
@@ -754,114 +1614,74 @@ func genCodePage(g *pageCodeGen) ([]byte, error) {
 		// function/method, but would have to figure out the interplay between
 		// user code and control flow, i.e., return an error if the handler
 		// wants to skip rendering, redirect, etc.
-		if h := g.page.handler; h != nil {
-			srcLineNo := g.lineNo(h.Pos())
-			lines := strings.Split(h.code, "\n")
-			for _, line := range lines {
-				if g.lineDirectivesEnabled {
-					g.emitLineDirective(srcLineNo)
-				}
-				g.bodyPrintf("  %s\n", line)
-				srcLineNo++
+		g.genParams()
+
+		g.genHandlers()
+
+		// the layout is resolved after the handler has run, so that both a
+		// ^layout(expr) directive and a call to SetLayout() in the handler
+		// may depend on the request. an unknown layout fails the request
+		// before any of the page is rendered.
+		g.bodyPrintf("// layout\n")
+		layoutName := strconv.Quote(g.page.layout)
+		if g.page.layoutExpr != "" {
+			if g.lineDirectivesEnabled {
+				g.emitLineDirective(g.lineNo(g.page.layoutPos))
 			}
+			layoutName = g.page.layoutExpr
 		}
+		g.bodyPrintf("layout, err := getLayout(layoutForRequest(req, %s))\n", layoutName)
+		g.used("fmt")
+		g.bodyPrintf("if err != nil {\n")
+		g.bodyPrintf("  return fmt.Errorf(\"page %%s: %%w\", %s, err)\n", strconv.Quote(g.pfile.relpath()))
+		g.bodyPrintf("}\n")
+		g.bodyPrintf("writeStatus(w, req)\n")
 
-		g.used("html/template")
+		// the page's contents and sections are functions that render them
+		// when the layout outputs them, on the request's goroutine, so that
+		// sections the layout doesn't output are never rendered.
+		g.used("io")
 		g.bodyPrintf("// sections\n")
-		g.bodyPrintf("sections := make(map[string]chan template.HTML)\n")
-		g.bodyPrintf("sections[\"contents\"] = make(chan template.HTML)\n")
-		for name := range g.page.sections {
-			g.bodyPrintf("sections[%s] = make(chan template.HTML)\n", strconv.Quote(name))
-		}
-
-		// TODO(paulsmith): this is where a flag that could conditionally toggle the rendering
-		// of the layout could go - maybe a special header in request object?
-		g.used("log", "sync", "context", "time")
-		g.bodyPrintf(
-			`
-			var wg sync.WaitGroup
-			layout := getLayout("%s")
-			ctx, cancel := context.WithTimeout(req.Context(), time.Second * 5)
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				defer cancel()
-				if err := layout.Respond(w, req.WithContext(ctx), sections); err != nil {
-					log.Printf("error responding with layout: %%v", err)
-					panic(err)
-				}
-			}()
-		`, g.page.layout)
-
-		// Make a new scope for the user's code block and HTML. This will help (but not fully prevent)
-		// name collisions with the surrounding code.
-		g.bodyPrintf("\n// Begin user Go code and HTML\n")
-		g.bodyPrintf("{\n")
-
-		g.bodyPrintf("var panicked any\n")
-		// render the main body contents
-		// TODO(paulsmith) could do these as a incremental stream
-		// so the receiving end is just pulling individual chunks off
-		g.bodyPrintf("wg.Add(1)\n")
-		g.bodyPrintf("go func() {\n")
-		g.bodyPrintf("  defer wg.Done()\n")
-		g.bodyPrintf("  defer func() {\n")
-		g.bodyPrintf("    if r := recover(); r != nil {\n")
-		g.bodyPrintf("      if panicked == nil {\n")
-		g.bodyPrintf("	      cancel()\n")
-		g.bodyPrintf("	      panicked = r\n")
-		g.bodyPrintf("	    }\n")
-		g.bodyPrintf("    }\n")
-		g.bodyPrintf("  }()\n")
-		g.used("bytes", "html/template")
+		g.bodyPrintf("sections := newLayoutSections()\n")
 		save := g.ioWriterVar
-		g.ioWriterVar = "__pushup_b"
-		g.bodyPrintf("  %s := new(bytes.Buffer)\n", g.ioWriterVar)
-		g.generate()
-		g.bodyPrintf("  sections[\"contents\"] <- template.HTML(%s.String())\n", g.ioWriterVar)
-		g.bodyPrintf("}()\n\n")
-		g.ioWriterVar = save
-
-		for name, block := range g.page.sections {
-			save := g.ioWriterVar
-			g.ioWriterVar = "__pushup_b"
-			g.bodyPrintf("wg.Add(1)\n")
-			g.bodyPrintf("go func() {\n")
-			g.bodyPrintf("  defer wg.Done()\n")
-			g.bodyPrintf("  defer func() {\n")
-			g.bodyPrintf("    if r := recover(); r != nil {\n")
-			g.bodyPrintf("      if panicked != nil {\n")
-			g.bodyPrintf("	      cancel()\n")
-			g.bodyPrintf("	      panicked = r\n")
-			g.bodyPrintf("	    }\n")
-			g.bodyPrintf("    }\n")
-			g.bodyPrintf("  }()\n")
-			g.bodyPrintf("  %s := new(bytes.Buffer)\n", g.ioWriterVar)
-			g.genNode(block)
-			g.bodyPrintf("  sections[%s] <- template.HTML(%s.String())\n", strconv.Quote(name), g.ioWriterVar)
-			g.bodyPrintf("}()\n")
-			g.ioWriterVar = save
-		}
+		g.ioWriterVar = "__pushup_w"
 
-		// Wait for layout to finish rendering
-		g.bodyPrintf("wg.Wait()\n")
+		// the function is a new scope for the user's code block and HTML.
+		// This will help (but not fully prevent) name collisions with the
+		// surrounding code.
+		g.bodyPrintf("sections.add(\"contents\", func(%s io.Writer) {\n", g.ioWriterVar)
+		g.bodyPrintf("// Begin user Go code and HTML\n")
+		g.generate()
+		g.bodyPrintf("// End user Go code and HTML\n")
+		g.bodyPrintf("})\n")
 
-		// Check if any of the goroutines panicked
-		g.bodyPrintf("if panicked != nil {\n")
-		g.bodyPrintf("  close(sections[\"contents\"])\n")
+		names := make([]string, 0, len(g.page.sections))
 		for name := range g.page.sections {
-			g.bodyPrintf("  close(sections[%s])\n", strconv.Quote(name))
+			names = append(names, name)
 		}
-		g.used("fmt")
-		g.bodyPrintf("  return fmt.Errorf(\"goroutine panicked: %%v\", panicked)\n")
-		g.bodyPrintf("}\n")
-
-		// Close the scope we started for the user code and HTML.
-		g.bodyPrintf("// End user Go code and HTML\n")
-		g.bodyPrintf("}\n")
+		sort.Strings(names)
+		for _, name := range names {
+			sec, deferred := g.page.deferred[name]
+			if deferred {
+				g.bodyPrintf("sections.addDeferred(req, %s, func(%s io.Writer) {\n", strconv.Quote(name), g.ioWriterVar)
+			} else {
+				g.bodyPrintf("sections.add(%s, func(%s io.Writer) {\n", strconv.Quote(name), g.ioWriterVar)
+			}
+			g.genNode(g.page.sections[name])
+			switch {
+			case !deferred:
+				g.bodyPrintf("})\n")
+			case sec.fallback != nil:
+				g.bodyPrintf("}, func(%s io.Writer) {\n", g.ioWriterVar)
+				g.genNode(sec.fallback)
+				g.bodyPrintf("})\n")
+			default:
+				g.bodyPrintf("}, nil)\n")
+			}
+		}
+		g.ioWriterVar = save
 
-		// return from Respond()
-		g.bodyPrintf("return nil\n")
+		g.bodyPrintf("return respondWithLayout(layout, w, req, sections)\n")
 		g.bodyPrintf("}\n")
 	}
 
@@ -877,6 +1697,8 @@ func genCodePage(g *pageCodeGen) ([]byte, error) {
 		}
 		g.bodyPrintf("}\n")
 
+		g.genMethods(typename)
+
 		g.used("net/http")
 		g.bodyPrintf("func (%s *%s) Respond(w http.ResponseWriter, req *http.Request) error {\n", methodReceiverName, typename)
 
@@ -884,17 +1706,10 @@ func genCodePage(g *pageCodeGen) ([]byte, error) {
 		// function/method, but would have to figure out the interplay between
 		// user code and control flow, i.e., return an error if the handler
 		// wants to skip rendering, redirect, etc.
-		if h := g.page.handler; h != nil {
-			srcLineNo := g.lineNo(h.Pos())
-			lines := strings.Split(h.code, "\n")
-			for _, line := range lines {
-				if g.lineDirectivesEnabled {
-					g.emitLineDirective(srcLineNo)
-				}
-				g.bodyPrintf("  %s\n", line)
-				srcLineNo++
-			}
-		}
+		g.genParams()
+
+		g.genHandlers()
+		g.bodyPrintf("writeStatus(w, req)\n")
 
 		// Make a new scope for the user's code block and HTML. This will help (but not fully prevent)
 		// name collisions with the surrounding code.
@@ -904,6 +1719,13 @@ func genCodePage(g *pageCodeGen) ([]byte, error) {
 		// FIXME(paulsmith): need to generate code for everything but emitting
 		// top-level page values to the output
 		g.genNodePartial(nodeList(g.page.nodes), partial)
+		if partial.section != nil {
+			// the section's code is in a scope of its own, as when the page
+			// renders the section
+			g.bodyPrintf("{\n")
+			g.genNodePartial(partial.section, partial)
+			g.bodyPrintf("}\n")
+		}
 
 		// Close the scope we started for the user code and HTML.
 		g.bodyPrintf("// End user Go code and HTML\n")
@@ -913,9 +1735,15 @@ func genCodePage(g *pageCodeGen) ([]byte, error) {
 		g.bodyPrintf("}\n")
 	}
 
+	dir := filepath.ToSlash(filepath.Dir(g.pfile.relpath()))
 	g.bodyPrintf("\nfunc init() {\n")
-	for _, initRoute := range inits {
-		g.bodyPrintf("  routes.add(%s, new(%s), %s)\n", strconv.Quote(initRoute.route), initRoute.typename, initRoute.role)
+	if isErrorPage {
+		prefix := errorPagePrefix(g.pfile.relpath())
+		g.bodyPrintf("  addErrorPage(%s, %d, new(%s))\n", strconv.Quote(prefix), code, inits[0].typename)
+	} else {
+		for _, initRoute := range inits {
+			g.bodyPrintf("  routes.add(%s, withMiddleware(%s, new(%s)), %s)\n", strconv.Quote(initRoute.route), strconv.Quote(dir), initRoute.typename, initRoute.role)
+		}
 	}
 	g.bodyPrintf("}\n\n")
 
@@ -959,6 +1787,8 @@ func generatedTypename(pfile projectFile, ftype upFileType) string {
 		suffix = "Page"
 	case upFileLayout:
 		suffix = "Layout"
+	case upFileComponent:
+		suffix = "Component"
 	default:
 		panic("unhandled file type")
 	}
@@ -976,6 +1806,9 @@ func generatedTypenamePartial(partial *partial, pfile projectFile) string {
 }
 
 func typenameFromPath(path string) string {
+	path = strings.ReplaceAll(path, "...", "Rest_")
+	path = strings.ReplaceAll(path, "[", "Optional_")
+	path = strings.ReplaceAll(path, "(", "Group_")
 	path = strings.ReplaceAll(path, "$", "DollarSign_")
 	buf := make([]rune, len(path))
 	i := 0
@@ -993,5 +1826,9 @@ func typenameFromPath(path string) string {
 			wordBoundary = true
 		}
 	}
+	// Go identifiers can't start with a digit, as from `_404.up' or `2024.up'
+	if i > 0 && unicode.IsDigit(buf[0]) {
+		return "Number" + string(buf[:i])
+	}
 	return string(buf[:i])
 }
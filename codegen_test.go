@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"path/filepath"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -28,13 +30,72 @@ io.WriteString(w, "foo")
 io.WriteString(w, "\">")
 io.WriteString(w, "bar")
 io.WriteString(w, "</div>")
+`,
+		},
+		{
+			node: &nodeComponent{
+				name:     "Card",
+				args:     `title: "Hello"`,
+				children: &nodeBlock{nodes: []node{&nodeLiteral{str: "bar"}}},
+				pos:      span{start: 7},
+			},
+			want: `{
+__pushup_children7 := new(bytes.Buffer)
+io.WriteString(__pushup_children7, "bar")
+renderCardComponent(w, req, CardComponentProps{title: "Hello", children: template.HTML(__pushup_children7.String())})
+}
+`,
+		},
+		{
+			node: &nodeGoStrExpr{expr: "url", escapers: []string{"filterURL", "normalizeURL", "escapeHTMLAttr"}},
+			want: `printEscapedWith(w, url, filterURL, normalizeURL, escapeHTMLAttr)
+`,
+		},
+		{
+			node: &nodeFor{
+				clause: &nodeGoCode{code: "_, x := range xs", pos: span{start: 5}},
+				block:  &nodeBlock{nodes: []node{&nodeGoStrExpr{expr: "x"}}},
+				alt:    &nodeBlock{nodes: []node{&nodeLiteral{str: "none"}}},
+			},
+			want: `{
+__pushup_iterated5 := false
+for _, x := range xs {
+__pushup_iterated5 = true
+printEscaped(w, x)
+}
+if !__pushup_iterated5 {
+io.WriteString(w, "none")
+}
+}
+`,
+		},
+		{
+			node: &nodeCondAttr{name: "checked", value: &nodeGoStrExpr{expr: "done", escapers: []string{"escapeHTMLAttr"}}},
+			want: `printCondAttr(w, "checked", done, escapeHTMLAttr)
+`,
+		},
+		{
+			node: &nodeSpreadAttrs{value: &nodeGoStrExpr{expr: "extra"}, static: []string{"id", "class"}},
+			want: `printSpreadAttrs(w, extra, "id", "class")
+`,
+		},
+		{
+			node: &nodeGoStrExpr{expr: "html", raw: true},
+			want: `printRaw(w, html)
+`,
+		},
+		{
+			node: &nodeComponent{name: "Card"},
+			want: `{
+renderCardComponent(w, req, CardComponentProps{})
+}
 `,
 		},
 	}
 
 	for _, test := range tests {
 		t.Run("", func(t *testing.T) {
-			page, err := newPageFromTree(&syntaxTree{nodes: []node{test.node}})
+			page, err := newPageFromTree(&syntaxTree{nodes: []node{test.node}}, "", "default")
 			if err != nil {
 				t.Fatalf("new page from tree: %v", err)
 			}
@@ -49,6 +110,248 @@ io.WriteString(w, "</div>")
 	}
 }
 
+func TestNewComponentFromTree(t *testing.T) {
+	tests := []struct {
+		input   string
+		props   []string
+		wantErr bool
+	}{
+		{"^prop title string\n^prop n int\n<p>^title</p>", []string{"title", "n"}, false},
+		{"^prop children string\n", nil, true},
+		{"^prop a int\n^prop a int\n", nil, true},
+		{"^handler { return nil }\n", nil, true},
+		{"^section s { <p></p> }\n", nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run("", func(t *testing.T) {
+			tree, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("parsing: %v", err)
+			}
+			comp, err := newComponentFromTree(tree)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			for _, prop := range comp.props {
+				got = append(got, prop.name)
+			}
+			if diff := cmp.Diff(test.props, got); diff != "" {
+				t.Errorf("(-want, +got)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNewLayoutFromTree(t *testing.T) {
+	tests := []struct {
+		input      string
+		parent     string
+		parentExpr string
+		sections   []string
+		inline     int
+		wantErr    bool
+	}{
+		// a layout without a parent outputs its sections in place
+		{"^section s {<p></p>}\n<main></main>", "", "", nil, 1, false},
+		{"^layout !\n^section s {<p></p>}\n", "", "", nil, 1, false},
+		{"^layout default\n^section s {<p></p>}\n<main></main>", "default", "", []string{"s"}, 0, false},
+		{"^layout(name)\n<main></main>", "", "name", nil, 0, false},
+		{"^layout a\n^layout b\n", "", "", nil, 0, true},
+		{"^prop n int\n", "", "", nil, 0, true},
+		{"^section s defer {<p></p>}\n<main></main>", "", "", nil, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run("", func(t *testing.T) {
+			tree, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("parsing: %v", err)
+			}
+			layout, err := newLayoutFromTree(tree)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if layout.parent != test.parent || layout.parentExpr != test.parentExpr {
+				t.Errorf("parent: want %q/%q, got %q/%q", test.parent, test.parentExpr, layout.parent, layout.parentExpr)
+			}
+			var got []string
+			for name := range layout.sections {
+				got = append(got, name)
+			}
+			if diff := cmp.Diff(test.sections, got); diff != "" {
+				t.Errorf("sections (-want, +got)\n%s", diff)
+			}
+			inline := 0
+			for _, n := range layout.nodes {
+				if _, ok := n.(*nodeSection); ok {
+					inline++
+				}
+			}
+			if inline != test.inline {
+				t.Errorf("inline sections: want %d, got %d", test.inline, inline)
+			}
+		})
+	}
+}
+
+func TestGenCodeLayoutSectionOrder(t *testing.T) {
+	src := "^layout default\n^section c {<p>c</p>}\n^section a {<p>a</p>}\n^section b {<p>b</p>}\n<main></main>"
+	tree, err := parse(src)
+	if err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+	layout, err := newLayoutFromTree(tree)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pfile := projectFile{path: filepath.Join("layouts", "nested.up"), projectFilesSubdir: "layouts"}
+	var first []byte
+	for i := 0; i < 10; i++ {
+		code, err := genCodeLayout(newLayoutCodeGen(layout, pfile, src))
+		if err != nil {
+			t.Fatalf("generating code: %v", err)
+		}
+		if first == nil {
+			first = code
+			a := bytes.Index(code, []byte(`__pushup_own["a"]`))
+			b := bytes.Index(code, []byte(`__pushup_own["b"]`))
+			c := bytes.Index(code, []byte(`__pushup_own["c"]`))
+			if a < 0 || !(a < b && b < c) {
+				t.Fatalf("expected the sections in order by name, got:\n%s", code)
+			}
+		} else if !bytes.Equal(first, code) {
+			t.Fatalf("generated code differs between builds")
+		}
+	}
+}
+
+func TestPageParams(t *testing.T) {
+	tests := []struct {
+		path    string
+		input   string
+		wantErr string
+	}{
+		{"$id.up", "^param id int\n^query page int = 1\n", ""},
+		{"a/$id/b.up", "^param id string\n", ""},
+		{"$id.up", "^param slug string\n", "1:8: ^param slug has no matching $slug segment in the page's path $id.up"},
+		{"index.up", "^query page []int\n", "1:8: unsupported type []int for ^query page, must be one of string, int, int64, uint, float64, bool, []string"},
+		{"index.up", "^query page int\n^query page int\n", `2:8: parameter "page" already declared`},
+		{"docs/$...path.up", "^param path []string\n", ""},
+		{"archive/$[year].up", "^param year int = 2024\n", ""},
+		{"$id.up", "^param id int = 1\n", "1:8: ^param id can't have a default value, its segment is not optional"},
+		{"$id.up", "^param id []string\n", "1:8: ^param id can only be a []string for a $...id rest segment"},
+		{"$id/_404.up", "^param id int\n", "1:8: ^param is not allowed in error pages"},
+		{"_500.up", "^query debug bool\n", ""},
+	}
+
+	for _, test := range tests {
+		t.Run("", func(t *testing.T) {
+			tree, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("parsing: %v", err)
+			}
+			page, err := newPageFromTree(tree, test.input, "default")
+			if err == nil {
+				g := newPageCodeGen(page, projectFile{path: test.path, projectFilesSubdir: "."}, test.input)
+				_, err = genCodePage(g)
+			}
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if err == nil || err.Error() != test.wantErr {
+				t.Errorf("want error %q, got %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestPageMethodHandlers(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []string
+		wantErr string
+	}{
+		{"^handler {}\n", nil, ""},
+		{"^handler GET {}\n^handler POST {}\n", []string{"GET", "POST"}, ""},
+		{"^handler {}\n^handler DELETE {}\n", []string{"DELETE"}, ""},
+		{"^handler {}\n^handler {}\n", nil, "only one handler per page can be defined"},
+		{"^handler POST {}\n^handler POST {}\n", nil, "only one POST handler per page can be defined"},
+	}
+
+	for _, test := range tests {
+		t.Run("", func(t *testing.T) {
+			tree, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("parsing: %v", err)
+			}
+			page, err := newPageFromTree(tree, test.input, "default")
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Errorf("want error %q, got %v", test.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			for _, h := range page.methodHandlers {
+				got = append(got, h.method)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("(-want, +got)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestErrorPageStatus(t *testing.T) {
+	tests := []struct {
+		path       string
+		wantCode   int
+		wantOK     bool
+		wantPrefix string
+	}{
+		{"_404.up", 404, true, ""},
+		{"admin/_500.up", 500, true, "/admin"},
+		{"docs/$id/_403.up", 403, true, "/docs/:id"},
+		{"(marketing)/_404.up", 404, true, ""},
+		{"_200.up", 0, false, ""},
+		{"_4040.up", 0, false, ""},
+		{"404.up", 0, false, ""},
+		{"_abc.up", 0, false, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			code, ok := errorPageStatus(test.path)
+			if code != test.wantCode || ok != test.wantOK {
+				t.Errorf("want %d, %v, got %d, %v", test.wantCode, test.wantOK, code, ok)
+			}
+			if ok {
+				if got := errorPagePrefix(test.path); got != test.wantPrefix {
+					t.Errorf("want prefix %q, got %q", test.wantPrefix, got)
+				}
+			}
+		})
+	}
+}
+
 func TestRouteForPage(t *testing.T) {
 	tests := []struct {
 		path string
@@ -78,10 +381,34 @@ func TestRouteForPage(t *testing.T) {
 			"$projectId/$productId",
 			"/:projectId/:productId",
 		},
+		{
+			"docs/$...path.up",
+			"/docs/*path",
+		},
+		{
+			"archive/$[year].up",
+			"/archive/:year?",
+		},
+		{
+			"files/$[...path]/index.up",
+			"/files/*path?/",
+		},
 		{
 			"blah/index.up",
 			"/blah/",
 		},
+		{
+			"(marketing)/about.up",
+			"/about",
+		},
+		{
+			"(marketing)/index.up",
+			"/",
+		},
+		{
+			"admin/(reports)/$id.up",
+			"/admin/:id",
+		},
 	}
 
 	for _, test := range tests {
@@ -104,6 +431,10 @@ func TestGeneratedTypename(t *testing.T) {
 		{projectFile{path: "foo_bar.up", projectFilesSubdir: "."}, upFilePage, "FooBarPage"},
 		{projectFile{path: "a/b/c.up", projectFilesSubdir: "."}, upFilePage, "ABCPage"},
 		{projectFile{path: "a/b/$c.up", projectFilesSubdir: "."}, upFilePage, "ABDollarSignCPage"},
+		{projectFile{path: "a/$...c.up", projectFilesSubdir: "."}, upFilePage, "ADollarSignRestCPage"},
+		{projectFile{path: "a/$[c].up", projectFilesSubdir: "."}, upFilePage, "ADollarSignOptionalCPage"},
+		{projectFile{path: "(marketing)/about.up", projectFilesSubdir: "."}, upFilePage, "GroupMarketingAboutPage"},
+		{projectFile{path: "card.up", projectFilesSubdir: "."}, upFileComponent, "CardComponent"},
 	}
 
 	for _, test := range tests {
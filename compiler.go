@@ -1,7 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"go/ast"
+	"go/format"
+	goparser "go/parser"
+	"go/token"
 	"io"
 	"os"
 	"path/filepath"
@@ -14,6 +19,7 @@ type upFileType int
 const (
 	upFilePage upFileType = iota
 	upFileLayout
+	upFileComponent
 )
 
 type compileProjectParams struct {
@@ -44,14 +50,14 @@ type compileProjectParams struct {
 
 func compileProject(c *compileProjectParams) error {
 	if c.parseOnly {
-		for _, pfile := range append(c.files.pages, c.files.layouts...) {
+		for _, pfile := range append(append(c.files.pages, c.files.layouts...), c.files.components...) {
 			path := pfile.path
 			b, err := os.ReadFile(path)
 			if err != nil {
 				return fmt.Errorf("reading file %s: %w", path, err)
 			}
 
-			tree, err := parse(string(b))
+			tree, err := parseWithComponents(string(b), c.files.componentNames())
 			if err != nil {
 				return fmt.Errorf("parsing file %s: %w", path, err)
 			}
@@ -62,6 +68,13 @@ func compileProject(c *compileProjectParams) error {
 		os.Exit(0)
 	}
 
+	// check that the files and routes of the project don't collide before
+	// generating any code
+	table, err := checkProject(c.files)
+	if err != nil {
+		return err
+	}
+
 	// compile layouts
 	for _, pfile := range c.files.layouts {
 		if err := compileUpFile(pfile, upFileLayout, c); err != nil {
@@ -69,6 +82,13 @@ func compileProject(c *compileProjectParams) error {
 		}
 	}
 
+	// compile components
+	for _, pfile := range c.files.components {
+		if err := compileUpFile(pfile, upFileComponent, c); err != nil {
+			return err
+		}
+	}
+
 	// compile pages
 	for _, pfile := range c.files.pages {
 		if err := compileUpFile(pfile, upFilePage, c); err != nil {
@@ -76,6 +96,24 @@ func compileProject(c *compileProjectParams) error {
 		}
 	}
 
+	// compile pages directories' middleware
+	for _, pfile := range c.files.middlewares {
+		if err := compileMiddlewareFile(pfile, c); err != nil {
+			return err
+		}
+	}
+
+	// generate the URL builders of the routes
+	{
+		src, err := genURLBuilders(table)
+		if err != nil {
+			return fmt.Errorf("generating URL builders: %w", err)
+		}
+		if err := os.WriteFile(filepath.Join(c.outDir, urlBuildersFileName), src, 0664); err != nil {
+			return fmt.Errorf("writing URL builders: %w", err)
+		}
+	}
+
 	// "compile" user Go code
 	for _, path := range c.files.gofiles {
 		if err := copyFile(filepath.Join(c.outDir, filepath.Base(path)), path); err != nil {
@@ -150,6 +188,8 @@ func compileUpFile(pfile projectFile, ftype upFileType, projectParams *compilePr
 		pfile:              pfile,
 		ftype:              ftype,
 		applyOptimizations: projectParams.applyOptimizations,
+		defaultLayout:      projectParams.files.defaultLayout(pfile),
+		components:         projectParams.files.componentNames(),
 	}
 	if err := compile(params); err != nil {
 		return fmt.Errorf("compiling page file %s: %w", path, err)
@@ -157,6 +197,70 @@ func compileUpFile(pfile projectFile, ftype upFileType, projectParams *compilePr
 	return nil
 }
 
+// middlewareFileName is the name of the Go file in a pages directory with the
+// HTTP middleware for the pages in it and its subdirectories.
+const middlewareFileName = "_middleware.go"
+
+// compileMiddlewareFile compiles a `_middleware.go' file in a pages directory.
+// the file's Middleware function is renamed so that the middleware of every
+// directory can live in the same package, and is registered with the runtime
+// for the directory.
+func compileMiddlewareFile(pfile projectFile, projectParams *compileProjectParams) error {
+	path := pfile.path
+	fset := token.NewFileSet()
+	file, err := goparser.ParseFile(fset, path, nil, goparser.ParseComments)
+	if err != nil {
+		return fmt.Errorf("parsing middleware file: %w", err)
+	}
+	dir := filepath.Dir(pfile.relpath())
+	name := "pagesMiddleware" + typenameFromPath(dir)
+	if err := renameMiddleware(file, name); err != nil {
+		return fmt.Errorf("middleware file %s: %w", path, err)
+	}
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, file); err != nil {
+		return fmt.Errorf("printing middleware file %s: %w", path, err)
+	}
+	fmt.Fprintf(&buf, "\nfunc init() {\n\taddMiddleware(%q, %s)\n}\n", filepath.ToSlash(dir), name)
+	destPath := filepath.Join(projectParams.outDir, middlewareOutputPath(pfile))
+	if err := os.WriteFile(destPath, buf.Bytes(), 0664); err != nil {
+		return fmt.Errorf("writing middleware file %s: %w", destPath, err)
+	}
+	return nil
+}
+
+// renameMiddleware renames the top-level Middleware function of a
+// `_middleware.go' file, and the references to it in the file.
+func renameMiddleware(file *ast.File, name string) error {
+	var obj *ast.Object
+	for _, decl := range file.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil && fn.Name.Name == "Middleware" {
+			obj = fn.Name.Obj
+			fn.Name.Name = name
+		}
+	}
+	if obj == nil {
+		return fmt.Errorf("expected a func Middleware(http.Handler) http.Handler")
+	}
+	ast.Inspect(file, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && id.Obj == obj {
+			id.Name = name
+		}
+		return true
+	})
+	return nil
+}
+
+// middlewareOutputPath returns the filename for the .go file containing the
+// compiled `_middleware.go' file of a pages directory.
+func middlewareOutputPath(pfile projectFile) string {
+	dirs := []string{"pages"}
+	if dir := filepath.Dir(pfile.relpath()); dir != "." {
+		dirs = append(dirs, strings.Split(dir, string([]rune{os.PathSeparator}))...)
+	}
+	return escapeOutputPath(strings.Join(dirs, "__")) + ".middleware.go"
+}
+
 // compiledOutputPath returns the filename for the .go file containing the
 // generated code for the Pushup page.
 func compiledOutputPath(pfile projectFile, ftype upFileType) string {
@@ -164,10 +268,7 @@ func compiledOutputPath(pfile projectFile, ftype upFileType) string {
 	if err != nil {
 		panic("internal error: relative path from project files subdir to .up file: " + err.Error())
 	}
-	// a .go file with a leading '$' in the name is invalid to the go tool
-	if rel[0] == '$' {
-		rel = "0x24" + rel[1:]
-	}
+	rel = escapeOutputPath(rel)
 	var dirs []string
 	dir := filepath.Dir(rel)
 	if dir != "." {
@@ -176,19 +277,41 @@ func compiledOutputPath(pfile projectFile, ftype upFileType) string {
 	file := filepath.Base(rel)
 	base := strings.TrimSuffix(file, filepath.Ext(file))
 	suffix := upFileExt
-	if ftype == upFileLayout {
+	switch ftype {
+	case upFileLayout:
 		suffix = ".layout.up"
+	case upFileComponent:
+		suffix = ".component.up"
 	}
 	result := strings.Join(append(dirs, base), "__") + suffix + ".go"
 	return result
 }
 
+// escapeOutputPath escapes the characters in the path of a generated .go file
+// that the go tool doesn't allow in file names.
+func escapeOutputPath(path string) string {
+	// a .go file with a leading '$' in the name is invalid to the go tool
+	if path[0] == '$' {
+		path = "0x24" + path[1:]
+	}
+	// and one with a leading '_', like from an error page, is ignored
+	if path[0] == '_' {
+		path = "0x5f" + path[1:]
+	}
+	// so are parentheses, from route group directories
+	return strings.NewReplacer("(", "0x28", ")", "0x29").Replace(path)
+}
+
 type compileParams struct {
 	source             io.Reader
 	dest               io.Writer
 	pfile              projectFile
 	ftype              upFileType
 	applyOptimizations bool
+	// layout of a page without a ^layout directive
+	defaultLayout string
+	// names of the project's components
+	components map[string]bool
 }
 
 // compile compiles Pushup source code. it parses the source, applies
@@ -201,7 +324,7 @@ func compile(params compileParams) error {
 	}
 	src := string(b)
 
-	tree, err := parse(src)
+	tree, err := parseWithComponents(src, params.components)
 	if err != nil {
 		return fmt.Errorf("parsing source: %w", err)
 	}
@@ -210,6 +333,10 @@ func compile(params compileParams) error {
 		tree = optimize(tree)
 	}
 
+	if err := escapeTree(tree, src); err != nil {
+		return fmt.Errorf("contextual escaping: %w", err)
+	}
+
 	var code []byte
 
 	switch params.ftype {
@@ -223,8 +350,18 @@ func compile(params compileParams) error {
 		if err != nil {
 			return fmt.Errorf("generating code for a layout: %w", err)
 		}
+	case upFileComponent:
+		comp, err := newComponentFromTree(tree)
+		if err != nil {
+			return fmt.Errorf("getting component from tree: %w", err)
+		}
+		codeGen := newComponentCodeGen(comp, params.pfile, src)
+		code, err = genCodeComponent(codeGen)
+		if err != nil {
+			return fmt.Errorf("generating code for a component: %w", err)
+		}
 	case upFilePage:
-		page, err := newPageFromTree(tree)
+		page, err := newPageFromTree(tree, src, params.defaultLayout)
 		if err != nil {
 			return fmt.Errorf("getting page from tree: %w", err)
 		}
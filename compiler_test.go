@@ -1,6 +1,12 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"go/format"
+	goparser "go/parser"
+	"go/token"
+	"testing"
+)
 
 func TestCompiledOutputPath(t *testing.T) {
 	tests := []struct {
@@ -33,11 +39,26 @@ func TestCompiledOutputPath(t *testing.T) {
 			"default.layout.up.go",
 			upFileLayout,
 		},
+		{
+			projectFile{path: "app/components/card.up", projectFilesSubdir: "app/components"},
+			"card.component.up.go",
+			upFileComponent,
+		},
 		{
 			projectFile{path: "app/pages/$foo.up", projectFilesSubdir: "app/pages"},
 			"0x24foo.up.go",
 			upFilePage,
 		},
+		{
+			projectFile{path: "app/pages/_404.up", projectFilesSubdir: "app/pages"},
+			"0x5f404.up.go",
+			upFilePage,
+		},
+		{
+			projectFile{path: "app/pages/(marketing)/about.up", projectFilesSubdir: "app/pages"},
+			"0x28marketing0x29__about.up.go",
+			upFilePage,
+		},
 	}
 
 	for _, test := range tests {
@@ -48,3 +69,81 @@ func TestCompiledOutputPath(t *testing.T) {
 		})
 	}
 }
+
+func TestMiddlewareOutputPath(t *testing.T) {
+	tests := []struct {
+		pfile projectFile
+		want  string
+	}{
+		{
+			projectFile{path: "app/pages/_middleware.go", projectFilesSubdir: "app/pages"},
+			"pages.middleware.go",
+		},
+		{
+			projectFile{path: "app/pages/admin/users/_middleware.go", projectFilesSubdir: "app/pages"},
+			"pages__admin__users.middleware.go",
+		},
+		{
+			projectFile{path: "app/pages/(marketing)/_middleware.go", projectFilesSubdir: "app/pages"},
+			"pages__0x28marketing0x29.middleware.go",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run("", func(t *testing.T) {
+			if got := middlewareOutputPath(test.pfile); test.want != got {
+				t.Errorf("want %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestRenameMiddleware(t *testing.T) {
+	src := `package build
+
+import "net/http"
+
+func Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r)
+	})
+}
+
+var _ = Middleware
+`
+	want := `package build
+
+import "net/http"
+
+func pagesMiddlewareAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r)
+	})
+}
+
+var _ = pagesMiddlewareAdmin
+`
+	fset := token.NewFileSet()
+	file, err := goparser.ParseFile(fset, "_middleware.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := renameMiddleware(file, "pagesMiddlewareAdmin"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, file); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, got)
+	}
+
+	file, err = goparser.ParseFile(fset, "_middleware.go", "package build\n\nfunc Auth() {}\n", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := renameMiddleware(file, "pagesMiddleware"); err == nil {
+		t.Errorf("expected an error for a file without a Middleware function")
+	}
+}
@@ -31,8 +31,20 @@ func prettyPrintTree(t *syntaxTree) {
 				fmt.Fprintf(w, "\x1b[32m%q\x1b[0m\n", str)
 			}
 		case *nodeGoStrExpr:
+			if n.raw {
+				fmt.Fprintf(w, "RAW ")
+			}
 			fmt.Fprintf(w, "\x1b[33m%s\x1b[0m\n", n.expr)
+		case *nodeCondAttr:
+			fmt.Fprintf(w, "\x1b[33m%s=?%s\x1b[0m\n", n.name, n.value.expr)
+			return false
+		case *nodeSpreadAttrs:
+			fmt.Fprintf(w, "\x1b[33mATTRS %s\x1b[0m\n", n.value.expr)
+			return false
 		case *nodeGoCode:
+			if n.method != "" {
+				fmt.Fprintf(w, "\x1b[34mHANDLER %s\x1b[0m ", n.method)
+			}
 			fmt.Fprintf(w, "\x1b[34m%s\x1b[0m\n", n.code)
 		case *nodeIf:
 			fmt.Fprintf(w, "\x1b[35mIF\x1b[0m")
@@ -50,6 +62,27 @@ func prettyPrintTree(t *syntaxTree) {
 			fmt.Fprintf(w, "\x1b[36mFOR\x1b[0m")
 			f(n.clause)
 			f(n.block)
+			if n.alt != nil {
+				pad()
+				fmt.Fprintf(w, "\x1b[1;36mELSE\x1b[0m\n")
+				f(n.alt)
+			}
+			return false
+		case *nodeSwitch:
+			fmt.Fprintf(w, "\x1b[35mSWITCH\x1b[0m")
+			f(n.tag)
+			for _, c := range n.cases {
+				f(c)
+			}
+			return false
+		case *nodeCase:
+			if n.isDefault() {
+				fmt.Fprintf(w, "\x1b[1;35mDEFAULT\x1b[0m\n")
+			} else {
+				fmt.Fprintf(w, "\x1b[35mCASE\x1b[0m")
+				f(n.list)
+			}
+			f(n.block)
 			return false
 		case *nodeElement:
 			fmt.Fprintf(w, "\x1b[31m%s\x1b[0m\n", n.tag.start())
@@ -57,13 +90,46 @@ func prettyPrintTree(t *syntaxTree) {
 			fmt.Fprintf(w, "\x1b[31m%s\x1b[0m\n", n.tag.end())
 			return false
 		case *nodeSection:
-			fmt.Fprintf(w, "SECTION %s\n", n.name)
+			if n.deferred {
+				fmt.Fprintf(w, "SECTION %s DEFER\n", n.name)
+			} else {
+				fmt.Fprintf(w, "SECTION %s\n", n.name)
+			}
 			f(n.block)
+			if n.fallback != nil {
+				fmt.Fprintf(w, "ELSE\n")
+				f(n.fallback)
+			}
 			return false
 		case *nodePartial:
 			fmt.Fprintf(w, "PARTIAL %s\n", n.name)
 			f(n.block)
 			return false
+		case *nodeComponent:
+			fmt.Fprintf(w, "COMPONENT %s(%s)\n", n.name, n.args)
+			if n.children != nil {
+				f(n.children)
+			}
+			return false
+		case *nodeProp:
+			fmt.Fprintf(w, "PROP %s %s\n", n.name, n.typ)
+		case *nodeParam:
+			fmt.Fprintf(w, "%s %s %s", strings.ToUpper(n.kind.String()), n.name, n.typ)
+			if n.dflt != "" {
+				fmt.Fprintf(w, " = %s", n.dflt)
+			}
+			fmt.Fprintf(w, "\n")
+		case *nodeFlush:
+			fmt.Fprintf(w, "FLUSH\n")
+		case *nodeTry:
+			fmt.Fprintf(w, "TRY\n")
+			f(n.block)
+			if n.catch != nil {
+				pad()
+				fmt.Fprintf(w, "CATCH %s\n", n.errVar)
+				f(n.catch)
+			}
+			return false
 		case *nodeBlock:
 			f(nodeList(n.nodes))
 			return false
@@ -74,7 +140,11 @@ func prettyPrintTree(t *syntaxTree) {
 			}
 			fmt.Fprintf(w, "%s\n", n.decl.path)
 		case *nodeLayout:
-			fmt.Fprintf(w, "LAYOUT %s\n", n.name)
+			if n.expr != "" {
+				fmt.Fprintf(w, "LAYOUT (%s)\n", n.expr)
+			} else {
+				fmt.Fprintf(w, "LAYOUT %s\n", n.name)
+			}
 		case nodeList:
 			for _, x := range n {
 				f(x)
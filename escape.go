@@ -0,0 +1,782 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// contextual auto-escaping
+//
+// Pushup pages interpolate the values of Go expressions into HTML, but HTML
+// documents embed other languages (JS in <script> elements and event handler
+// attributes, CSS in <style> elements and style attributes, URLs in href and
+// src attributes), each of which has its own rules for what is safe to output.
+// before code generation, we walk the syntax tree in the order the markup will
+// be output, tracking the parsing context a browser would be in at each point,
+// and annotate every expression with the context it appears in. the code
+// generator then emits a chain of runtime escapers appropriate for that
+// context, similar to the contextual escaping in html/template.
+//
+// https://pkg.go.dev/html/template#hdr-Contexts
+
+// escState is the parsing state of the document at a point in the markup.
+type escState uint8
+
+const (
+	// escStateText is HTML text content, the default.
+	escStateText escState = iota
+	// escStateRCDATA is the content of a <textarea> or <title> element.
+	escStateRCDATA
+	// escStateHTMLCmt is inside an HTML comment.
+	escStateHTMLCmt
+	// escStateTag is inside a start tag, but not in an attribute.
+	escStateTag
+	// escStateAttrName is inside an attribute name.
+	escStateAttrName
+	// escStateAfterName is after an attribute name, before any '='.
+	escStateAfterName
+	// escStateBeforeValue is after the '=' of an attribute, before its value.
+	escStateBeforeValue
+	// escStateAttr is inside an attribute value that is neither JS nor CSS.
+	escStateAttr
+	// escStateJS is in JS code, in a <script> element or event handler
+	// attribute.
+	escStateJS
+	// escStateJSDqStr is inside a double-quoted JS string.
+	escStateJSDqStr
+	// escStateJSSqStr is inside a single-quoted JS string.
+	escStateJSSqStr
+	// escStateJSTmplLit is inside a JS template literal.
+	escStateJSTmplLit
+	// escStateJSLineCmt is inside a JS line comment.
+	escStateJSLineCmt
+	// escStateJSBlockCmt is inside a JS block comment.
+	escStateJSBlockCmt
+	// escStateJSRegexp is inside a JS regular expression literal.
+	escStateJSRegexp
+	// escStateJSRegexpClass is inside a character class, like [/'], of a JS
+	// regular expression literal.
+	escStateJSRegexpClass
+	// escStateCSS is in CSS, in a <style> element or style attribute.
+	escStateCSS
+	// escStateCSSDqStr is inside a double-quoted CSS string.
+	escStateCSSDqStr
+	// escStateCSSSqStr is inside a single-quoted CSS string.
+	escStateCSSSqStr
+	// escStateCSSCmt is inside a CSS comment.
+	escStateCSSCmt
+)
+
+// escJSCtx is what a '/' in JS code would start, going by the preceding
+// token.
+type escJSCtx uint8
+
+const (
+	// escJSCtxRegexp is where a '/' starts a regular expression literal, as
+	// at the start of a script or after an operator.
+	escJSCtxRegexp escJSCtx = iota
+	// escJSCtxDivOp is where a '/' is a division, as after a value.
+	escJSCtxDivOp
+	// escJSCtxUnknown is where it could be either, as after an expression
+	// output in one branch of a conditional and an operator in the other.
+	escJSCtxUnknown
+)
+
+// escDelim is the delimiter that ends the current attribute value.
+type escDelim uint8
+
+const (
+	escDelimNone escDelim = iota
+	escDelimDoubleQuote
+	escDelimSingleQuote
+	// escDelimSpaceOrTagEnd is an unquoted attribute value.
+	escDelimSpaceOrTagEnd
+)
+
+// escAttr is the kind of content of the current attribute value.
+type escAttr uint8
+
+const (
+	escAttrNone escAttr = iota
+	escAttrURL
+	escAttrJS
+	escAttrCSS
+)
+
+// escURLPart is the part of a URL attribute value we are in.
+type escURLPart uint8
+
+const (
+	// escURLPartNone is at the start of the URL, where the scheme may be.
+	escURLPartNone escURLPart = iota
+	// escURLPartPreQuery is in the scheme, authority, or path.
+	escURLPartPreQuery
+	// escURLPartQueryOrFrag is in the query or fragment.
+	escURLPartQueryOrFrag
+)
+
+// escElement is a special element whose content is not HTML text.
+type escElement uint8
+
+const (
+	escElementNone escElement = iota
+	escElementScript
+	escElementStyle
+	escElementTextarea
+	escElementTitle
+)
+
+var escElementNames = map[escElement]string{
+	escElementScript:   "script",
+	escElementStyle:    "style",
+	escElementTextarea: "textarea",
+	escElementTitle:    "title",
+}
+
+// escContext is the context at a point in the output markup.
+type escContext struct {
+	state   escState
+	jsCtx   escJSCtx
+	delim   escDelim
+	attr    escAttr
+	urlPart escURLPart
+	element escElement
+	// name is the tag or attribute name being scanned, or the attribute
+	// whose value is, if the value is scanned into value: the type of a
+	// <script>, which decides whether its content is JS
+	name  string
+	value string
+}
+
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\f' || c == '\r'
+}
+
+func isASCIILetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// hasPrefixFold reports whether s begins with prefix, ignoring ASCII case.
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// attrTypeForName returns the kind of content of the attribute's value.
+func attrTypeForName(name string) escAttr {
+	name = strings.ToLower(name)
+	if strings.HasPrefix(name, "data-") {
+		name = name[len("data-"):]
+	} else if i := strings.IndexByte(name, ':'); i >= 0 {
+		// namespaced attributes like xlink:href
+		if name[:i] == "xmlns" {
+			return escAttrURL
+		}
+		name = name[i+1:]
+	}
+	switch name {
+	case "action", "background", "cite", "codebase", "formaction", "href",
+		"icon", "longdesc", "manifest", "poster", "src", "srcset", "usemap",
+		"xmlns":
+		return escAttrURL
+	case "style":
+		return escAttrCSS
+	}
+	if strings.HasPrefix(name, "on") {
+		return escAttrJS
+	}
+	// heuristic from html/template for attributes we don't know about
+	if strings.Contains(name, "src") || strings.Contains(name, "uri") || strings.Contains(name, "url") {
+		return escAttrURL
+	}
+	return escAttrNone
+}
+
+// isJSType reports whether the MIME type of a <script> element's type
+// attribute is JS, or JSON, which is escaped the same way. the content of a
+// script of another type, like a client-side template, isn't JS.
+//
+// https://html.spec.whatwg.org/multipage/scripting.html#attr-script-type
+func isJSType(mimeType string) bool {
+	if i := strings.IndexByte(mimeType, ';'); i >= 0 {
+		mimeType = mimeType[:i]
+	}
+	mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+	switch mimeType {
+	case "", "module",
+		"application/ecmascript", "application/javascript", "application/json",
+		"application/x-ecmascript", "application/x-javascript",
+		"text/ecmascript", "text/javascript", "text/javascript1.0",
+		"text/javascript1.1", "text/javascript1.2", "text/javascript1.3",
+		"text/javascript1.4", "text/javascript1.5", "text/jscript",
+		"text/livescript", "text/x-ecmascript", "text/x-javascript":
+		return true
+	}
+	// structured syntax suffix, like application/ld+json
+	return strings.HasSuffix(mimeType, "+json")
+}
+
+// regexpPrecederKeywords are the JS keywords after which a '/' starts a
+// regular expression literal rather than a division.
+var regexpPrecederKeywords = map[string]bool{
+	"break":      true,
+	"case":       true,
+	"continue":   true,
+	"delete":     true,
+	"do":         true,
+	"else":       true,
+	"finally":    true,
+	"in":         true,
+	"instanceof": true,
+	"return":     true,
+	"throw":      true,
+	"try":        true,
+	"typeof":     true,
+	"void":       true,
+}
+
+func isJSIdentByte(c byte) bool {
+	return isASCIILetter(c) || (c >= '0' && c <= '9') || c == '_' || c == '$' || c >= 0x80
+}
+
+func elementForTagName(name string) escElement {
+	switch strings.ToLower(name) {
+	case "script":
+		return escElementScript
+	case "style":
+		return escElementStyle
+	case "textarea":
+		return escElementTextarea
+	case "title":
+		return escElementTitle
+	}
+	return escElementNone
+}
+
+// transition returns the context after the literal markup s is output in
+// context c.
+func (c escContext) transition(s string) escContext {
+	for i := 0; i < len(s); {
+		c, i = c.step(s, i)
+	}
+	return c
+}
+
+// step consumes one or more bytes of s starting at index i, returning the new
+// context and the index of the next unconsumed byte.
+func (c escContext) step(s string, i int) (escContext, int) {
+	ch := s[i]
+
+	// attribute values end at their delimiter, regardless of the state of
+	// the embedded JS, CSS, or URL
+	if c.delim != escDelimNone {
+		switch {
+		case c.delim == escDelimDoubleQuote && ch == '"',
+			c.delim == escDelimSingleQuote && ch == '\'':
+			return escContext{state: escStateTag, element: c.endAttrValue()}, i + 1
+		case c.delim == escDelimSpaceOrTagEnd && isHTMLSpace(ch):
+			return escContext{state: escStateTag, element: c.endAttrValue()}, i + 1
+		case c.delim == escDelimSpaceOrTagEnd && ch == '>':
+			return escContext{state: escStateTag, element: c.endAttrValue()}.endTag(), i + 1
+		}
+	}
+
+	// the content of special elements ends at their end tag, even inside a
+	// JS string or comment
+	if (c.element != escElementNone && c.delim == escDelimNone && c.state >= escStateJS) || c.state == escStateRCDATA {
+		if ch == '<' && hasPrefixFold(s[i:], "</"+escElementNames[c.element]) {
+			return escContext{state: escStateText}, i
+		}
+	}
+
+	switch c.state {
+	case escStateText:
+		if ch != '<' {
+			return c, i + 1
+		}
+		rest := s[i+1:]
+		switch {
+		case strings.HasPrefix(rest, "!--"):
+			return escContext{state: escStateHTMLCmt}, i + 4
+		case strings.HasPrefix(rest, "/") || strings.HasPrefix(rest, "!") || strings.HasPrefix(rest, "?"):
+			// end tag, doctype, or processing instruction: skip to the end
+			// of it
+			if j := strings.IndexByte(rest, '>'); j >= 0 {
+				return c, i + 1 + j + 1
+			}
+			return c, len(s)
+		case len(rest) > 0 && isASCIILetter(rest[0]):
+			j := 0
+			for j < len(rest) && !isHTMLSpace(rest[j]) && rest[j] != '>' && rest[j] != '/' {
+				j++
+			}
+			return escContext{state: escStateTag, element: elementForTagName(rest[:j])}, i + 1 + j
+		}
+		return c, i + 1
+	case escStateRCDATA:
+		return c, i + 1
+	case escStateHTMLCmt:
+		if strings.HasPrefix(s[i:], "-->") {
+			return escContext{state: escStateText}, i + 3
+		}
+		return c, i + 1
+	case escStateTag:
+		switch {
+		case ch == '>':
+			return c.endTag(), i + 1
+		case isHTMLSpace(ch) || ch == '/':
+			return c, i + 1
+		}
+		return escContext{state: escStateAttrName, element: c.element, name: string(ch)}, i + 1
+	case escStateAttrName:
+		switch {
+		case ch == '=':
+			return c.beforeValue(), i + 1
+		case isHTMLSpace(ch):
+			c.state = escStateAfterName
+			return c, i + 1
+		case ch == '>':
+			return c.endTag(), i + 1
+		case ch == '/':
+			return escContext{state: escStateTag, element: c.element}, i + 1
+		}
+		c.name += string(ch)
+		return c, i + 1
+	case escStateAfterName:
+		switch {
+		case ch == '=':
+			return c.beforeValue(), i + 1
+		case isHTMLSpace(ch):
+			return c, i + 1
+		case ch == '>':
+			return c.endTag(), i + 1
+		case ch == '/':
+			return escContext{state: escStateTag, element: c.element}, i + 1
+		}
+		return escContext{state: escStateAttrName, element: c.element, name: string(ch)}, i + 1
+	case escStateBeforeValue:
+		switch {
+		case isHTMLSpace(ch):
+			return c, i + 1
+		case ch == '>':
+			return escContext{element: c.element}.endTag(), i + 1
+		case ch == '"':
+			return c.attrValue(escDelimDoubleQuote), i + 1
+		case ch == '\'':
+			return c.attrValue(escDelimSingleQuote), i + 1
+		}
+		// unquoted value, don't consume the first byte of it
+		return c.attrValue(escDelimSpaceOrTagEnd), i
+	case escStateAttr:
+		if c.name != "" {
+			c.value += string(ch)
+		}
+		if c.attr == escAttrURL {
+			if ch == '?' || ch == '#' {
+				c.urlPart = escURLPartQueryOrFrag
+			} else if c.urlPart == escURLPartNone {
+				c.urlPart = escURLPartPreQuery
+			}
+		}
+		return c, i + 1
+	case escStateJS:
+		switch {
+		case ch == '"':
+			c.state = escStateJSDqStr
+		case ch == '\'':
+			c.state = escStateJSSqStr
+		case ch == '`':
+			c.state = escStateJSTmplLit
+		case strings.HasPrefix(s[i:], "//"):
+			c.state = escStateJSLineCmt
+			return c, i + 2
+		case strings.HasPrefix(s[i:], "/*"):
+			c.state = escStateJSBlockCmt
+			return c, i + 2
+		case ch == '/':
+			switch c.jsCtx {
+			case escJSCtxRegexp:
+				c.state = escStateJSRegexp
+			case escJSCtxDivOp:
+				c.jsCtx = escJSCtxRegexp
+			default:
+				panic(escapeError{msg: "'/' could start a division or a regular expression in JS", pos: span{start: i}})
+			}
+		case isJSIdentByte(ch):
+			// a keyword like return is followed by an expression, any other
+			// word or number by an operator
+			j := i + 1
+			for j < len(s) && isJSIdentByte(s[j]) {
+				j++
+			}
+			c.jsCtx = escJSCtxDivOp
+			if regexpPrecederKeywords[s[i:j]] {
+				c.jsCtx = escJSCtxRegexp
+			}
+			return c, j
+		case ch == '+' || ch == '-':
+			// a ++ or -- follows a value, a + or - precedes one
+			if i+1 < len(s) && s[i+1] == ch {
+				c.jsCtx = escJSCtxDivOp
+				return c, i + 2
+			}
+			c.jsCtx = escJSCtxRegexp
+		case ch == ')' || ch == ']':
+			c.jsCtx = escJSCtxDivOp
+		case isHTMLSpace(ch):
+		default:
+			// other punctuators precede an expression. a '}' may end a block
+			// or an object literal, but a '/' after an object literal is rare
+			c.jsCtx = escJSCtxRegexp
+		}
+		return c, i + 1
+	case escStateJSDqStr, escStateJSSqStr, escStateJSTmplLit:
+		quote := map[escState]byte{escStateJSDqStr: '"', escStateJSSqStr: '\'', escStateJSTmplLit: '`'}[c.state]
+		switch ch {
+		case '\\':
+			return c, min(i+2, len(s))
+		case quote:
+			c.state = escStateJS
+			c.jsCtx = escJSCtxDivOp
+		}
+		return c, i + 1
+	case escStateJSRegexp, escStateJSRegexpClass:
+		switch {
+		case ch == '\\':
+			return c, min(i+2, len(s))
+		case ch == '[' && c.state == escStateJSRegexp:
+			c.state = escStateJSRegexpClass
+		case ch == ']' && c.state == escStateJSRegexpClass:
+			c.state = escStateJSRegexp
+		case ch == '/' && c.state == escStateJSRegexp:
+			// any flags that follow are a word, so a '/' after them is a
+			// division
+			c.state = escStateJS
+			c.jsCtx = escJSCtxDivOp
+		}
+		return c, i + 1
+	case escStateJSLineCmt:
+		if ch == '\n' {
+			c.state = escStateJS
+		}
+		return c, i + 1
+	case escStateJSBlockCmt:
+		if strings.HasPrefix(s[i:], "*/") {
+			c.state = escStateJS
+			return c, i + 2
+		}
+		return c, i + 1
+	case escStateCSS:
+		switch {
+		case ch == '"':
+			c.state = escStateCSSDqStr
+		case ch == '\'':
+			c.state = escStateCSSSqStr
+		case strings.HasPrefix(s[i:], "/*"):
+			c.state = escStateCSSCmt
+			return c, i + 2
+		}
+		return c, i + 1
+	case escStateCSSDqStr, escStateCSSSqStr:
+		quote := byte('"')
+		if c.state == escStateCSSSqStr {
+			quote = '\''
+		}
+		switch ch {
+		case '\\':
+			return c, min(i+2, len(s))
+		case quote:
+			c.state = escStateCSS
+		}
+		return c, i + 1
+	case escStateCSSCmt:
+		if strings.HasPrefix(s[i:], "*/") {
+			c.state = escStateCSS
+			return c, i + 2
+		}
+		return c, i + 1
+	}
+	panic(fmt.Sprintf("internal error: unhandled escape state %d", c.state))
+}
+
+// endTag returns the context after the '>' of a start tag.
+func (c escContext) endTag() escContext {
+	switch c.element {
+	case escElementScript:
+		return escContext{state: escStateJS, element: c.element}
+	case escElementStyle:
+		return escContext{state: escStateCSS, element: c.element}
+	case escElementTextarea, escElementTitle:
+		return escContext{state: escStateRCDATA, element: c.element}
+	}
+	return escContext{state: escStateText}
+}
+
+// beforeValue returns the context after the '=' following an attribute name.
+func (c escContext) beforeValue() escContext {
+	return escContext{state: escStateBeforeValue, element: c.element, attr: attrTypeForName(c.name), name: c.name}
+}
+
+// attrValue returns the context at the start of an attribute value.
+func (c escContext) attrValue(delim escDelim) escContext {
+	result := escContext{delim: delim, attr: c.attr, element: c.element}
+	if c.element == escElementScript && strings.EqualFold(c.name, "type") {
+		result.name = c.name
+	}
+	switch c.attr {
+	case escAttrJS:
+		result.state = escStateJS
+	case escAttrCSS:
+		result.state = escStateCSS
+	default:
+		result.state = escStateAttr
+	}
+	return result
+}
+
+// endAttrValue returns the element whose start tag continues after the
+// attribute value ends. a <script> whose type isn't JS is an ordinary
+// element, whose content is HTML text.
+func (c escContext) endAttrValue() escElement {
+	if c.name != "" && !isJSType(c.value) {
+		return escElementNone
+	}
+	return c.element
+}
+
+// afterExpr returns the context after the value of an expression is output
+// in context c.
+func (c escContext) afterExpr() escContext {
+	if c.state == escStateBeforeValue {
+		c = c.attrValue(escDelimSpaceOrTagEnd)
+	}
+	if c.state == escStateAttr {
+		// a script type that isn't all literal markup is assumed to be JS
+		c.name, c.value = "", ""
+	}
+	if c.state == escStateAttr && c.attr == escAttrURL && c.urlPart == escURLPartNone {
+		c.urlPart = escURLPartPreQuery
+	}
+	if c.state == escStateJS {
+		// the value is output as a JS value
+		c.jsCtx = escJSCtxDivOp
+	}
+	return c
+}
+
+// join returns the context after markup that may end in context a or b, like
+// the branches of a conditional, and whether they can be joined. contexts
+// that differ only in what a '/' in JS would start can, and a '/' that follows
+// is an error.
+func join(a, b escContext) (escContext, bool) {
+	if a == b {
+		return a, true
+	}
+	a.jsCtx, b.jsCtx = escJSCtxUnknown, escJSCtxUnknown
+	return a, a == b
+}
+
+// escapers returns the names of the runtime escaper functions, in order, to
+// apply to the value of an expression output in context c. the empty list
+// means HTML text escaping.
+func (c escContext) escapers() []string {
+	if c.state == escStateBeforeValue {
+		return c.attrValue(escDelimSpaceOrTagEnd).escapers()
+	}
+	var result []string
+	switch c.state {
+	case escStateText, escStateRCDATA, escStateHTMLCmt:
+		return nil
+	case escStateTag, escStateAttrName, escStateAfterName:
+		return []string{"escapeHTMLAttrName"}
+	case escStateAttr:
+		if c.attr == escAttrURL {
+			switch c.urlPart {
+			case escURLPartNone:
+				result = append(result, "filterURL", "normalizeURL")
+			case escURLPartPreQuery:
+				result = append(result, "normalizeURL")
+			case escURLPartQueryOrFrag:
+				result = append(result, "escapeURL")
+			}
+		}
+	case escStateJS:
+		result = append(result, "escapeJSVal")
+	case escStateJSDqStr, escStateJSSqStr, escStateJSTmplLit, escStateJSLineCmt, escStateJSBlockCmt:
+		result = append(result, "escapeJSStr")
+	case escStateJSRegexp, escStateJSRegexpClass:
+		result = append(result, "escapeJSRegexp")
+	case escStateCSS:
+		result = append(result, "filterCSS")
+	case escStateCSSDqStr, escStateCSSSqStr, escStateCSSCmt:
+		result = append(result, "escapeCSS")
+	}
+	switch c.delim {
+	case escDelimDoubleQuote, escDelimSingleQuote:
+		result = append(result, "escapeHTMLAttr")
+	case escDelimSpaceOrTagEnd:
+		result = append(result, "escapeHTMLNospace")
+	}
+	return result
+}
+
+// escapeError is an error in contextual auto-escaping, like a conditional
+// whose branches end in different contexts.
+type escapeError struct {
+	msg string
+	pos span
+}
+
+func (e escapeError) Error() string {
+	return e.msg
+}
+
+// escapeTree determines the context of every expression in the syntax tree
+// and annotates it with the escapers the code generator should apply.
+func escapeTree(tree *syntaxTree, source string) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			if ee, ok := e.(escapeError); ok {
+				start := min(ee.pos.start, len(source))
+				lineNo := lineCount(source[:start])
+				column := start - strings.LastIndexByte(source[:start], '\n')
+				err = fmt.Errorf("%d:%d: %s", lineNo, column, ee.msg)
+			} else {
+				panic(e)
+			}
+		}
+	}()
+	escapeNode(nodeList(tree.nodes), escContext{})
+	return nil
+}
+
+// escapeLiteral returns the context after the literal markup n is output in
+// context c. an error in the markup is reported at its position in n.
+func escapeLiteral(n *nodeLiteral, c escContext) escContext {
+	defer func() {
+		if e := recover(); e != nil {
+			if ee, ok := e.(escapeError); ok {
+				ee.pos.start += n.pos.start
+				ee.pos.end = ee.pos.start + 1
+				panic(ee)
+			}
+			panic(e)
+		}
+	}()
+	return c.transition(n.str)
+}
+
+// escapeNode annotates the expressions in n, which is output starting in
+// context c, and returns the context after n.
+func escapeNode(n node, c escContext) escContext {
+	switch n := n.(type) {
+	case *nodeLiteral:
+		return escapeLiteral(n, c)
+	case *nodeGoStrExpr:
+		if n.raw {
+			// trusted by the author, assume it doesn't change the context
+			return c
+		}
+		n.escapers = c.escapers()
+		return c.afterExpr()
+	case *nodeCondAttr:
+		attr := escContext{state: escStateAttrName, element: c.element, name: n.name}
+		n.value.escapers = attr.beforeValue().attrValue(escDelimDoubleQuote).escapers()
+		return escContext{state: escStateTag, element: c.element}
+	case *nodeSpreadAttrs:
+		// escaped at runtime, according to the name of each attribute
+		return escContext{state: escStateTag, element: c.element}
+	case *nodeElement:
+		c = escapeNode(nodeList(n.startTagNodes), c)
+		c = escapeNode(nodeList(n.children), c)
+		return c.transition(n.tag.end())
+	case nodeList:
+		for _, x := range n {
+			c = escapeNode(x, c)
+		}
+		return c
+	case *nodeBlock:
+		return escapeNode(nodeList(n.nodes), c)
+	case *nodeIf:
+		then := escapeNode(n.then, c)
+		alt := c
+		if n.alt != nil {
+			alt = escapeNode(n.alt, c)
+		}
+		result, ok := join(then, alt)
+		if !ok {
+			panic(escapeError{"branches of " + transSymStr + "if end in different contexts", n.Pos()})
+		}
+		return result
+	case *nodeFor:
+		// the body may run any number of times, so it's escaped again from
+		// the context after it if that differs in what a '/' would start
+		result, ok := join(c, escapeNode(n.block, c))
+		if ok && result != c {
+			result, ok = join(result, escapeNode(n.block, result))
+		}
+		if !ok {
+			panic(escapeError{"body of " + transSymStr + "for ends in a different context than it starts in", n.Pos()})
+		}
+		if n.alt != nil {
+			if result, ok = join(result, escapeNode(n.alt, c)); !ok {
+				panic(escapeError{transSymStr + "else of " + transSymStr + "for ends in a different context than it starts in", n.Pos()})
+			}
+		}
+		return result
+	case *nodeSwitch:
+		result := c
+		hasDefault := false
+		for i, cc := range n.cases {
+			hasDefault = hasDefault || cc.isDefault()
+			after := escapeNode(cc.block, c)
+			if i == 0 {
+				result = after
+			} else if joined, ok := join(result, after); ok {
+				result = joined
+			} else {
+				panic(escapeError{"cases of " + transSymStr + "switch end in different contexts", cc.Pos()})
+			}
+		}
+		if !hasDefault {
+			joined, ok := join(result, c)
+			if !ok {
+				panic(escapeError{"cases of " + transSymStr + "switch change the context without a default", n.Pos()})
+			}
+			result = joined
+		}
+		return result
+	case *nodeSection:
+		// sections are rendered on their own and output by the layout as
+		// HTML text
+		escapeNode(n.block, escContext{})
+		if n.fallback != nil {
+			escapeNode(n.fallback, escContext{})
+		}
+		return c
+	case *nodePartial:
+		return escapeNode(n.block, c)
+	case *nodeTry:
+		// the catch block is output in place of the try block, so both must
+		// leave the markup in the same context
+		try := escapeNode(n.block, c)
+		catch := c
+		if n.catch != nil {
+			catch = escapeNode(n.catch, c)
+		}
+		result, ok := join(try, catch)
+		if !ok {
+			panic(escapeError{transSymStr + "try and " + transSymStr + "catch end in different contexts", n.Pos()})
+		}
+		return result
+	case *nodeComponent:
+		// children are rendered on their own and output by the component
+		// as HTML text
+		if n.children != nil {
+			escapeNode(n.children, escContext{})
+		}
+		return c
+	case *nodeGoCode, *nodeImport, *nodeLayout, *nodeProp, *nodeParam, *nodeFlush:
+		return c
+	}
+	panic(fmt.Sprintf("internal error: unhandled node type %T", n))
+}
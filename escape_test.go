@@ -0,0 +1,188 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEscapeTree(t *testing.T) {
+	tests := []struct {
+		source string
+		// escapers for each expression in the source, in order
+		want [][]string
+	}{
+		{
+			"<p>^name</p>",
+			[][]string{nil},
+		},
+		{
+			`<p title="^name" class="a ^name">^name</p>`,
+			[][]string{{"escapeHTMLAttr"}, {"escapeHTMLAttr"}, nil},
+		},
+		{
+			`<p title=^name>hi</p>`,
+			[][]string{{"escapeHTMLNospace"}},
+		},
+		{
+			`<a href="^url">a</a><a href="/users/^id?tab=^tab#^frag">b</a>`,
+			[][]string{
+				{"filterURL", "normalizeURL", "escapeHTMLAttr"},
+				{"normalizeURL", "escapeHTMLAttr"},
+				{"escapeURL", "escapeHTMLAttr"},
+				{"escapeURL", "escapeHTMLAttr"},
+			},
+		},
+		{
+			`<img data-src=^url>`,
+			[][]string{{"filterURL", "normalizeURL", "escapeHTMLNospace"}},
+		},
+		{
+			`<p data-^name="x">hi</p>`,
+			[][]string{{"escapeHTMLAttrName"}},
+		},
+		{
+			"<script>var x = ^x; var s = \"a ^s\"; // ^c\nvar t = `^t`;</script><p>^y</p>",
+			[][]string{{"escapeJSVal"}, {"escapeJSStr"}, {"escapeJSStr"}, {"escapeJSStr"}, nil},
+		},
+		{
+			`<button onclick="go(^x, '^s')">go</button>`,
+			[][]string{{"escapeJSVal", "escapeHTMLAttr"}, {"escapeJSStr", "escapeHTMLAttr"}},
+		},
+		{
+			`<style>p { color: ^color; font-family: "^font"; }</style>`,
+			[][]string{{"filterCSS"}, {"escapeCSS"}},
+		},
+		{
+			`<p style="color: ^color">hi</p>`,
+			[][]string{{"filterCSS", "escapeHTMLAttr"}},
+		},
+		{
+			`<a href="^raw(url)">a</a><a href="^url">b</a>`,
+			[][]string{nil, {"filterURL", "normalizeURL", "escapeHTMLAttr"}},
+		},
+		{
+			`<input checked=^?done value="^v"><a href=^?url ^attrs(m)>a</a>`,
+			[][]string{{"escapeHTMLAttr"}, {"escapeHTMLAttr"}, {"filterURL", "normalizeURL", "escapeHTMLAttr"}, nil},
+		},
+		{
+			`<title>^title</title><textarea>^text</textarea>`,
+			[][]string{nil, nil},
+		},
+		{
+			`^if x { <script>var x = "^a";</script> } ^else { <p>^b</p> }`,
+			[][]string{{"escapeJSStr"}, nil},
+		},
+		{
+			`^section head { <style>p { color: ^color; }</style> }`,
+			[][]string{{"filterCSS"}},
+		},
+		{
+			`<script>var re = /'/, q = /["]/g; var x = ^x; var s = "^s";</script>`,
+			[][]string{{"escapeJSVal"}, {"escapeJSStr"}},
+		},
+		{
+			`<script>var y = a / b / ^x; var re = /a^x/i, c = /[/]^x/;</script>`,
+			[][]string{{"escapeJSVal"}, {"escapeJSRegexp"}, {"escapeJSRegexp"}},
+		},
+		{
+			`<script>if (ok) { return /'/.test(^s) } i++ / 2; f(^x) / 2;</script>`,
+			[][]string{{"escapeJSVal"}, {"escapeJSVal"}},
+		},
+		{
+			`<button onclick="check(/'/, ^x)">go</button>`,
+			[][]string{{"escapeJSVal", "escapeHTMLAttr"}},
+		},
+		{
+			`<script type="text/template"><p class="^c">^x</p></script><script>var x = ^x;</script>`,
+			[][]string{{"escapeHTMLAttr"}, nil, {"escapeJSVal"}},
+		},
+		{
+			`<script type=application/json>{"a": ^x, "b": "^s"}</script><script type="application/ld+json">{"c": ^x}</script><script type="module">var x = ^x;</script>`,
+			[][]string{{"escapeJSVal"}, {"escapeJSStr"}, {"escapeJSVal"}, {"escapeJSVal"}},
+		},
+		{
+			`<script type="text/javascript; charset=utf-8">var x = ^x;</script>`,
+			[][]string{{"escapeJSVal"}},
+		},
+		{
+			`<script type="text/^kind">var x = ^x;</script>`,
+			[][]string{{"escapeHTMLAttr"}, {"escapeJSVal"}},
+		},
+		{
+			"<script>var x = ^if c { <text>^a</text> } ^else { <text>1</text> } + ^b;</script>",
+			[][]string{{"escapeJSVal"}, {"escapeJSVal"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run("", func(t *testing.T) {
+			tree, err := parse(test.source)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			if err := escapeTree(tree, test.source); err != nil {
+				t.Fatalf("escape tree: %v", err)
+			}
+			var got [][]string
+			var f inspector
+			f = func(n node) bool {
+				switch n := n.(type) {
+				case *nodeGoStrExpr:
+					got = append(got, n.escapers)
+				case *nodeIf:
+					// skip the condition
+					inspect(n.then, f)
+					if n.alt != nil {
+						inspect(n.alt, f)
+					}
+					return false
+				}
+				return true
+			}
+			inspect(nodeList(tree.nodes), f)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("expected escapers did not match got (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestEscapeTreeErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{
+			"<script>\nvar s = ^if x { <text>\"</text> }</script>",
+			"2:13: branches of ^if end in different contexts",
+		},
+		{
+			"<script>^for x := range xs { <text>'</text> }</script>",
+			"1:14: body of ^for ends in a different context than it starts in",
+		},
+		{
+			"<script>^try { <text>\"</text> } ^catch { <text>x</text> }</script>",
+			"1:10: ^try and ^catch end in different contexts",
+		},
+		{
+			"<script>var x = ^if c { <text>^a</text> } ^else { <text>1 +</text> } / 2;</script>",
+			"1:70: '/' could start a division or a regular expression in JS",
+		},
+	}
+	for _, test := range tests {
+		t.Run("", func(t *testing.T) {
+			tree, err := parse(test.source)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			err = escapeTree(tree, test.source)
+			if err == nil {
+				t.Fatalf("expected error, got nil")
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("expected error %q, got %q", test.want, err.Error())
+			}
+		})
+	}
+}
@@ -13,6 +13,9 @@ var DB *sql.DB
 
 // FIXME(paulsmith): relying on init() is not great from an app lifecycle POV
 func init() {
+	// let the form on the album delete page make a DELETE request
+	MethodOverride = true
+
 	dbPath := "./mypushupapp.db"
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
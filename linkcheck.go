@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// linkAttrs are the attributes of HTML elements whose values are URLs that
+// the link checker resolves, and the HTTP methods the browser requests them
+// with. a form's method is set by another attribute, so its URL may be
+// served for any method.
+var linkAttrs = map[string]string{
+	"href":       http.MethodGet,
+	"src":        http.MethodGet,
+	"action":     "",
+	"formaction": "",
+	"poster":     http.MethodGet,
+	"hx-get":     http.MethodGet,
+	"hx-post":    http.MethodPost,
+	"hx-put":     http.MethodPut,
+	"hx-patch":   http.MethodPatch,
+	"hx-delete":  http.MethodDelete,
+}
+
+// runtimePaths are the URL paths the generated app's main serves itself,
+// outside of the pages.
+var runtimePaths = []string{
+	"/favicon.ico",
+	"/debug/pprof/*",
+}
+
+// staticURLPrefix is the URL path the app's static files are served under.
+const staticURLPrefix = "/static/"
+
+// checkLinks checks the literal root-relative URLs in the attributes of the
+// HTML elements of the pages, layouts, and components of the project, like
+// `<a href="/about">', and reports every one that no route or static file
+// serves for the method the link is requested with. a URL with a Pushup
+// expression in it, or that isn't root-relative, isn't checked. allow lists
+// URL paths that are handled outside of the pages, a trailing `*' matching any
+// path it's a prefix of, in addition to the paths the app's main serves.
+func checkLinks(files *projectFiles, table []*routeEntry, allow []string) error {
+	allow = append(append([]string(nil), runtimePaths...), allow...)
+	// the routes in the order the router tries them
+	table = append([]*routeEntry(nil), table...)
+	sortRouteTable(table)
+	static := make(map[string]bool)
+	for _, pfile := range files.static {
+		static[staticURLPrefix+filepath.ToSlash(pfile.relpath())] = true
+	}
+
+	components := files.componentNames()
+	var errs []error
+	for _, pfile := range append(append(append([]projectFile(nil), files.pages...), files.layouts...), files.components...) {
+		b, err := os.ReadFile(pfile.path)
+		if err != nil {
+			return fmt.Errorf("reading file: %w", err)
+		}
+		src := string(b)
+		tree, err := parseWithComponents(src, components)
+		if err != nil {
+			return fmt.Errorf("parsing file %s: %w", pfile.path, err)
+		}
+		check := func(tagname string, tagStart int, attrs []*attr) {
+			for _, a := range attrs {
+				method, ok := linkAttrs[strings.ToLower(a.name.string)]
+				if !ok {
+					continue
+				}
+				path, ok := linkPath(a.value.string)
+				if !ok || linkAllowed(path, allow) || static[path] || routeTableServes(table, path, method) {
+					continue
+				}
+				start := min(tagStart+int(a.value.start), len(src))
+				line := lineCount(src[:start])
+				column := start - strings.LastIndexByte(src[:start], '\n')
+				errs = append(errs, fmt.Errorf("%s:%d:%d: dead link %s in %s attribute of <%s>", pfile.path, line, column, a.value.string, a.name.string, tagname))
+			}
+		}
+		var f inspector
+		f = func(n node) bool {
+			switch n := n.(type) {
+			case *nodeElement:
+				check(n.tag.name, n.pos.start, n.tag.attrs)
+				walk(f, nodeList(n.children))
+				return false
+			case *nodeLiteral:
+				// the parser leaves the start tags of the top level of the
+				// document as literals, so scan them for their attributes
+				if tagname, attrs, ok := scanStartTag(src, n.pos.start); ok {
+					check(tagname, n.pos.start, attrs)
+				}
+			}
+			return true
+		}
+		walk(f, nodeList(tree.nodes))
+	}
+	return errors.Join(errs...)
+}
+
+// scanStartTag scans the HTML start tag at the offset of the source for its
+// name and attributes, if there is one there.
+func scanStartTag(src string, offset int) (string, []*attr, bool) {
+	if offset+1 >= len(src) || src[offset] != '<' || !isASCIIAlpha(int(src[offset+1])) {
+		return "", nil, false
+	}
+	tokenizer := html.NewTokenizer(strings.NewReader(src[offset:]))
+	if tt := tokenizer.Next(); tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+		return "", nil, false
+	}
+	raw := string(tokenizer.Raw())
+	tagname, hasAttr := tokenizer.TagName()
+	if !hasAttr {
+		return string(tagname), nil, true
+	}
+	attrs, err := scanAttrs(raw)
+	if err != nil {
+		return "", nil, false
+	}
+	return string(tagname), attrs, true
+}
+
+// linkPath returns the decoded URL path of an attribute value, without its
+// query or fragment, if the value is a literal root-relative URL.
+func linkPath(val string) (string, bool) {
+	if strings.ContainsRune(val, transSym) {
+		return "", false
+	}
+	val = html.UnescapeString(val)
+	if !strings.HasPrefix(val, "/") || strings.HasPrefix(val, "//") {
+		return "", false
+	}
+	u, err := url.Parse(val)
+	if err != nil {
+		return "", false
+	}
+	return u.Path, true
+}
+
+// linkAllowed reports whether the URL path is in the allowlist.
+func linkAllowed(path string, allow []string) bool {
+	for _, pattern := range allow {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		} else if path == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// routeTableServes reports whether the route of the table that matches the
+// URL path, or would after the router's redirect that removes a trailing
+// slash, responds to the method. the table is in the order of precedence, so
+// the first route that matches is the one the router picks. an empty method
+// is any method.
+func routeTableServes(table []*routeEntry, path string, method string) bool {
+	match := func(path string) *routeEntry {
+		for _, e := range table {
+			if _, ok := matchRoute(e.route, path); ok {
+				return e
+			}
+		}
+		return nil
+	}
+	e := match(path)
+	if e == nil && len(path) > 1 && strings.HasSuffix(path, "/") {
+		e = match(path[:len(path)-1])
+	}
+	if e == nil {
+		return false
+	}
+	return method == "" || e.methods == nil || slices.Contains(e.methods, method)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCheckLinks(t *testing.T) {
+	appDir, files := writeProjectFiles(t, map[string]string{
+		"pages/index.up": `<a href="/about">About</a>
+<a href="/people/42?tab=1#top">Person</a>
+<a href="/people/">People</a>
+<img src="/static/logo.png">
+<a href="/gone">Gone</a>
+^if true {
+	<p><a hx-get="/static/missing.js">Missing</a></p>
+}
+<link rel="icon" href="/favicon.ico">
+<a href="/debug/pprof/heap">Heap</a>
+<a href="/subscribe">Subscribe</a>
+<button hx-post="/subscribe">Subscribe</button>
+<form method="post" action="/subscribe"></form>`,
+		"pages/subscribe.up":    "^handler POST {}\n<p>Subscribed</p>",
+		"pages/about.up":        `<a href="^urls.Index()">Home</a> <a href="https://example.com/">Elsewhere</a>`,
+		"pages/people/$id.up":   `<a href="/people">All</a>`,
+		"pages/people/index.up": `<form action="/api/people"></form>`,
+		"layouts/default.up":    `<link rel="stylesheet" href="/static/style.css">^outputSection("contents")`,
+		"static/logo.png":       "",
+	})
+	table, err := checkProject(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	if err := checkLinks(files, table, []string{"/api/*"}); err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			got = append(got, strings.ReplaceAll(line, appDir+string(filepath.Separator), ""))
+		}
+	}
+	want := []string{
+		"pages/index.up:5:10: dead link /gone in href attribute of <a>",
+		"pages/index.up:7:16: dead link /static/missing.js in hx-get attribute of <a>",
+		"pages/index.up:11:10: dead link /subscribe in href attribute of <a>",
+		"pages/people/$id.up:1:10: dead link /people in href attribute of <a>",
+		"layouts/default.up:1:30: dead link /static/style.css in href attribute of <link>",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(-want +got):\n%s", diff)
+	}
+}
+
+func TestLinkPath(t *testing.T) {
+	tests := []struct {
+		val  string
+		want string
+		ok   bool
+	}{
+		{"/about", "/about", true},
+		{"/people/a%20b?x=1#y", "/people/a b", true},
+		{"/search?q=a&amp;b=c", "/search", true},
+		{"/people/^id", "", false},
+		{"//cdn.example.com/x.js", "", false},
+		{"https://example.com/", "", false},
+		{"about", "", false},
+		{"#top", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.val, func(t *testing.T) {
+			got, ok := linkPath(tt.val)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("expected %q, %v, got %q, %v", tt.want, tt.ok, got, ok)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ package main
 import (
 	"context"
 	"embed"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -18,6 +19,7 @@ import (
 	"regexp"
 	"runtime"
 	"runtime/pprof"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -165,7 +167,7 @@ func newNewCmd(arguments []string) *newCmd {
 	return &newCmd{projectDir: projectDir, moduleName: moduleNameFlag.String()}
 }
 
-//go:embed scaffold
+//go:embed all:scaffold
 var scaffold embed.FS
 
 func (n *newCmd) do() error {
@@ -179,7 +181,7 @@ func (n *newCmd) do() error {
 	}
 
 	// create project directory structure
-	for _, name := range []string{"pages", "layouts", "pkg", "static"} {
+	for _, name := range []string{"pages", "layouts", "components", "pkg", "static"} {
 		path := filepath.Join(n.projectDir, appDirName, name)
 		if err := os.MkdirAll(path, 0755); err != nil {
 			return fmt.Errorf("creating project directory %s: %w", path, err)
@@ -189,6 +191,8 @@ func (n *newCmd) do() error {
 	scaffoldFiles := []string{
 		"layouts/default.up",
 		"pages/index.up",
+		"pages/_404.up",
+		"pages/_500.up",
 		"static/style.css",
 		"static/htmx.min.js",
 		"pkg/app.go",
@@ -266,6 +270,8 @@ type buildCmd struct {
 	outFile            string
 	embedSource        bool
 	pages              stringSlice
+	components         stringSlice
+	layouts            stringSlice
 	verbose            bool
 
 	files  *projectFiles
@@ -283,6 +289,8 @@ func setBuildFlags(flags *flag.FlagSet, b *buildCmd) {
 	flags.StringVar(&b.outFile, "out-file", "", "path to output application binary. Defaults to ./build/bin/projectName")
 	flags.BoolVar(&b.embedSource, "embed-source", true, "embed the source .up files in executable")
 	flags.Var(&b.pages, "page", "path to a Pushup page. multiple can be given")
+	flags.Var(&b.components, "component", "path to a Pushup component, used with -page. multiple can be given")
+	flags.Var(&b.layouts, "layout", "path to a Pushup layout, used with -page. multiple can be given")
 	flags.BoolVar(&b.verbose, "verbose", false, "output verbose information")
 }
 
@@ -315,6 +323,14 @@ func (b *buildCmd) rescanProjectFiles() error {
 		for _, page := range b.pages {
 			pfiles.pages = append(pfiles.pages, projectFile{path: page, projectFilesSubdir: ""})
 		}
+		for _, comp := range b.components {
+			// components are named relative to their own directory
+			pfiles.components = append(pfiles.components, projectFile{path: comp, projectFilesSubdir: filepath.Dir(comp)})
+		}
+		for _, layout := range b.layouts {
+			// likewise for layouts
+			pfiles.layouts = append(pfiles.layouts, projectFile{path: layout, projectFilesSubdir: filepath.Dir(layout)})
+		}
 		b.files = pfiles
 	}
 	return nil
@@ -519,11 +535,16 @@ func (r *runCmd) do() error {
 
 type routesCmd struct {
 	projectDir string
+	format     *regexString
+	match      string
 }
 
 func newRoutesCmd(args []string) *routesCmd {
 	flags := flag.NewFlagSet("pushup routes", flag.ExitOnError)
 	r := new(routesCmd)
+	r.format = newRegexString(`^(table|json)$`, "table")
+	flags.Var(r.format, "format", "output format, table or json")
+	flags.StringVar(&r.match, "match", "", "explain which route handles the URL path")
 	//nolint:errcheck
 	flags.Parse(args)
 	if flags.NArg() == 1 {
@@ -534,26 +555,267 @@ func newRoutesCmd(args []string) *routesCmd {
 	return r
 }
 
+// routeJSON is a route in the JSON output of `pushup routes'.
+type routeJSON struct {
+	Route  string `json:"route"`
+	Kind   string `json:"kind"`
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Layout string `json:"layout"`
+	// null for every method
+	Methods []string         `json:"methods"`
+	Params  []routeParamJSON `json:"params"`
+}
+
+type routeParamJSON struct {
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`
+	Type    string `json:"type"`
+	Default string `json:"default,omitempty"`
+}
+
+// routeMatchJSON is the JSON output of `pushup routes -match'.
+type routeMatchJSON struct {
+	Path string `json:"path"`
+	// the route that handles the path, if any
+	Route  *routeJSON        `json:"route,omitempty"`
+	Params map[string]string `json:"params,omitempty"`
+	// the path a request for it is redirected to, without its trailing
+	// slash, when no route matches it
+	Redirect string `json:"redirect,omitempty"`
+	// the other routes that match the path, which the route takes precedence
+	// over
+	Others []routeOtherJSON `json:"others,omitempty"`
+}
+
+type routeOtherJSON struct {
+	routeJSON
+	Reason string `json:"reason"`
+}
+
+func newRouteJSON(e *routeEntry) *routeJSON {
+	r := &routeJSON{
+		Route:   e.route,
+		Kind:    "page",
+		File:    e.pfile.path,
+		Line:    e.sourceLine(),
+		Layout:  e.layout,
+		Methods: e.methods,
+		Params:  []routeParamJSON{},
+	}
+	if e.partial != nil {
+		r.Kind = "partial"
+	}
+	for _, p := range e.params {
+		r.Params = append(r.Params, routeParamJSON{Name: p.name, Kind: p.kind.String(), Type: p.typ, Default: p.dflt})
+	}
+	return r
+}
+
 func (r *routesCmd) do() error {
 	appDir := filepath.Join(r.projectDir, appDirName)
 	files, err := findProjectFiles(appDir)
 	if err != nil {
 		return err
 	}
-	// TODO(paulsmith): sort by route match specificity
+	table, err := buildRouteTable(files)
+	if err != nil {
+		return err
+	}
+	sortRouteTable(table)
+	if r.match != "" {
+		return r.explainMatch(table)
+	}
+	if r.format.String() == "json" {
+		routes := make([]*routeJSON, len(table))
+		for i, e := range table {
+			routes[i] = newRouteJSON(e)
+		}
+		return writeJSON(os.Stdout, routes)
+	}
 	// TODO(paulsmith): colorize the dynamic path segments
 	w := new(tabwriter.Writer)
-	w.Init(os.Stdout, 0, 0, 1, ' ', 0)
-	for _, page := range files.pages {
-		route := page.route()
-		fmt.Fprintln(w, route+"\t"+page.relpath())
+	w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ROUTE\tKIND\tMETHODS\tLAYOUT\tPARAMS\tSOURCE")
+	for _, e := range table {
+		kind := "page"
+		if e.partial != nil {
+			kind = "partial"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s:%d\n", e.route, kind, displayMethods(e.methods), e.layout, displayParams(e.params), e.pfile.path, e.sourceLine())
+	}
+	return w.Flush()
+}
+
+// explainMatch prints the route that handles the URL path of the -match flag,
+// and the other routes that match it and why they lose to it.
+func (r *routesCmd) explainMatch(table []*routeEntry) error {
+	path := r.match
+	result := routeMatchJSON{Path: path}
+	var found *routeEntry
+	for _, e := range table {
+		params, ok := matchRoute(e.route, path)
+		if !ok {
+			continue
+		}
+		if found == nil {
+			found = e
+			result.Route = newRouteJSON(e)
+			result.Params = params
+			continue
+		}
+		result.Others = append(result.Others, routeOtherJSON{*newRouteJSON(e), precedenceReason(found.route, e.route)})
+	}
+	if found == nil && len(path) > 1 && strings.HasSuffix(path, "/") {
+		lessSlash := strings.TrimSuffix(path, "/")
+		for _, e := range table {
+			if _, ok := matchRoute(e.route, lessSlash); ok {
+				result.Redirect = lessSlash
+				break
+			}
+		}
+	}
+
+	if r.format.String() == "json" {
+		if err := writeJSON(os.Stdout, result); err != nil {
+			return err
+		}
+	} else {
+		switch {
+		case found != nil:
+			fmt.Printf("%s is handled by %s\n", path, displayRouteEntry(found))
+			names := make([]string, 0, len(result.Params))
+			for name := range result.Params {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				fmt.Printf("  %s = %q\n", name, result.Params[name])
+			}
+			if len(result.Others) > 0 {
+				fmt.Printf("it takes precedence over the other routes that match:\n")
+				for _, o := range result.Others {
+					fmt.Printf("  %s %s:%d: %s\n", o.Route, o.File, o.Line, o.Reason)
+				}
+			}
+		case result.Redirect != "":
+			fmt.Printf("%s is redirected to %s, which is handled by a route without the trailing slash\n", path, result.Redirect)
+		}
+	}
+	if found == nil && result.Redirect == "" {
+		return fmt.Errorf("no route matches %s", path)
 	}
-	w.Flush()
 	return nil
 }
 
+// precedenceReason explains why the router chooses route a over route b, when
+// both match a URL path.
+func precedenceReason(a, b string) string {
+	c, i := compareRoutePrecedence(a, b)
+	as, bs := routeSegments(a), routeSegments(b)
+	switch {
+	case c >= 0:
+		return "the route was added first"
+	case i < len(as) && i < len(bs):
+		return fmt.Sprintf("at segment %d, %s is more specific than %s", i+1, describeSegment(as[i]), describeSegment(bs[i]))
+	}
+	return fmt.Sprintf("%s has more segments", a)
+}
+
+// describeSegment describes a segment of a route by its kind.
+func describeSegment(seg string) string {
+	switch routeSegmentRank(seg) {
+	case 0:
+		return fmt.Sprintf("static segment %q", seg)
+	case 1:
+		return "single segment " + seg
+	case 2:
+		return "optional segment " + seg
+	case 3:
+		return "rest segment " + seg
+	}
+	return "optional rest segment " + seg
+}
+
+func displayRouteEntry(e *routeEntry) string {
+	kind := "page"
+	if e.partial != nil {
+		kind = "partial"
+	}
+	return fmt.Sprintf("%s (%s %s:%d)", e.route, kind, e.pfile.path, e.sourceLine())
+}
+
+// displayMethods returns the HTTP methods of a route for display, or "*" if it
+// responds to every method.
+func displayMethods(methods []string) string {
+	if len(methods) == 0 {
+		return "*"
+	}
+	return strings.Join(methods, ",")
+}
+
+// displayParams returns the parameters of a route for display, like
+// `id int, ?page int'. query parameters are prefixed with `?'.
+func displayParams(params []pageParam) string {
+	if len(params) == 0 {
+		return "-"
+	}
+	var ss []string
+	for _, p := range params {
+		s := p.name + " " + p.typ
+		if p.kind == queryParam {
+			s = "?" + s
+		}
+		ss = append(ss, s)
+	}
+	return strings.Join(ss, ", ")
+}
+
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
 var _ doer = (*routesCmd)(nil)
 
+type checkCmd struct {
+	projectDir string
+	allow      stringSlice
+}
+
+func newCheckCmd(args []string) *checkCmd {
+	flags := flag.NewFlagSet("pushup check", flag.ExitOnError)
+	c := new(checkCmd)
+	flags.Var(&c.allow, "allow", "URL `path` handled outside of the pages, or path prefix ending in *, not to report as a dead link (may be repeated)")
+	//nolint:errcheck
+	flags.Parse(args)
+	if flags.NArg() == 1 {
+		c.projectDir = flags.Arg(0)
+	} else {
+		c.projectDir = "."
+	}
+	return c
+}
+
+// do checks the project without building it: that its files and routes don't
+// collide, and that the literal links of its pages, layouts, and components
+// lead to a route or a static file.
+func (c *checkCmd) do() error {
+	appDir := filepath.Join(c.projectDir, appDirName)
+	files, err := findProjectFiles(appDir)
+	if err != nil {
+		return err
+	}
+	table, err := checkProject(files)
+	if err != nil {
+		return err
+	}
+	return checkLinks(files, table, c.allow)
+}
+
+var _ doer = (*checkCmd)(nil)
+
 type cliCmd struct {
 	name        string
 	usage       string
@@ -566,6 +828,7 @@ var cliCmds = []cliCmd{
 	{name: "build", usage: "", description: "compile Pushup project and build executable", fn: func(args []string) doer { return newBuildCmd(args) }},
 	{name: "run", usage: "", description: "build and run Pushup project app", fn: func(args []string) doer { return newRunCmd(args) }},
 	{name: "routes", usage: "", description: "print the routes in the Pushup project", fn: func(args []string) doer { return newRoutesCmd(args) }},
+	{name: "check", usage: "", description: "check the Pushup project for collisions and dead links", fn: func(args []string) doer { return newCheckCmd(args) }},
 }
 
 func printPushupHelp() {
@@ -624,10 +887,47 @@ type projectFiles struct {
 	pages []projectFile
 	// list of .up layout files
 	layouts []projectFile
+	// list of .up component files
+	components []projectFile
 	// paths to static files like JS, CSS, etc.
 	static []projectFile
+	// list of `_middleware.go' files in pages directories
+	middlewares []projectFile
 	// paths to user-contributed .go code
 	gofiles []string // TODO(paulsmith): convert to projectFile
+	// default layouts of pages directories, set by `_layout' files, keyed by
+	// the directory's path relative to the pages directory
+	dirLayouts map[string]string
+}
+
+// layoutFileName is the name of the file in a pages directory that sets the
+// default layout for the pages in it and its subdirectories.
+const layoutFileName = "_layout"
+
+// defaultLayout returns the layout of a page that doesn't set one with a
+// `^layout' directive, from the `_layout' file in the nearest directory
+// enclosing the page, or else "default".
+func (f *projectFiles) defaultLayout(page projectFile) string {
+	dir := filepath.Dir(page.relpath())
+	for {
+		if name, ok := f.dirLayouts[dir]; ok {
+			return name
+		}
+		if dir == "." || dir == string(filepath.Separator) {
+			return "default"
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// componentNames returns the names of the project's components, by which
+// pages, layouts, and other components invoke them.
+func (f *projectFiles) componentNames() map[string]bool {
+	names := make(map[string]bool, len(f.components))
+	for _, pfile := range f.components {
+		names[componentName(pfile)] = true
+	}
+	return names
 }
 
 //nolint:unused
@@ -640,10 +940,18 @@ func (f *projectFiles) debug() {
 	for _, p := range f.layouts {
 		fmt.Printf("\t%v\n", p)
 	}
+	fmt.Println("components:")
+	for _, p := range f.components {
+		fmt.Printf("\t%v\n", p)
+	}
 	fmt.Println("static:")
 	for _, p := range f.static {
 		fmt.Printf("\t%v\n", p)
 	}
+	fmt.Println("middlewares:")
+	for _, p := range f.middlewares {
+		fmt.Printf("\t%v\n", p)
+	}
 	fmt.Println("gofiles:")
 	for _, p := range f.gofiles {
 		fmt.Printf("\t%s\n", p)
@@ -675,10 +983,24 @@ func findProjectFiles(appDir string) (*projectFiles, error) {
 
 	pagesDir := filepath.Join(appDir, "pages")
 	{
+		pf.dirLayouts = make(map[string]string)
 		if err := fs.WalkDir(os.DirFS(pagesDir), ".", func(path string, d fs.DirEntry, _ error) error {
 			if !d.IsDir() && filepath.Ext(path) == upFileExt {
 				pfile := projectFile{path: filepath.Join(pagesDir, path), projectFilesSubdir: pagesDir}
 				pf.pages = append(pf.pages, pfile)
+			} else if !d.IsDir() && d.Name() == middlewareFileName {
+				pfile := projectFile{path: filepath.Join(pagesDir, path), projectFilesSubdir: pagesDir}
+				pf.middlewares = append(pf.middlewares, pfile)
+			} else if !d.IsDir() && d.Name() == layoutFileName {
+				b, err := os.ReadFile(filepath.Join(pagesDir, path))
+				if err != nil {
+					return fmt.Errorf("reading layout file: %w", err)
+				}
+				name := strings.TrimSpace(string(b))
+				if name == "" {
+					return fmt.Errorf("layout file %s is empty, expected the name of a layout or !", filepath.Join(pagesDir, path))
+				}
+				pf.dirLayouts[filepath.Dir(path)] = name
 			}
 			return nil
 		}); err != nil {
@@ -690,6 +1012,20 @@ func findProjectFiles(appDir string) (*projectFiles, error) {
 		}
 	}
 
+	// the components directory is optional
+	componentsDir := filepath.Join(appDir, "components")
+	if dirExists(componentsDir) {
+		if err := fs.WalkDir(os.DirFS(componentsDir), ".", func(path string, d fs.DirEntry, _ error) error {
+			if !d.IsDir() && filepath.Ext(path) == upFileExt {
+				pfile := projectFile{path: filepath.Join(componentsDir, path), projectFilesSubdir: componentsDir}
+				pf.components = append(pf.components, pfile)
+			}
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("walking components dir: %w", err)
+		}
+	}
+
 	pkgDir := filepath.Join(appDir, "pkg")
 	{
 		entries, err := os.ReadDir(pkgDir)
@@ -26,7 +26,9 @@ import (
 type testRequest struct {
 	name           string
 	path           string
+	method         string
 	queryParams    []string
+	formParams     []string
 	expectedOutput string
 }
 
@@ -61,15 +63,31 @@ func TestPushup(t *testing.T) {
 	if err != nil {
 		t.Fatalf("reading testdata dir: %v", err)
 	}
+
+	// components shared by the testdata pages
+	var sharedArgs []string
+	{
+		componentFiles, err := filepath.Glob(filepath.Join(testdataDir, "components", "*"+upFileExt))
+		if err != nil {
+			t.Fatalf("globbing testdata components: %v", err)
+		}
+		for _, path := range componentFiles {
+			sharedArgs = append(sharedArgs, "-component", path)
+		}
+	}
+	// layouts shared by the testdata pages
+	{
+		layoutFiles, err := filepath.Glob(filepath.Join(testdataDir, "layouts", "*"+upFileExt))
+		if err != nil {
+			t.Fatalf("globbing testdata layouts: %v", err)
+		}
+		for _, path := range layoutFiles {
+			sharedArgs = append(sharedArgs, "-layout", path)
+		}
+	}
 	for _, entry := range entries {
 		if strings.HasSuffix(entry.Name(), upFileExt) {
 			t.Run(entry.Name(), func(t *testing.T) {
-				// FIXME(paulsmith): remove this once we have been panic
-				// handling in layouts
-				if entry.Name() == "panicking.up" {
-					t.Skip()
-				}
-
 				basename, _ := splitExt(entry.Name())
 
 				var requests []testRequest
@@ -108,6 +126,10 @@ func TestPushup(t *testing.T) {
 											config.path = pair[1]
 										case "queryParam":
 											config.queryParams = append(config.queryParams, pair[1])
+										case "method":
+											config.method = pair[1]
+										case "formParam":
+											config.formParams = append(config.formParams, pair[1])
 										default:
 											log.Printf("unhandled request config key: %q", pair[0])
 										}
@@ -150,6 +172,12 @@ func TestPushup(t *testing.T) {
 					requestPath = "/testdata/"
 				} else if basename == "$name" {
 					requestPath = "/testdata/world"
+				} else if basename == "$id" {
+					requestPath = "/testdata/42"
+				} else if basename == "$...path" {
+					requestPath = "/testdata/docs"
+				} else if basename == "$[page]" {
+					requestPath = "/testdata"
 				}
 
 				requests = append(requests, testRequest{
@@ -178,7 +206,8 @@ func TestPushup(t *testing.T) {
 							allgood bool
 						)
 
-						cmd := exec.Command(pushup, "run", "-page", pushupFile, "-unix-socket", socketPath)
+						args := append([]string{"run", "-page", pushupFile, "-unix-socket", socketPath}, sharedArgs...)
+						cmd := exec.Command(pushup, args...)
 						sysProcAttr(cmd)
 
 						stdout, err := cmd.StdoutPipe()
@@ -263,7 +292,18 @@ func TestPushup(t *testing.T) {
 								queryParams = "?" + strings.Join(request.queryParams, "&")
 							}
 							reqUrl := "http://dummy" + request.path + queryParams
-							resp, err := client.Get(reqUrl)
+							method := request.method
+							if method == "" {
+								method = http.MethodGet
+							}
+							req, err := http.NewRequest(method, reqUrl, strings.NewReader(strings.Join(request.formParams, "&")))
+							if err != nil {
+								return err
+							}
+							if len(request.formParams) > 0 {
+								req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+							}
+							resp, err := client.Do(req)
 							if err != nil {
 								return nil
 							}
@@ -320,6 +360,8 @@ func TestTypenameFromPath(t *testing.T) {
 		{"index", "Index"},
 		{"$name", "DollarSignName"},
 		{"default", "Default"},
+		{"_404", "Number404"},
+		{"admin/_404", "Admin404"},
 	}
 
 	for _, test := range tests {
@@ -331,3 +373,33 @@ func TestTypenameFromPath(t *testing.T) {
 		})
 	}
 }
+
+func TestDefaultLayout(t *testing.T) {
+	files := &projectFiles{
+		dirLayouts: map[string]string{
+			"admin":         "admin",
+			"admin/reports": "print",
+			"embed":         "!",
+		},
+	}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"index.up", "default"},
+		{"about/team.up", "default"},
+		{"admin/index.up", "admin"},
+		{"admin/users/$id.up", "admin"},
+		{"admin/reports/daily.up", "print"},
+		{"embed/widget.up", "!"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			page := projectFile{path: filepath.Join("app", "pages", test.path), projectFilesSubdir: filepath.Join("app", "pages")}
+			if got := files.defaultLayout(page); test.want != got {
+				t.Errorf("want %q, got %q", test.want, got)
+			}
+		})
+	}
+}
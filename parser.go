@@ -7,6 +7,7 @@ import (
 	"go/scanner"
 	"go/token"
 	"io"
+	"strconv"
 	"strings"
 	"unicode"
 	"unicode/utf8"
@@ -15,7 +16,15 @@ import (
 )
 
 func parse(source string) (tree *syntaxTree, err error) {
+	return parseWithComponents(source, nil)
+}
+
+// parseWithComponents parses the source of a file of a project whose
+// components have the given names, so that only tags with those names are
+// parsed as component tags.
+func parseWithComponents(source string, components map[string]bool) (tree *syntaxTree, err error) {
 	p := newParser(source)
+	p.components = components
 	defer func() {
 		if e := recover(); e != nil {
 			if se, ok := e.(syntaxError); ok {
@@ -41,6 +50,9 @@ type parser struct {
 
 	htmlParser *htmlParser
 	codeParser *codeParser
+
+	// names of the components of the project, or nil if they aren't known
+	components map[string]bool
 }
 
 func newParser(source string) *parser {
@@ -107,6 +119,16 @@ func (p *parser) errorf(format string, args ...any) {
 	panic(syntaxError{fmt.Errorf(format, args...), lineNo, column})
 }
 
+// syntaxErrorAt returns a syntax error at the position in the source, for
+// errors detected after parsing, like in the declarations of a page.
+func syntaxErrorAt(source string, pos span, format string, args ...any) error {
+	start := min(pos.start, len(source))
+	upToErr := source[:start]
+	lineNo := strings.Count(upToErr, "\n") + 1
+	column := start - strings.LastIndex(upToErr, "\n")
+	return syntaxError{fmt.Errorf(format, args...), lineNo, column}
+}
+
 // htmlParser is the Pushup HTML parser. It wraps the golang.org/x/net/html
 // tokenizer, which is an HTML 5 specification-compliant parser. It changes
 // control to the Go code parser (codeParser type) if it encounters the
@@ -200,6 +222,7 @@ func (p *htmlParser) parseAttributeNameOrValue(nameOrValue string, nameOrValueSt
 				pos++
 				saveParser := p.parser
 				p.parser = newParser(nameOrValue[1:])
+				p.parser.components = saveParser.components
 				nodes = append(nodes, p.transition())
 				bytesRead := p.parser.offset
 				pos += bytesRead
@@ -239,6 +262,18 @@ func (p *htmlParser) parseStartTag() []node {
 			nameEndPos := nameStartPos + len(name)
 			valEndPos := valStartPos + len(value)
 
+			// conditional and spread attributes output their own leading
+			// space, so that no extra whitespace is left behind if they
+			// output nothing
+			if n := p.parseSpecialAttr(attr, bytesRead); n != nil {
+				if lit := strings.TrimRight(p.raw[bytesRead:nameStartPos], " \t\n\f\r"); lit != "" {
+					nodes = append(nodes, p.emitLiteralFromRange(bytesRead, bytesRead+len(lit)))
+				}
+				nodes = append(nodes, n)
+				bytesRead = n.Pos().end - p.start
+				continue
+			}
+
 			// emit raw chars between tag name or last attribute and this
 			// attribute
 			if n := nameStartPos - bytesRead; n > 0 {
@@ -271,6 +306,71 @@ func (p *htmlParser) parseStartTag() []node {
 	return nodes
 }
 
+// parseSpecialAttr parses a conditional attribute, `name=^?expr', or a spread
+// of attributes, `^attrs(expr)', in the current start tag. it returns nil if
+// the attribute is neither.
+func (p *htmlParser) parseSpecialAttr(a *attr, bytesRead int) node {
+	name := a.name.string
+	value := a.value.string
+	nameStartPos := int(a.name.start)
+	valStartPos := int(a.value.start)
+	hasValue := valStartPos > nameStartPos+len(name)
+
+	parseExpr := func(expr string, start int) *nodeGoStrExpr {
+		// position syntax errors at the expression
+		saveOffset := p.parser.offset
+		p.parser.offset = p.start + start
+		if expr == "" {
+			p.errorf("expected Go expression")
+		}
+		if _, err := goparser.ParseExpr(expr); err != nil {
+			p.errorf("illegal Go expression: %w", err)
+		}
+		p.parser.offset = saveOffset
+		return &nodeGoStrExpr{expr: expr, pos: span{start: p.start + start, end: p.start + start + len(expr)}}
+	}
+
+	const spreadPrefix = transSymStr + "attrs("
+	if strings.HasPrefix(name, spreadPrefix) {
+		if !strings.HasSuffix(name, ")") {
+			p.parser.offset = p.start + nameStartPos + len(name)
+			p.errorf("expected ')' at end of %sattrs, the expression may not contain whitespace", transSymStr)
+		}
+		if hasValue {
+			p.parser.offset = p.start + valStartPos
+			p.errorf("%sattrs may not have a value", transSymStr)
+		}
+		result := &nodeSpreadAttrs{pos: span{start: p.start + nameStartPos, end: p.start + nameStartPos + len(name)}}
+		result.value = parseExpr(name[len(spreadPrefix):len(name)-1], nameStartPos+len(spreadPrefix))
+		for _, other := range p.attrs {
+			if other != a && !strings.Contains(other.name.string, transSymStr) {
+				result.static = append(result.static, strings.ToLower(other.name.string))
+			}
+		}
+		return result
+	}
+
+	const condPrefix = transSymStr + "?"
+	if hasValue && strings.HasPrefix(value, condPrefix) {
+		if strings.Contains(name, transSymStr) {
+			p.parser.offset = p.start + nameStartPos
+			p.errorf("the name of a conditional attribute may not contain an expression")
+		}
+		end := valStartPos + len(value)
+		// include the closing quote of a quoted value
+		if q := p.raw[valStartPos-1]; (q == '"' || q == '\'') && end < len(p.raw) && p.raw[end] == q {
+			end++
+		}
+		return &nodeCondAttr{
+			name:  strings.ToLower(name),
+			value: parseExpr(value[len(condPrefix):], valStartPos+len(condPrefix)),
+			pos:   span{start: p.start + nameStartPos, end: p.start + end},
+		}
+	}
+
+	return nil
+}
+
 func (p *htmlParser) emitLiteral() node {
 	e := new(nodeLiteral)
 	e.pos.start = p.start
@@ -294,12 +394,21 @@ tokenLoop:
 		}
 		switch p.toktyp {
 		case html.StartTagToken, html.SelfClosingTagToken:
+			if p.isComponentTag() {
+				tree.nodes = append(tree.nodes, p.parseComponentElement())
+				continue
+			}
 			tree.nodes = append(tree.nodes, p.parseStartTag()...)
 		case html.EndTagToken, html.DoctypeToken, html.CommentToken:
 			tree.nodes = append(tree.nodes, p.emitLiteral())
 		case html.TextToken:
 			if idx := strings.IndexRune(p.raw, transSym); idx >= 0 {
-				if escaped := strings.Index(p.raw, transSymEsc); escaped >= 0 {
+				if p.isServerComment(idx) {
+					if idx > 0 {
+						tree.nodes = append(tree.nodes, p.emitLiteralFromRange(0, idx))
+					}
+					p.skipServerComment(idx)
+				} else if escaped := strings.Index(p.raw, transSymEsc); escaped >= 0 {
 					// it's an escaped transition symbol
 					if escaped > 0 {
 						// emit the leading text before the doubled escape
@@ -317,7 +426,16 @@ tokenLoop:
 					p.parser.offset = p.start + escaped + 2
 				} else {
 					// FIXME(paulsmith): clean this up!
-					if strings.HasPrefix(p.raw[idx+1:], "layout") {
+					if strings.HasPrefix(p.raw[idx+1:], "layout(") {
+						// ^layout(expr) selects the layout at request time
+						e := new(nodeLayout)
+						e.pos.start = p.start + idx + 1
+						p.parser.offset = e.pos.start + len("layout(")
+						p.parser.codeParser.reset()
+						e.expr = p.parser.codeParser.parseExplicitExpression().expr
+						e.pos.end = p.parser.offset
+						tree.nodes = append(tree.nodes, e)
+					} else if strings.HasPrefix(p.raw[idx+1:], "layout") {
 						s := p.raw[idx+1+len("layout"):]
 						n := 0
 						if len(s) < 1 || s[0] != ' ' {
@@ -381,6 +499,33 @@ tokenLoop:
 	return tree
 }
 
+// server-side comment delimiters. server-side comments are stripped at
+// compile time and never reach the client, and may contain anything,
+// including transition symbols.
+const (
+	serverCommentStart = transSymStr + "*"
+	serverCommentEnd   = "*" + transSymStr
+)
+
+// isServerComment reports whether the transition symbol at idx in the current
+// text token starts a server-side comment.
+func (p *htmlParser) isServerComment(idx int) bool {
+	return strings.HasPrefix(p.raw[idx:], serverCommentStart)
+}
+
+// skipServerComment moves the parser past the server-side comment starting at
+// idx in the current text token. the comment may extend past the end of the
+// token.
+func (p *htmlParser) skipServerComment(idx int) {
+	start := p.start + idx
+	end := strings.Index(p.parser.sourceFrom(start+len(serverCommentStart)), serverCommentEnd)
+	if end < 0 {
+		p.parser.offset = start
+		p.errorf("unterminated server-side comment, expected closing %q", serverCommentEnd)
+	}
+	p.parser.offset = start + len(serverCommentStart) + end + len(serverCommentEnd)
+}
+
 func (p *htmlParser) transition() node {
 	codeParser := p.parser.codeParser
 	codeParser.reset()
@@ -436,6 +581,10 @@ func (p *htmlParser) parseElement() node {
 		p.errorf("expected an HTML element start or self-closing tag, got %s", p.toktyp)
 	}
 
+	if p.isComponentTag() {
+		return p.parseComponentElement()
+	}
+
 	result = new(nodeElement)
 	result.tag = newTag(p.tagname, p.attrs)
 	result.pos.start = p.parser.offset - len(p.raw)
@@ -482,6 +631,11 @@ loop:
 				p.errorf("HTML tokenizer: %w", p.err)
 			}
 		case html.StartTagToken, html.SelfClosingTagToken:
+			if p.isComponentTag() {
+				result = append(result, p.parseComponentElement())
+				p.advance()
+				continue
+			}
 			elem := new(nodeElement)
 			elem.tag = newTag(p.tagname, p.attrs)
 			elem.pos.start = p.parser.offset - len(p.raw)
@@ -510,7 +664,12 @@ loop:
 		case html.TextToken:
 			// TODO(paulsmith): de-dupe this logic
 			if idx := strings.IndexRune(p.raw, transSym); idx >= 0 {
-				if idx < len(p.raw)-1 && p.raw[idx+1] == transSym {
+				if p.isServerComment(idx) {
+					if idx > 0 {
+						result = append(result, p.emitLiteralFromRange(0, idx))
+					}
+					p.skipServerComment(idx)
+				} else if idx < len(p.raw)-1 && p.raw[idx+1] == transSym {
 					// it's an escaped transition sym
 					// TODO(paulsmith): emit transSym literal text expression
 				} else {
@@ -532,6 +691,8 @@ loop:
 			}
 			p.advance()
 		case html.CommentToken:
+			// preserve HTML comments, same as at the top level
+			result = append(result, p.emitLiteral())
 			p.advance()
 		case html.DoctypeToken:
 			p.errorf("doctype token may not be a child of an element")
@@ -543,6 +704,99 @@ loop:
 	return result
 }
 
+// isComponentTag reports whether the current start or self-closing tag token
+// invokes a component rather than being an HTML element. if the components of
+// the project are known, the tag must have the name of one of them, like
+// `<Card>'. otherwise, the tag must look like a component name, capitalized
+// with a lowercase letter in it, so that HTML tags in uppercase like `<P>' or
+// `<BR>' are still elements. (the HTML tokenizer lowercases tag names, so we
+// check the raw source.)
+func (p *htmlParser) isComponentTag() bool {
+	if !p.match(html.StartTagToken, html.SelfClosingTagToken) || len(p.raw) < 1+len(p.tagname) {
+		return false
+	}
+	name := p.raw[1 : 1+len(p.tagname)]
+	if p.parser.components != nil {
+		return p.parser.components[name]
+	}
+	return isComponentName(name)
+}
+
+// isComponentName reports whether a tag name looks like the name of a
+// component: an uppercase letter followed by letters and digits, at least one
+// of them lowercase.
+func isComponentName(name string) bool {
+	if name == "" || name[0] < 'A' || name[0] > 'Z' {
+		return false
+	}
+	lower := false
+	for _, r := range name[1:] {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		default:
+			return false
+		}
+	}
+	return lower
+}
+
+// parseComponentElement parses a component tag, its attributes as props, and
+// its children. it returns with the current token being the last token of the
+// component, i.e., its end tag, or the self-closing start tag.
+func (p *htmlParser) parseComponentElement() *nodeComponent {
+	result := new(nodeComponent)
+	result.pos.start = p.start
+	result.pos.end = p.parser.offset
+	result.name = p.raw[1 : 1+len(p.tagname)]
+
+	var args []string
+	for _, a := range p.attrs {
+		// attribute names are lowercased by the lexer, so take prop names
+		// from the raw source to preserve case
+		nameStart := int(a.name.start)
+		name := p.raw[nameStart : nameStart+len(a.name.string)]
+		var expr string
+		switch value := a.value.string; {
+		case int(a.value.start) <= nameStart:
+			// attribute with no value, like <Card featured>
+			expr = "true"
+		case strings.HasPrefix(value, transSymStr) && !strings.HasPrefix(value, transSymEsc):
+			saveParser := p.parser
+			p.parser = newParser(value[1:])
+			p.parser.components = saveParser.components
+			e := p.transition()
+			bytesRead := p.parser.offset
+			p.parser = saveParser
+			goExpr, ok := e.(*nodeGoStrExpr)
+			if !ok || bytesRead != len(value)-1 {
+				p.errorf("component prop %s must be a single Go expression or a literal string", name)
+			}
+			expr = goExpr.expr
+		case strings.ContainsRune(value, transSym) && !strings.Contains(value, transSymEsc):
+			p.errorf("component prop %s must be a single Go expression or a literal string", name)
+		default:
+			value = strings.ReplaceAll(value, transSymEsc, transSymStr)
+			expr = strconv.Quote(html.UnescapeString(value))
+		}
+		args = append(args, name+": "+expr)
+	}
+	result.args = strings.Join(args, ", ")
+
+	if p.match(html.SelfClosingTagToken) {
+		return result
+	}
+
+	p.advance()
+	children := p.parseChildren()
+	if !p.match(html.EndTagToken) || string(p.tagname) != strings.ToLower(result.name) {
+		p.errorf("expected </%s> end tag", result.name)
+	}
+	result.children = &nodeBlock{nodes: children}
+	return result
+}
+
 func isVoidElement(tagname string) bool {
 	// Per spec: https://html.spec.whatwg.org/multipage/syntax.html#void-elements
 	voidElements := map[string]bool{"area": true,
@@ -765,6 +1019,27 @@ func (p *codeParser) parseCode() node {
 	} else if tok == token.IDENT && lit == "partial" {
 		p.advance()
 		e = p.parsePartialKeyword()
+	} else if tok == token.IDENT && lit == "component" {
+		p.advance()
+		e = p.parseComponentKeyword()
+	} else if tok == token.IDENT && lit == "prop" {
+		p.advance()
+		e = p.parsePropKeyword()
+	} else if tok == token.IDENT && (lit == "param" || lit == "query") && strings.ContainsRune(" \t", rune(p.charAt(p.tokenOffset(p.peek())+len(lit)))) {
+		// param and query are only keywords when followed by a declaration,
+		// so that variables by those names may still be used as expressions
+		kind := routeParam
+		if lit == "query" {
+			kind = queryParam
+		}
+		p.advance()
+		e = p.parseParamKeyword(kind)
+	} else if tok == token.IDENT && lit == "flush" && strings.ContainsRune(" \t\r\n<\x00", rune(p.charAt(p.tokenOffset(p.peek())+len(lit)))) {
+		// flush is only a keyword when it stands alone, so that a variable
+		// named flush may still be used as an expression
+		e = p.parseFlushKeyword()
+	} else if tok == token.IDENT && lit == "try" && strings.ContainsRune(" \t\r\n{", rune(p.charAt(p.tokenOffset(p.peek())+len(lit)))) {
+		e = p.parseTryKeyword()
 	} else if tok == token.LBRACE {
 		e = p.parseCodeBlock()
 	} else if tok == token.IMPORT {
@@ -773,6 +1048,16 @@ func (p *codeParser) parseCode() node {
 	} else if tok == token.FOR {
 		p.advance()
 		e = p.parseForStmt()
+	} else if tok == token.SWITCH {
+		e = p.parseSwitchStmt()
+	} else if tok == token.IDENT && lit == "raw" && p.charAt(p.tokenOffset(p.peek())+len(lit)) == '(' {
+		// raw is only a keyword when immediately followed by a paren, so
+		// that a variable named raw may still be used as an expression
+		p.advance()
+		p.advance()
+		result := p.parseExplicitExpression()
+		result.raw = true
+		e = result
 	} else if tok == token.LPAREN {
 		p.advance()
 		e = p.parseExplicitExpression()
@@ -820,26 +1105,46 @@ loop:
 	}
 	stmt.then = p.parseStmtBlock()
 	// parse ^else clause
-	if p.peek().tok == token.XOR {
+	if p.atElse() {
 		p.advance()
-		if p.peek().tok == token.ELSE {
+		p.advance()
+		if p.peek().tok == token.XOR {
 			p.advance()
-			if p.peek().tok == token.XOR {
+			if p.peek().tok == token.IF {
 				p.advance()
-				if p.peek().tok == token.IF {
-					p.advance()
-					stmt.alt = p.parseIfStmt()
-				} else {
-					p.errorf("expected `if' after transition character, got %v", p.peek().String())
-				}
+				stmt.alt = p.parseIfStmt()
 			} else {
-				stmt.alt = p.parseStmtBlock()
+				p.errorf("expected `if' after transition character, got %v", p.peek().String())
 			}
+		} else {
+			stmt.alt = p.parseStmtBlock()
 		}
 	}
 	return &stmt
 }
 
+// atElse reports whether the next tokens are `^else', on the same line as the
+// closing brace of the block just parsed. it doesn't consume any tokens, so
+// that any other transition that follows is left to the HTML parser.
+func (p *codeParser) atElse() bool {
+	return p.atKeyword("else")
+}
+
+// atKeyword reports whether the next tokens are the transition character
+// followed by keyword kw, on the same line as the closing brace of the block
+// just parsed, without consuming any tokens.
+func (p *codeParser) atKeyword(kw string) bool {
+	if p.peek().tok != token.XOR {
+		return false
+	}
+	rest := strings.TrimLeft(p.parser.remainingSource(), " \t")
+	if !strings.HasPrefix(rest, transSymStr+kw) {
+		return false
+	}
+	rest = rest[len(transSymStr+kw):]
+	return rest == "" || !(unicode.IsLetter(rune(rest[0])) || unicode.IsDigit(rune(rest[0])) || rest[0] == '_')
+}
+
 func (p *codeParser) parseForStmt() *nodeFor {
 	var stmt nodeFor
 	start := p.peek().pos
@@ -861,9 +1166,142 @@ loop:
 	stmt.clause.pos.end = offset + n
 	stmt.clause.code = p.sourceFrom(start)[:n]
 	stmt.block = p.parseStmtBlock()
+	// parse ^else block for when the loop body is never executed
+	if p.atElse() {
+		p.advance()
+		p.advance()
+		stmt.alt = p.parseStmtBlock()
+	}
 	return &stmt
 }
 
+func (p *codeParser) parseSwitchStmt() *nodeSwitch {
+	// we are sitting on the 'switch' keyword
+	var stmt nodeSwitch
+	stmt.pos.start = p.tokenOffset(p.peek())
+	p.advance()
+	stmt.pos.end = p.parser.offset
+	stmt.tag = p.parseClauseUntilBrace("SWITCH statement")
+	if p.peek().tok != token.LBRACE {
+		p.errorf("expected '{', got '%s'", p.peek().String())
+	}
+	p.advance()
+	hasDefault := false
+loop:
+	for {
+		switch p.peek().tok {
+		case token.SEMICOLON:
+			// automatically inserted after a closing '}' of a case block
+			// followed by a newline
+			p.advance()
+		case token.RBRACE:
+			p.advance()
+			break loop
+		case token.XOR:
+			p.advance()
+			c := new(nodeCase)
+			c.pos.start = p.tokenOffset(p.peek())
+			switch p.peek().tok {
+			case token.CASE:
+				p.advance()
+				c.pos.end = p.parser.offset
+				c.list = p.parseClauseUntilBrace("CASE clause")
+				if c.list.code == "" {
+					p.errorf("expected expression list after `case'")
+				}
+			case token.DEFAULT:
+				if hasDefault {
+					p.errorf("multiple defaults in SWITCH statement")
+				}
+				hasDefault = true
+				p.advance()
+				c.pos.end = p.parser.offset
+			default:
+				p.errorf("expected `case' or `default' after transition character, got %v", p.peek().String())
+			}
+			c.block = p.parseStmtBlock()
+			stmt.cases = append(stmt.cases, c)
+		case token.EOF:
+			p.errorf("premature end of SWITCH statement")
+		default:
+			p.errorf("expected "+transSymStr+"case or "+transSymStr+"default in SWITCH statement, got %q", p.peek().String())
+		}
+	}
+	return &stmt
+}
+
+// parseClauseUntilBrace consumes Go tokens up to but not including the next
+// '{' token, and returns them as Go code. the code is empty if the '{' token
+// immediately follows. what is a description of the enclosing construct for
+// error messages.
+func (p *codeParser) parseClauseUntilBrace(what string) *nodeGoCode {
+	result := &nodeGoCode{context: inlineGoCode}
+	start := p.peek().pos
+	result.pos.start = p.tokenOffset(p.peek())
+	result.pos.end = result.pos.start
+	consumed := false
+	// depth of the parens, brackets and composite literal braces the clause
+	// is in, so that a '{' inside them doesn't end it
+	depth := 0
+loop:
+	for {
+		switch p.peek().tok {
+		case token.EOF:
+			p.errorf("premature end of %s", what)
+		case token.LBRACE:
+			if depth == 0 && !(consumed && (p.prev().tok == token.IDENT || p.prev().tok == token.RBRACK) && isCompositeLitBrace(p.sourceFrom(p.peek().pos))) {
+				break loop
+			}
+			depth++
+		case token.LPAREN, token.LBRACK:
+			depth++
+		case token.RPAREN, token.RBRACK, token.RBRACE:
+			depth--
+		}
+		consumed = true
+		p.advance()
+	}
+	if consumed {
+		n := (p.file.Offset(p.prev().pos) - p.file.Offset(start)) + len(p.prev().String())
+		result.pos.end = result.pos.start + n
+		result.code = p.sourceFrom(start)[:n]
+	}
+	return result
+}
+
+// isCompositeLitBrace reports whether the '{' at the start of src, following a
+// type name in a clause, opens a composite literal, as in `^case Point{1, 2}
+// {', rather than the block of the clause. the brace opens a literal if the
+// braces match up as Go code, and the clause goes on after the closing brace,
+// with the block's '{', another expression in a list, or a selector or index
+// of the literal. HTML or a transition inside the braces means they're the
+// block.
+func isCompositeLitBrace(src string) bool {
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+	var s scanner.Scanner
+	s.Init(file, []byte(src), nil, 0)
+	depth := 0
+	for {
+		_, tok, _ := s.Scan()
+		switch tok {
+		case token.EOF, token.ILLEGAL, token.XOR, token.LSS:
+			return false
+		case token.LBRACE, token.LPAREN, token.LBRACK:
+			depth++
+		case token.RBRACE, token.RPAREN, token.RBRACK:
+			depth--
+			if depth == 0 {
+				switch _, next, _ := s.Scan(); next {
+				case token.LBRACE, token.COMMA, token.PERIOD, token.LBRACK:
+					return true
+				}
+				return false
+			}
+		}
+	}
+}
+
 func (p *codeParser) parseStmtBlock() *nodeBlock {
 	// we are sitting on the opening '{' token here
 	if p.peek().tok != token.LBRACE {
@@ -897,10 +1335,28 @@ func (p *codeParser) parseStmtBlock() *nodeBlock {
 	return block
 }
 
+// handlerMethods are the HTTP methods a `^handler' may be declared for. HEAD
+// and OPTIONS requests are handled automatically.
+var handlerMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+
 // TODO(paulsmith): extract a common function with parseCodeKeyword
 func (p *codeParser) parseHandlerKeyword() *nodeGoCode {
 	result := &nodeGoCode{context: handlerGoCode}
 	// we are one token past the 'handler' keyword
+	if p.peek().tok == token.IDENT {
+		method := p.peek().lit
+		valid := false
+		for _, m := range handlerMethods {
+			if method == m {
+				valid = true
+			}
+		}
+		if !valid {
+			p.errorf("unsupported HTTP method %s for handler, must be one of %s", method, strings.Join(handlerMethods, ", "))
+		}
+		result.method = method
+		p.advance()
+	}
 	if p.peek().tok != token.LBRACE {
 		p.errorf("expected '{', got '%s'", p.peek().tok)
 	}
@@ -931,6 +1387,35 @@ loop:
 	return result
 }
 
+// parseFlushKeyword parses a `^flush' point in the markup.
+func (p *codeParser) parseFlushKeyword() *nodeFlush {
+	result := new(nodeFlush)
+	result.pos.start = p.tokenOffset(p.peek())
+	result.pos.end = result.pos.start + len("flush")
+	p.advance()
+	return result
+}
+
+// parseTryKeyword parses a `^try' block and its optional `^catch' block.
+func (p *codeParser) parseTryKeyword() *nodeTry {
+	result := new(nodeTry)
+	result.pos.start = p.tokenOffset(p.peek())
+	result.pos.end = result.pos.start + len("try")
+	p.advance()
+	result.block = p.parseStmtBlock()
+	if p.atKeyword("catch") {
+		p.advance()
+		p.advance()
+		// the name of the error variable is optional
+		if p.peek().tok == token.IDENT {
+			result.errVar = p.peek().lit
+			p.advance()
+		}
+		result.catch = p.parseStmtBlock()
+	}
+	return result
+}
+
 func (p *codeParser) parseSectionKeyword() *nodeSection {
 	// enter function one past the "section" IDENT token
 	// FIXME(paulsmith): we are currently requiring that the name of the
@@ -943,7 +1428,17 @@ func (p *codeParser) parseSectionKeyword() *nodeSection {
 	result.pos.start = p.parser.offset
 	p.advance()
 	result.pos.end = p.parser.offset
+	if p.peek().tok == token.DEFER {
+		result.deferred = true
+		p.advance()
+	}
 	result.block = p.parseStmtBlock()
+	// parse ^else block of fallback markup for a deferred section
+	if result.deferred && p.atElse() {
+		p.advance()
+		p.advance()
+		result.fallback = p.parseStmtBlock()
+	}
 	return result
 }
 
@@ -965,6 +1460,133 @@ func (p *codeParser) parsePartialKeyword() *nodePartial {
 	return result
 }
 
+func (p *codeParser) parseComponentKeyword() *nodeComponent {
+	/*
+		examples:
+		TRANS_SYMcomponent Card
+		TRANS_SYMcomponent Card(title: "Hello", count: n)
+		TRANS_SYMcomponent Card(title: "Hello") { <p>children</p> }
+	*/
+	// enter function one past the "component" IDENT token
+	if p.peek().tok != token.IDENT {
+		p.errorf("expected IDENT, got %s", p.peek().tok.String())
+	}
+	result := &nodeComponent{name: p.peek().lit}
+	result.pos.start = p.tokenOffset(p.peek())
+	p.advance()
+	result.pos.end = p.parser.offset
+	if p.peek().tok == token.LPAREN {
+		p.advance()
+		start := p.peek().pos
+		depth := 1
+		consumed := false
+	loop:
+		for {
+			switch p.peek().tok {
+			case token.LPAREN:
+				depth++
+			case token.RPAREN:
+				depth--
+				if depth == 0 {
+					break loop
+				}
+			case token.EOF:
+				p.errorf("unterminated component props, expected closing ')'")
+			}
+			consumed = true
+			p.advance()
+		}
+		if consumed {
+			n := (p.file.Offset(p.prev().pos) - p.file.Offset(start)) + len(p.prev().String())
+			result.args = p.sourceFrom(start)[:n]
+			if _, err := goparser.ParseExpr(result.name + "{" + result.args + "}"); err != nil {
+				p.errorf("component props must be keyed elements like `name: value': %w", err)
+			}
+		}
+		// move past the closing ')'
+		p.advance()
+	}
+	if p.peek().tok == token.LBRACE {
+		result.children = p.parseStmtBlock()
+	}
+	return result
+}
+
+func (p *codeParser) parsePropKeyword() *nodeProp {
+	// enter function one past the "prop" IDENT token
+	if p.peek().tok != token.IDENT {
+		p.errorf("expected IDENT, got %s", p.peek().tok.String())
+	}
+	result := &nodeProp{name: p.peek().lit}
+	result.pos.start = p.tokenOffset(p.peek())
+	p.advance()
+	// the type extends to the end of the line
+	start := p.peek().pos
+	consumed := false
+loop:
+	for {
+		switch p.peek().tok {
+		case token.SEMICOLON, token.EOF:
+			break loop
+		}
+		consumed = true
+		p.advance()
+	}
+	if !consumed {
+		p.errorf("expected a Go type after " + transSymStr + "prop " + result.name)
+	}
+	n := (p.file.Offset(p.prev().pos) - p.file.Offset(start)) + len(p.prev().String())
+	result.typ = p.sourceFrom(start)[:n]
+	result.pos.end = p.parser.offset
+	return result
+}
+
+func (p *codeParser) parseParamKeyword(kind paramKind) *nodeParam {
+	// enter function one past the "param" or "query" IDENT token
+	if p.peek().tok != token.IDENT {
+		p.errorf("expected IDENT, got %s", p.peek().tok.String())
+	}
+	result := &nodeParam{kind: kind, name: p.peek().lit}
+	result.pos.start = p.tokenOffset(p.peek())
+	p.advance()
+	// the type extends to the end of the line or to the '=' of a default value
+	start := p.peek().pos
+	consumed := false
+loop:
+	for {
+		switch p.peek().tok {
+		case token.SEMICOLON, token.EOF, token.ASSIGN:
+			break loop
+		}
+		consumed = true
+		p.advance()
+	}
+	if !consumed {
+		p.errorf("expected a Go type after %s%s %s", transSymStr, kind, result.name)
+	}
+	n := (p.file.Offset(p.prev().pos) - p.file.Offset(start)) + len(p.prev().String())
+	result.typ = p.sourceFrom(start)[:n]
+	if p.peek().tok == token.ASSIGN {
+		p.advance()
+		start := p.peek().pos
+		consumed := false
+		for p.peek().tok != token.SEMICOLON && p.peek().tok != token.EOF {
+			consumed = true
+			p.advance()
+		}
+		if !consumed {
+			p.errorf("expected a default value after '='")
+		}
+		n := (p.file.Offset(p.prev().pos) - p.file.Offset(start)) + len(p.prev().String())
+		result.dflt = p.sourceFrom(start)[:n]
+		if _, err := goparser.ParseExpr(result.dflt); err != nil {
+			p.errorf("illegal Go expression: %w", err)
+		}
+	}
+	result.pos.end = p.parser.offset
+	return result
+}
+
 func (p *codeParser) parseCodeBlock() *nodeGoCode {
 	result := &nodeGoCode{context: inlineGoCode}
 	if p.peek().tok != token.LBRACE {
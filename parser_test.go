@@ -21,6 +21,171 @@ func TestParse(t *testing.T) {
 				},
 			},
 		},
+		{
+			"^for _, x := range xs { <p>^x</p> } ^else { <p>none</p> } ^name",
+			&syntaxTree{
+				nodes: []node{
+					&nodeFor{
+						clause: &nodeGoCode{code: "_, x := range xs", pos: span{start: 5, end: 21}},
+						block: &nodeBlock{
+							nodes: []node{
+								&nodeLiteral{str: " ", pos: span{start: 23, end: 24}},
+								&nodeElement{
+									tag:           tag{name: "p"},
+									startTagNodes: []node{&nodeLiteral{str: "<p>", pos: span{start: 24, end: 27}}},
+									pos:           span{start: 24, end: 27},
+									children:      []node{&nodeGoStrExpr{expr: "x", pos: span{start: 28, end: 29}}},
+								},
+							},
+						},
+						alt: &nodeBlock{
+							nodes: []node{
+								&nodeLiteral{str: " ", pos: span{start: 43, end: 44}},
+								&nodeElement{
+									tag:           tag{name: "p"},
+									startTagNodes: []node{&nodeLiteral{str: "<p>", pos: span{start: 44, end: 47}}},
+									pos:           span{start: 44, end: 47},
+									children:      []node{&nodeLiteral{str: "none", pos: span{start: 47, end: 51}}},
+								},
+							},
+						},
+					},
+					&nodeLiteral{str: " ", pos: span{start: 57, end: 58}},
+					&nodeGoStrExpr{expr: "name", pos: span{start: 59, end: 63}},
+				},
+			},
+		},
+		{
+			`<input type="checkbox" checked=^?done ^attrs(extra)>`,
+			&syntaxTree{
+				nodes: []node{
+					&nodeLiteral{str: "<input ", pos: span{start: 0, end: 7}},
+					&nodeLiteral{str: "type", pos: span{start: 7, end: 11}},
+					&nodeLiteral{str: `="`, pos: span{start: 11, end: 13}},
+					&nodeLiteral{str: "checkbox", pos: span{start: 13, end: 21}},
+					&nodeLiteral{str: `"`, pos: span{start: 21, end: 22}},
+					&nodeCondAttr{
+						name:  "checked",
+						value: &nodeGoStrExpr{expr: "done", pos: span{start: 33, end: 37}},
+						pos:   span{start: 23, end: 37},
+					},
+					&nodeSpreadAttrs{
+						value:  &nodeGoStrExpr{expr: "extra", pos: span{start: 45, end: 50}},
+						static: []string{"type", "checked"},
+						pos:    span{start: 38, end: 51},
+					},
+					&nodeLiteral{str: ">", pos: span{start: 51, end: 52}},
+				},
+			},
+		},
+		{
+			"a ^* x ^y <p> *^b",
+			&syntaxTree{
+				nodes: []node{
+					&nodeLiteral{str: "a ", pos: span{start: 0, end: 2}},
+					&nodeLiteral{str: "b", pos: span{start: 16, end: 17}},
+				},
+			},
+		},
+		{
+			"^if x { <div><!-- c -->^* gone *^</div> }",
+			&syntaxTree{
+				nodes: []node{
+					&nodeIf{
+						cond: &nodeGoStrExpr{expr: "x", pos: span{start: 4, end: 5}},
+						then: &nodeBlock{
+							nodes: []node{
+								&nodeLiteral{str: " ", pos: span{start: 7, end: 8}},
+								&nodeElement{
+									tag:           tag{name: "div"},
+									startTagNodes: []node{&nodeLiteral{str: "<div>", pos: span{start: 8, end: 13}}},
+									pos:           span{start: 8, end: 13},
+									children:      []node{&nodeLiteral{str: "<!-- c -->", pos: span{start: 13, end: 23}}},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			`^raw(html) ^raw`,
+			&syntaxTree{
+				nodes: []node{
+					&nodeGoStrExpr{expr: "html", pos: span{start: 5, end: 9}, raw: true},
+					&nodeLiteral{str: " ", pos: span{start: 10, end: 11}},
+					&nodeGoStrExpr{expr: "raw", pos: span{start: 12, end: 15}},
+				},
+			},
+		},
+		{
+			`<p>a</p>^flush ^flush.x`,
+			&syntaxTree{
+				nodes: []node{
+					&nodeLiteral{str: "<p>", pos: span{end: 3}},
+					&nodeLiteral{str: "a", pos: span{start: 3, end: 4}},
+					&nodeLiteral{str: "</p>", pos: span{start: 4, end: 8}},
+					&nodeFlush{pos: span{start: 9, end: 14}},
+					&nodeLiteral{str: " ", pos: span{start: 14, end: 15}},
+					&nodeGoStrExpr{expr: "flush.x", pos: span{start: 16, end: 23}},
+				},
+			},
+		},
+		{
+			`^try {<p>x</p>} ^catch err {<p>y</p>}`,
+			&syntaxTree{
+				nodes: []node{
+					&nodeTry{
+						pos: span{start: 1, end: 4},
+						block: &nodeBlock{nodes: []node{
+							&nodeElement{
+								tag:           tag{name: "p"},
+								startTagNodes: []node{&nodeLiteral{str: "<p>", pos: span{start: 6, end: 9}}},
+								pos:           span{start: 6, end: 9},
+								children:      []node{&nodeLiteral{str: "x", pos: span{start: 9, end: 10}}},
+							},
+						}},
+						errVar: "err",
+						catch: &nodeBlock{nodes: []node{
+							&nodeElement{
+								tag:           tag{name: "p"},
+								startTagNodes: []node{&nodeLiteral{str: "<p>", pos: span{start: 28, end: 31}}},
+								pos:           span{start: 28, end: 31},
+								children:      []node{&nodeLiteral{str: "y", pos: span{start: 31, end: 32}}},
+							},
+						}},
+					},
+				},
+			},
+		},
+		{
+			`^section recs defer {<p>x</p>} ^else {<p>y</p>}`,
+			&syntaxTree{
+				nodes: []node{
+					&nodeSection{
+						name: "recs",
+						pos:  span{start: 8, end: 13},
+						block: &nodeBlock{nodes: []node{
+							&nodeElement{
+								tag:           tag{name: "p"},
+								startTagNodes: []node{&nodeLiteral{str: "<p>", pos: span{start: 21, end: 24}}},
+								pos:           span{start: 21, end: 24},
+								children:      []node{&nodeLiteral{str: "x", pos: span{start: 24, end: 25}}},
+							},
+						}},
+						deferred: true,
+						fallback: &nodeBlock{nodes: []node{
+							&nodeElement{
+								tag:           tag{name: "p"},
+								startTagNodes: []node{&nodeLiteral{str: "<p>", pos: span{start: 38, end: 41}}},
+								pos:           span{start: 38, end: 41},
+								children:      []node{&nodeLiteral{str: "y", pos: span{start: 41, end: 42}}},
+							},
+						}},
+					},
+				},
+			},
+		},
 		{
 			`<a href="^^foo"></a>`,
 			&syntaxTree{
@@ -197,6 +362,22 @@ func TestParse(t *testing.T) {
 				},
 			},
 		},
+		{
+			`^layout(names[i])`,
+			&syntaxTree{
+				nodes: []node{
+					&nodeLayout{expr: "names[i]", pos: span{start: 1, end: 17}},
+				},
+			},
+		},
+		{
+			`^handler POST {x()}`,
+			&syntaxTree{
+				nodes: []node{
+					&nodeGoCode{context: handlerGoCode, method: "POST", code: "x()", pos: span{start: 15, end: 18}},
+				},
+			},
+		},
 		{
 			`^import "time"`,
 			&syntaxTree{
@@ -426,6 +607,139 @@ func TestParse(t *testing.T) {
 				},
 			},
 		},
+		{
+			`^switch x {
+^case 1, 2 { <p></p> }
+^default { <br/> }
+}`,
+			&syntaxTree{
+				nodes: []node{
+					&nodeSwitch{
+						tag: &nodeGoCode{code: "x", pos: span{start: 8, end: 9}},
+						pos: span{start: 1, end: 7},
+						cases: []*nodeCase{
+							{
+								list: &nodeGoCode{code: "1, 2", pos: span{start: 18, end: 22}},
+								pos:  span{start: 13, end: 17},
+								block: &nodeBlock{
+									nodes: []node{
+										&nodeLiteral{str: " ", pos: span{start: 24, end: 25}},
+										&nodeElement{
+											tag:           tag{name: "p"},
+											startTagNodes: []node{&nodeLiteral{str: "<p>", pos: span{start: 25, end: 28}}},
+											pos:           span{start: 25, end: 28},
+										},
+									},
+								},
+							},
+							{
+								pos: span{start: 36, end: 43},
+								block: &nodeBlock{
+									nodes: []node{
+										&nodeLiteral{str: " ", pos: span{start: 45, end: 46}},
+										&nodeElement{
+											tag:           tag{name: "br"},
+											startTagNodes: []node{&nodeLiteral{str: "<br/>", pos: span{start: 46, end: 51}}},
+											pos:           span{start: 46, end: 51},
+											selfClosing:   true,
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			// composite literals in the clauses
+			`^switch f(T{}) {
+^case Point{1, 2}, Point{3, 4} { <br/> }
+}`,
+			&syntaxTree{
+				nodes: []node{
+					&nodeSwitch{
+						tag: &nodeGoCode{code: "f(T{})", pos: span{start: 8, end: 14}},
+						pos: span{start: 1, end: 7},
+						cases: []*nodeCase{
+							{
+								list: &nodeGoCode{code: "Point{1, 2}, Point{3, 4}", pos: span{start: 23, end: 47}},
+								pos:  span{start: 18, end: 22},
+								block: &nodeBlock{
+									nodes: []node{
+										&nodeLiteral{str: " ", pos: span{start: 49, end: 50}},
+										&nodeElement{
+											tag:           tag{name: "br"},
+											startTagNodes: []node{&nodeLiteral{str: "<br/>", pos: span{start: 50, end: 55}}},
+											pos:           span{start: 50, end: 55},
+											selfClosing:   true,
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			`<Card title=^t itemCount="3" featured><p></p></Card>`,
+			&syntaxTree{
+				nodes: []node{
+					&nodeComponent{
+						name: "Card",
+						args: `title: t, itemCount: "3", featured: true`,
+						pos:  span{start: 0, end: 38},
+						children: &nodeBlock{
+							nodes: []node{
+								&nodeElement{
+									tag:           tag{name: "p"},
+									startTagNodes: []node{&nodeLiteral{str: "<p>", pos: span{start: 38, end: 41}}},
+									pos:           span{start: 38, end: 41},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			`^component Card(title: "x")
+^prop title string
+`,
+			&syntaxTree{
+				nodes: []node{
+					&nodeComponent{
+						name: "Card",
+						args: `title: "x"`,
+						pos:  span{start: 11, end: 15},
+					},
+					&nodeLiteral{str: "\n", pos: span{start: 27, end: 28}},
+					&nodeProp{name: "title", typ: "string", pos: span{start: 34, end: 46}},
+					&nodeLiteral{str: "\n", pos: span{start: 46, end: 47}},
+				},
+			},
+		},
+		{
+			"^param id int\n^query page int = 1\n",
+			&syntaxTree{
+				nodes: []node{
+					&nodeParam{kind: routeParam, name: "id", typ: "int", pos: span{start: 7, end: 13}},
+					&nodeLiteral{str: "\n", pos: span{start: 13, end: 14}},
+					&nodeParam{kind: queryParam, name: "page", typ: "int", dflt: "1", pos: span{start: 21, end: 33}},
+					&nodeLiteral{str: "\n", pos: span{start: 33, end: 34}},
+				},
+			},
+		},
+		{
+			// not a declaration, so an expression
+			`^query`,
+			&syntaxTree{
+				nodes: []node{
+					&nodeGoStrExpr{expr: "query", pos: span{start: 1, end: 6}},
+				},
+			},
+		},
 	}
 	opts := cmp.AllowUnexported(unexported...)
 	for _, test := range tests {
@@ -445,14 +759,24 @@ var unexported = []any{
 	attr{},
 	importDecl{},
 	nodeBlock{},
+	nodeCase{},
+	nodeComponent{},
+	nodeCondAttr{},
 	nodeElement{},
+	nodeFlush{},
+	nodeFor{},
 	nodeGoCode{},
 	nodeGoStrExpr{},
 	nodeIf{},
 	nodeImport{},
 	nodeLayout{},
 	nodeLiteral{},
+	nodeParam{},
+	nodeProp{},
 	nodeSection{},
+	nodeSpreadAttrs{},
+	nodeSwitch{},
+	nodeTry{},
 	nodePartial{},
 	span{},
 	stringPos{},
@@ -473,6 +797,18 @@ func TestParseSyntaxErrors(t *testing.T) {
 	<illegal />
 }`, 3, 2,
 		},
+		{"^switch x {\n\t<p></p>\n}", 1, 12},
+		{"^switch x {\n^default { <p></p> }\n^default { <p></p> }\n}", 3, 2},
+		{"<Card title=\"^t and more\"></Card>", 1, 27},
+		{"<Card><p></p></Cart>", 1, 21},
+		{"<p ^attrs(a b)></p>", 1, 12},
+		{"<p>\n ^* x </p>", 2, 2},
+		{"<p\n  ^attrs(m)=x></p>", 2, 13},
+		{"<p checked=^?></p>", 1, 14},
+		{"^layout(\"a\" +)\n", 1, 15},
+		{"^query page\n", 1, 12},
+		{"^query page int =\n", 1, 18},
+		{"^handler FETCH {}\n", 1, 9},
 		// FIXME(paulsmith): add more syntax errors
 	}
 
@@ -520,6 +856,40 @@ func FuzzParser(f *testing.F) {
 	})
 }
 
+func TestParseUppercaseTags(t *testing.T) {
+	tests := []struct {
+		input      string
+		components map[string]bool
+		want       []string
+	}{
+		{"<P>Hi<BR></P>", nil, nil},
+		{"<HTML><BODY><P>Hi</P></BODY></HTML>", nil, nil},
+		{"<Card></Card>", nil, []string{"Card"}},
+		{"<Table><Card/></Table>", map[string]bool{"Card": true}, []string{"Card"}},
+		{"<Table><TR><TD>x</TD></TR></Table>", map[string]bool{"Card": true}, nil},
+		{"^if true {\n<Table><P>x</P></Table>\n}", map[string]bool{}, nil},
+		{"^if true {\n<Table/>\n}", map[string]bool{"Table": true}, []string{"Table"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			tree, err := parseWithComponents(tt.input, tt.components)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			inspect(nodeList(tree.nodes), func(n node) bool {
+				if c, ok := n.(*nodeComponent); ok {
+					got = append(got, c.name)
+				}
+				return true
+			})
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("components (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestTagString(t *testing.T) {
 	tests := []struct {
 		tag  tag
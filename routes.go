@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// routeEntry is a route of a Pushup app, to a page or to an inline partial of
+// a page.
+type routeEntry struct {
+	route string
+	pfile projectFile
+	// the inline partial the route is to, or nil for a page
+	partial *partial
+	// position of the partial in the page's source
+	line, column int
+	// name of the generated Go type that responds to the route
+	typename string
+	// HTTP methods the page has handlers for, or nil for every method
+	methods []string
+	// layout the page is rendered with, for display
+	layout string
+	// parameters of the page: its dynamic segments, and query parameters
+	params []pageParam
+}
+
+// pageParam is a parameter of a route, either a dynamic segment of its path
+// or a query parameter declared with `^query'.
+type pageParam struct {
+	name string
+	kind paramKind
+	// Go type the parameter is declared as, string if it isn't
+	typ string
+	// whether a route parameter's segment is optional, like `$[page]'
+	optional bool
+	// Go expression of a query parameter's default value
+	dflt string
+}
+
+// sourceLine returns the line of the source where the route is declared: the line
+// of an inline partial, or the first line of a page.
+func (e *routeEntry) sourceLine() int {
+	if e.partial == nil {
+		return 1
+	}
+	return e.line
+}
+
+// pos returns the position of the page or partial, for diagnostics.
+func (e *routeEntry) pos() string {
+	if e.partial == nil {
+		return e.pfile.path
+	}
+	return fmt.Sprintf("%s:%d:%d", e.pfile.path, e.line, e.column)
+}
+
+// describe returns a description of the page or partial, for diagnostics.
+func (e *routeEntry) describe() string {
+	if e.partial == nil {
+		return "page " + e.pfile.path
+	}
+	return fmt.Sprintf("partial %s at %s", e.partial.urlpath(), e.pos())
+}
+
+// buildRouteTable returns the routes of the pages of the project and of their
+// inline partials, in the order of the pages. error pages don't have routes.
+func buildRouteTable(files *projectFiles) ([]*routeEntry, error) {
+	var table []*routeEntry
+	for _, pfile := range files.pages {
+		if _, ok := errorPageStatus(pfile.relpath()); ok {
+			continue
+		}
+		b, err := os.ReadFile(pfile.path)
+		if err != nil {
+			return nil, fmt.Errorf("reading page file: %w", err)
+		}
+		src := string(b)
+		tree, err := parseWithComponents(src, files.componentNames())
+		if err != nil {
+			return nil, fmt.Errorf("parsing page file %s: %w", pfile.path, err)
+		}
+		page, err := newPageFromTree(tree, src, files.defaultLayout(pfile))
+		if err != nil {
+			return nil, fmt.Errorf("page file %s: %w", pfile.path, err)
+		}
+		route := pfile.route()
+		var methods []string
+		for _, h := range page.methodHandlers {
+			methods = append(methods, h.method)
+		}
+		table = append(table, &routeEntry{
+			route:    route,
+			pfile:    pfile,
+			typename: generatedTypename(pfile, upFilePage),
+			methods:  methods,
+			layout:   displayLayout(page),
+			params:   pageRouteParams(route, page),
+		})
+		for _, p := range page.partials {
+			// the position of a partial is just past the keyword, so skip to
+			// its name
+			start := min(p.node.Pos().start, len(src))
+			for start < len(src) && (src[start] == ' ' || src[start] == '\t') {
+				start++
+			}
+			// partials respond to the same methods as their page, and are
+			// rendered without a layout
+			route := routeForPartial(pfile.relpath(), p.urlpath())
+			table = append(table, &routeEntry{
+				route:    route,
+				pfile:    pfile,
+				partial:  p,
+				line:     lineCount(src[:start]),
+				column:   start - strings.LastIndexByte(src[:start], '\n'),
+				typename: generatedTypenamePartial(p, pfile),
+				methods:  methods,
+				layout:   "!",
+				params:   pageRouteParams(route, page),
+			})
+		}
+	}
+	return table, nil
+}
+
+// displayLayout returns the layout a page is rendered with, for display: the
+// layout's name, the expression that picks it at request time in
+// parentheses, or "!" if the page has no layout.
+func displayLayout(p *page) string {
+	switch {
+	case p.layoutExpr != "":
+		return "(" + p.layoutExpr + ")"
+	case p.layout == "":
+		return "!"
+	}
+	return p.layout
+}
+
+// pageRouteParams returns the parameters of a route of the page: the dynamic
+// segments of the route, with the types of their `^param' declarations, and
+// the page's `^query' parameters.
+func pageRouteParams(route string, p *page) []pageParam {
+	var params []pageParam
+	for _, seg := range strings.Split(route, "/") {
+		if routeSegmentRank(seg) == 0 {
+			continue
+		}
+		param := pageParam{name: strings.TrimSuffix(seg[1:], "?"), kind: routeParam, typ: "string", optional: strings.HasSuffix(seg, "?")}
+		for _, decl := range p.params {
+			if decl.kind == routeParam && decl.name == param.name {
+				param.typ = decl.typ
+			}
+		}
+		params = append(params, param)
+	}
+	for _, decl := range p.params {
+		if decl.kind == queryParam {
+			params = append(params, pageParam{name: decl.name, kind: queryParam, typ: decl.typ, dflt: decl.dflt})
+		}
+	}
+	return params
+}
+
+// routeSegmentRank ranks a segment of a route by how specific it is, the same
+// as the router does: a static segment is 0, then `:name', `:name?', `*name'
+// and `*name?'.
+func routeSegmentRank(seg string) int {
+	var rank int
+	switch {
+	case strings.HasPrefix(seg, ":"):
+		rank = 1
+	case strings.HasPrefix(seg, "*"):
+		rank = 3
+	default:
+		return 0
+	}
+	if strings.HasSuffix(seg, "?") {
+		rank++
+	}
+	return rank
+}
+
+// routeSegments returns the segments of a route, following its leading slash.
+func routeSegments(route string) []string {
+	return strings.Split(strings.TrimPrefix(route, "/"), "/")
+}
+
+// compareRoutePrecedence compares two routes by the order the router tries
+// them in, returning a negative number if a is tried before b. at the first
+// segment where they differ in kind, the more specific segment comes first,
+// and a route that spells out more segments comes before one that ends where
+// it has the same kinds of segments. the segment where the routes differ is
+// returned too, or -1 if neither is tried first.
+func compareRoutePrecedence(a, b string) (int, int) {
+	as, bs := routeSegments(a), routeSegments(b)
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if ra, rb := routeSegmentRank(as[i]), routeSegmentRank(bs[i]); ra != rb {
+			return ra - rb, i
+		}
+	}
+	if len(as) != len(bs) {
+		return len(bs) - len(as), min(len(as), len(bs))
+	}
+	return 0, -1
+}
+
+// sortRouteTable sorts the routes in the order of their precedence. routes
+// that can't match the same URL paths, because they differ in a static
+// segment, are ordered by that segment, so that routes are grouped by their
+// leading segments.
+func sortRouteTable(table []*routeEntry) {
+	sort.SliceStable(table, func(i, j int) bool {
+		as, bs := routeSegments(table[i].route), routeSegments(table[j].route)
+		for k := 0; k < len(as) && k < len(bs); k++ {
+			ra, rb := routeSegmentRank(as[k]), routeSegmentRank(bs[k])
+			if ra == 0 && rb == 0 && as[k] != bs[k] {
+				return as[k] < bs[k]
+			}
+			if ra != rb {
+				return ra < rb
+			}
+		}
+		if len(as) != len(bs) {
+			return len(as) > len(bs)
+		}
+		return table[i].route < table[j].route
+	})
+}
+
+// matchRoute reports whether the URL path matches the route, the same as the
+// router matches it, and returns the values of its dynamic segments by name.
+func matchRoute(route string, path string) (map[string]string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	vals := make(map[string]string)
+	if !matchSegments(routeSegments(route), strings.Split(path[1:], "/"), vals) {
+		return nil, false
+	}
+	return vals, true
+}
+
+func matchSegments(segs []string, parts []string, vals map[string]string) bool {
+	if len(segs) == 0 {
+		return len(parts) == 0
+	}
+	seg := segs[0]
+	rank := routeSegmentRank(seg)
+	if rank == 0 {
+		return len(parts) > 0 && parts[0] == seg && matchSegments(segs[1:], parts[1:], vals)
+	}
+	name := strings.TrimSuffix(seg[1:], "?")
+	optional := rank == 2 || rank == 4
+	// a single segment matches one non-empty segment, and a rest segment as
+	// many as it can
+	end := 0
+	for end < len(parts) && parts[end] != "" {
+		end++
+	}
+	if rank <= 2 {
+		end = min(end, 1)
+	}
+	for i := end; i > 0; i-- {
+		if matchSegments(segs[1:], parts[i:], vals) {
+			vals[name] = strings.Join(parts[:i], "/")
+			return true
+		}
+	}
+	if optional && matchSegments(segs[1:], parts, vals) {
+		vals[name] = ""
+		return true
+	}
+	return false
+}
+
+// checkProject builds the route table of the project and checks that no two
+// of its files or routes map to the same generated Go type, output file, URL
+// builder, or route, and that no two routes are ambiguous, differing only in the names of
+// their parameters. every collision is reported, with the positions of both
+// sides.
+func checkProject(files *projectFiles) ([]*routeEntry, error) {
+	table, err := buildRouteTable(files)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	// pairs of positions that already collide, so that a collision that
+	// follows from another isn't reported twice
+	collided := make(map[[2]string]bool)
+
+	// claim records that pos maps to key, reporting a collision if something
+	// else already does
+	claim := func(claimed map[string]string, key string, pos string, what string) {
+		if prev, ok := claimed[key]; ok {
+			errs = append(errs, fmt.Errorf("%s: %s %s collides with %s", pos, what, key, prev))
+			collided[[2]string{prev, pos}] = true
+			return
+		}
+		claimed[key] = pos
+	}
+
+	// generated Go type names
+	{
+		claimed := make(map[string]string)
+		for _, pfile := range files.layouts {
+			claim(claimed, generatedTypename(pfile, upFileLayout), pfile.path, "type name")
+		}
+		for _, pfile := range files.components {
+			claim(claimed, generatedTypename(pfile, upFileComponent), pfile.path, "type name")
+		}
+		for _, pfile := range files.pages {
+			if _, ok := errorPageStatus(pfile.relpath()); ok {
+				claim(claimed, generatedTypename(pfile, upFilePage), pfile.path, "type name")
+			}
+		}
+		for _, e := range table {
+			claim(claimed, e.typename, e.pos(), "type name")
+		}
+		for _, pfile := range files.middlewares {
+			dir := filepath.Dir(pfile.relpath())
+			claim(claimed, "pagesMiddleware"+typenameFromPath(dir), pfile.path, "middleware name")
+		}
+	}
+
+	// generated and copied files in the build directory
+	{
+		claimed := map[string]string{
+			"pushup_support.go": "the Pushup runtime",
+			urlBuildersFileName: "the URL builders",
+		}
+		for _, pfile := range files.layouts {
+			claim(claimed, compiledOutputPath(pfile, upFileLayout), pfile.path, "output file")
+		}
+		for _, pfile := range files.components {
+			claim(claimed, compiledOutputPath(pfile, upFileComponent), pfile.path, "output file")
+		}
+		for _, pfile := range files.pages {
+			claim(claimed, compiledOutputPath(pfile, upFilePage), pfile.path, "output file")
+		}
+		for _, pfile := range files.middlewares {
+			claim(claimed, middlewareOutputPath(pfile), pfile.path, "output file")
+		}
+		for _, path := range files.gofiles {
+			claim(claimed, filepath.Base(path), path, "output file")
+		}
+	}
+
+	// routes
+	{
+		shapes := make(map[string]*routeEntry)
+		reported := make(map[[2]*routeEntry]bool)
+		for _, e := range table {
+			for _, shape := range routeShapes(e.route) {
+				prev, ok := shapes[shape]
+				if !ok {
+					shapes[shape] = e
+					continue
+				}
+				if prev == e || reported[[2]*routeEntry{prev, e}] {
+					continue
+				}
+				reported[[2]*routeEntry{prev, e}] = true
+				collided[[2]string{prev.pos(), e.pos()}] = true
+				if prev.route == e.route {
+					errs = append(errs, fmt.Errorf("%s: route %s collides with %s", e.pos(), e.route, prev.describe()))
+				} else {
+					errs = append(errs, fmt.Errorf("%s: route %s is ambiguous with route %s of %s", e.pos(), e.route, prev.route, prev.describe()))
+				}
+			}
+		}
+	}
+
+	// generated URL builder names, which collide when routes differ only in
+	// punctuation, or in a static segment and a parameter of the same name
+	{
+		claimed := make(map[string]string)
+		for _, e := range table {
+			name := urlBuilderName(e.route)
+			if prev, ok := claimed[name]; ok && collided[[2]string{prev, e.pos()}] {
+				continue
+			}
+			claim(claimed, name, e.pos(), "URL builder name")
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return table, nil
+}
+
+// routeShapes returns the forms of a route that match the URL paths that it
+// matches, with the names of its dynamic segments left out, and each of its
+// optional segments either present or absent. routes that share a shape match
+// the same URL paths, and only one of them could ever respond to them.
+func routeShapes(route string) []string {
+	shapes := []string{""}
+	for _, seg := range strings.Split(strings.TrimPrefix(route, "/"), "/") {
+		var kind string
+		switch {
+		case strings.HasPrefix(seg, ":"):
+			kind = ":"
+		case strings.HasPrefix(seg, "*"):
+			kind = "*"
+		default:
+			kind = seg
+		}
+		n := len(shapes)
+		for i := 0; i < n; i++ {
+			if kind != seg && strings.HasSuffix(seg, "?") {
+				// the absent form
+				shapes = append(shapes, shapes[i])
+			}
+			shapes[i] += "/" + kind
+		}
+	}
+	return shapes
+}
+
+// urlBuildersFileName is the name of the generated Go file with the URL
+// builders of the routes.
+const urlBuildersFileName = "pushup_urls.go"
+
+// urlBuilderName returns the name of the generated method that builds URL
+// paths for the route, e.g., CrudAlbumId for "/crud/album/:id". a route to a
+// directory's index page ends in Index.
+func urlBuilderName(route string) string {
+	if strings.HasSuffix(route, "/") {
+		route += "index"
+	}
+	return typenameFromPath(route)
+}
+
+// genURLBuilders generates the URL builders of the routes: a method of the
+// package-level urls value for each route, taking its dynamic segments as
+// arguments of their `^param' types and returning the URL path. linking to
+// a page with its builder, rather than spelling out its path, makes renaming
+// or removing the page a Go compile error.
+func genURLBuilders(table []*routeEntry) ([]byte, error) {
+	table = append([]*routeEntry(nil), table...)
+	sort.SliceStable(table, func(i, j int) bool {
+		return urlBuilderName(table[i].route) < urlBuilderName(table[j].route)
+	})
+	var b bytes.Buffer
+	b.WriteString("// this file is mechanically generated, do not edit!\n")
+	b.WriteString("// version: ")
+	printVersion(&b)
+	b.WriteString("\n")
+	b.WriteString("package build\n\n")
+	b.WriteString("// urlBuilders has a method for each route of the app that returns the\n")
+	b.WriteString("// route's URL path.\n")
+	b.WriteString("type urlBuilders struct{}\n\n")
+	b.WriteString("// urls builds the URL paths of the app's routes.\n")
+	b.WriteString("var urls urlBuilders\n\n")
+	for _, e := range table {
+		var args, vals []string
+		for i, p := range e.params {
+			if p.kind != routeParam {
+				continue
+			}
+			// suffixed, so that a parameter named like routeURL or a
+			// predeclared identifier doesn't shadow it. a segment's name
+			// needn't be a Go identifier, like `$my-id.up'
+			name := p.name + "Param"
+			if !token.IsIdentifier(name) {
+				name = fmt.Sprintf("param%d", i)
+			}
+			// an optional segment is left out if its value is nil, as a rest
+			// parameter's is if its slice is nil
+			typ := p.typ
+			if p.optional && typ != "[]string" {
+				typ = "*" + typ
+			}
+			args = append(args, name+" "+typ)
+			vals = append(vals, ", "+name)
+		}
+		what := "page " + filepath.ToSlash(e.pfile.relpath())
+		if e.partial != nil {
+			what = fmt.Sprintf("partial %s of page %s", e.partial.urlpath(), filepath.ToSlash(e.pfile.relpath()))
+		}
+		fmt.Fprintf(&b, "// %s returns the URL path of the route %s, to %s.\n", urlBuilderName(e.route), e.route, what)
+		fmt.Fprintf(&b, "func (urlBuilders) %s(%s) string {\n", urlBuilderName(e.route), strings.Join(args, ", "))
+		fmt.Fprintf(&b, "\treturn routeURL(%s%s)\n", strconv.Quote(e.route), strings.Join(vals, ""))
+		b.WriteString("}\n\n")
+	}
+	formatted, err := format.Source(b.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("gofmt the generated code: %w", err)
+	}
+	return formatted, nil
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRouteShapes(t *testing.T) {
+	tests := []struct {
+		route string
+		want  []string
+	}{
+		{"/", []string{"/"}},
+		{"/about", []string{"/about"}},
+		{"/people/", []string{"/people/"}},
+		{"/people/:id", []string{"/people/:"}},
+		{"/docs/*path", []string{"/docs/*"}},
+		{"/archive/:year?", []string{"/archive/:", "/archive"}},
+		{"/files/*path?/edit", []string{"/files/*/edit", "/files/edit"}},
+		{"/:a?/:b?", []string{"/:/:", "/:", "/:", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.route, func(t *testing.T) {
+			if diff := cmp.Diff(tt.want, routeShapes(tt.route)); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// writeProjectFiles writes the files, keyed by their paths relative to the
+// app directory, to a temporary app directory and returns it and the project
+// files in it, in lexical order like findProjectFiles finds them.
+func writeProjectFiles(t *testing.T, files map[string]string) (string, *projectFiles) {
+	t.Helper()
+	appDir := t.TempDir()
+	pf := &projectFiles{dirLayouts: make(map[string]string)}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		src := files[name]
+		path := filepath.Join(appDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		subdir, _, _ := strings.Cut(name, "/")
+		pfile := projectFile{path: path, projectFilesSubdir: filepath.Join(appDir, subdir)}
+		switch {
+		case subdir == "layouts":
+			pf.layouts = append(pf.layouts, pfile)
+		case subdir == "components":
+			pf.components = append(pf.components, pfile)
+		case subdir == "static":
+			pf.static = append(pf.static, pfile)
+		case subdir == "pkg":
+			pf.gofiles = append(pf.gofiles, path)
+		case filepath.Base(name) == middlewareFileName:
+			pf.middlewares = append(pf.middlewares, pfile)
+		default:
+			pf.pages = append(pf.pages, pfile)
+		}
+	}
+	return appDir, pf
+}
+
+func TestCheckProject(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  []string
+	}{
+		{
+			"no collisions",
+			map[string]string{
+				"pages/index.up":       "<h1>Home</h1>",
+				"pages/people/$id.up":  "<h1>Person</h1>",
+				"pages/people/new.up":  "<h1>New</h1>",
+				"pages/item.up":        "^partial edit {<p>edit</p>}",
+				"pages/_404.up":        "<h1>Not found</h1>",
+				"pages/docs/$...p.up":  "<h1>Docs</h1>",
+				"layouts/default.up":   "^outputSection(\"contents\")",
+				"components/card.up":   "<div></div>",
+				"pkg/app.go":           "package build",
+				"pages/_middleware.go": "package build",
+			},
+			nil,
+		},
+		{
+			"type names",
+			map[string]string{
+				"pages/foo-bar.up": "",
+				"pages/foo_bar.up": "",
+			},
+			[]string{"pages/foo_bar.up: type name FooBarPage collides with pages/foo-bar.up"},
+		},
+		{
+			"output files",
+			map[string]string{
+				"pages/a/b.up":  "",
+				"pages/a__b.up": "",
+			},
+			[]string{
+				"pages/a__b.up: type name ABPage collides with pages/a/b.up",
+				"pages/a__b.up: output file a__b.up.go collides with pages/a/b.up",
+			},
+		},
+		{
+			"partial and page",
+			map[string]string{
+				"pages/item.up":      "<h1>Item</h1>\n^partial edit {<p>edit</p>}",
+				"pages/item/edit.up": "",
+			},
+			[]string{"pages/item/edit.up: route /item/edit collides with partial edit at pages/item.up:2:10"},
+		},
+		{
+			"ambiguous parameters",
+			map[string]string{
+				"pages/$a.up": "",
+				"pages/$b.up": "",
+			},
+			[]string{"pages/$b.up: route /:b is ambiguous with route /:a of page pages/$a.up"},
+		},
+		{
+			"absent optional segment",
+			map[string]string{
+				"pages/archive.up":         "",
+				"pages/archive/$[year].up": "",
+			},
+			[]string{"pages/archive/$[year].up: route /archive/:year? is ambiguous with route /archive of page pages/archive.up"},
+		},
+		{
+			"route groups",
+			map[string]string{
+				"pages/(marketing)/about.up": "",
+				"pages/about.up":             "",
+			},
+			[]string{"pages/about.up: route /about collides with page pages/(marketing)/about.up"},
+		},
+		{
+			"Go file and runtime",
+			map[string]string{
+				"pkg/pushup_support.go": "package build",
+			},
+			[]string{"pkg/pushup_support.go: output file pushup_support.go collides with the Pushup runtime"},
+		},
+		{
+			"URL builder names",
+			map[string]string{
+				"pages/people/$id.up": "",
+				"pages/people/id.up":  "",
+				"pkg/pushup_urls.go":  "package build",
+			},
+			[]string{
+				"pkg/pushup_urls.go: output file pushup_urls.go collides with the URL builders",
+				"pages/people/id.up: URL builder name PeopleId collides with pages/people/$id.up",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appDir, files := writeProjectFiles(t, tt.files)
+			_, err := checkProject(files)
+			var got []string
+			if err != nil {
+				for _, line := range strings.Split(err.Error(), "\n") {
+					got = append(got, strings.ReplaceAll(line, appDir+string(filepath.Separator), ""))
+				}
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMatchRoute(t *testing.T) {
+	tests := []struct {
+		route string
+		path  string
+		want  map[string]string
+		ok    bool
+	}{
+		{"/", "/", map[string]string{}, true},
+		{"/about", "/about", map[string]string{}, true},
+		{"/about", "/about/", nil, false},
+		{"/people/:id", "/people/42", map[string]string{"id": "42"}, true},
+		{"/people/:id", "/people/", nil, false},
+		{"/archive/:year?", "/archive", map[string]string{"year": ""}, true},
+		{"/archive/:year?", "/archive/2024", map[string]string{"year": "2024"}, true},
+		{"/docs/*path", "/docs/a/b/c", map[string]string{"path": "a/b/c"}, true},
+		{"/docs/*path", "/docs", nil, false},
+		{"/files/*path?/edit", "/files/a/b/edit", map[string]string{"path": "a/b"}, true},
+		{"/files/*path?/edit", "/files/edit", map[string]string{"path": ""}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.route+" "+tt.path, func(t *testing.T) {
+			got, ok := matchRoute(tt.route, tt.path)
+			if ok != tt.ok {
+				t.Fatalf("expected ok %v, got %v", tt.ok, ok)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPrecedenceReason(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want string
+	}{
+		{"/people/new", "/people/:id", `at segment 2, static segment "new" is more specific than single segment :id`},
+		{"/docs/:page", "/docs/*path", "at segment 2, single segment :page is more specific than rest segment *path"},
+		{"/archive/:year?", "/archive/*rest?", "at segment 2, optional segment :year? is more specific than optional rest segment *rest?"},
+		{"/archive/:year/:month?", "/archive/:year", "/archive/:year/:month? has more segments"},
+		{"/:a", "/:b", "the route was added first"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a, func(t *testing.T) {
+			if got := precedenceReason(tt.a, tt.b); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSortRouteTable(t *testing.T) {
+	routes := []string{
+		"/docs/*path",
+		"/people/:id",
+		"/",
+		"/people/new",
+		"/docs/:page",
+		"/about",
+		"/people/:id/edit",
+		"/:slug",
+	}
+	var table []*routeEntry
+	for _, r := range routes {
+		table = append(table, &routeEntry{route: r})
+	}
+	sortRouteTable(table)
+	var got []string
+	for _, e := range table {
+		got = append(got, e.route)
+	}
+	want := []string{
+		"/",
+		"/about",
+		"/docs/:page",
+		"/docs/*path",
+		"/people/new",
+		"/people/:id/edit",
+		"/people/:id",
+		"/:slug",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(-want +got):\n%s", diff)
+	}
+}
+
+func TestBuildRouteTable(t *testing.T) {
+	_, files := writeProjectFiles(t, map[string]string{
+		"pages/people/$id.up": "^param id int\n^query sort string\n^handler GET {}\n^handler POST {}\n<h1>Person</h1>",
+		"pages/plain.up":      "^layout !\n<p>plain</p>\n^partial row {<p>row</p>}",
+	})
+	table, err := buildRouteTable(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sortRouteTable(table)
+	type row struct {
+		Route   string
+		Line    int
+		Layout  string
+		Methods []string
+		Params  []pageParam
+	}
+	var got []row
+	for _, e := range table {
+		got = append(got, row{e.route, e.sourceLine(), e.layout, e.methods, e.params})
+	}
+	want := []row{
+		{"/people/:id", 1, "default", []string{"GET", "POST"}, []pageParam{
+			{name: "id", kind: routeParam, typ: "int"},
+			{name: "sort", kind: queryParam, typ: "string"},
+		}},
+		{"/plain/row", 3, "!", nil, nil},
+		{"/plain", 1, "!", nil, nil},
+	}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(pageParam{})); diff != "" {
+		t.Errorf("(-want +got):\n%s", diff)
+	}
+}
+
+func TestURLBuilderName(t *testing.T) {
+	tests := []struct {
+		route string
+		want  string
+	}{
+		{"/", "Index"},
+		{"/about", "About"},
+		{"/crud/", "CrudIndex"},
+		{"/crud/album/:id", "CrudAlbumId"},
+		{"/htmx/active-search/results", "HtmxActiveSearchResults"},
+		{"/docs/*path?", "DocsPath"},
+		{"/2024/recap", "Number2024Recap"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.route, func(t *testing.T) {
+			if got := urlBuilderName(tt.route); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestGenURLBuilders(t *testing.T) {
+	_, files := writeProjectFiles(t, map[string]string{
+		"pages/people/$id.up":      "^param id int\n^query sort string\n<h1>Person</h1>\n^partial edit {<p>edit</p>}",
+		"pages/docs/$...path.up":   "^param path []string",
+		"pages/$type.up":           "",
+		"pages/archive/$[year].up": "^param year int",
+		"pages/tags/$[tag].up":     "",
+		"pages/$my-id.up":          "",
+	})
+	table, err := buildRouteTable(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := genURLBuilders(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"func (urlBuilders) PeopleId(idParam int) string {\n\treturn routeURL(\"/people/:id\", idParam)\n}",
+		"func (urlBuilders) PeopleIdEdit(idParam int) string {\n\treturn routeURL(\"/people/:id/edit\", idParam)\n}",
+		"func (urlBuilders) DocsPath(pathParam []string) string {\n\treturn routeURL(\"/docs/*path\", pathParam)\n}",
+		"func (urlBuilders) Type(typeParam string) string {\n\treturn routeURL(\"/:type\", typeParam)\n}",
+		"func (urlBuilders) ArchiveYear(yearParam *int) string {\n\treturn routeURL(\"/archive/:year?\", yearParam)\n}",
+		"func (urlBuilders) TagsTag(tagParam *string) string {\n\treturn routeURL(\"/tags/:tag?\", tagParam)\n}",
+		"func (urlBuilders) MyId(param0 string) string {\n\treturn routeURL(\"/:my-id\", param0)\n}",
+	} {
+		if !strings.Contains(string(src), want) {
+			t.Errorf("expected generated code to contain %q, got:\n%s", want, src)
+		}
+	}
+}
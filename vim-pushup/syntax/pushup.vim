@@ -45,8 +45,8 @@ syn region pushupExplExpr start=/\^(/rs=s+1 end=/)/ skip=/\([^)]\|\\[)]\)/ exten
 
 " Since expression syntax is more generic than directive syntax and both are
 " regions, this needs to be defined after the expression rules.
-syn keyword pushupDirName import layout contained
-syn region pushupDirSimpl start=/\^\(import\|layout\)/ end=/$/ extend skipwhite matchgroup=NONE contains=pushupTranSym,pushupDirName,@golang nextgroup=pushupTranSym
+syn keyword pushupDirName import layout param query contained
+syn region pushupDirSimpl start=/\^\(import\|layout\|param\|query\)/ end=/$/ extend skipwhite matchgroup=NONE contains=pushupTranSym,pushupDirName,@golang nextgroup=pushupTranSym
 
 " htmlTop is defined by the standard vim HTML syntax file. This extends the
 " cluster of top-level identifiers, which allows them to be matched inside the
@@ -94,6 +94,11 @@ syn region pushupSection start=/\^section\s\+\S\+\s*{/ end=/}/ skip=/[^}]/ conta
 " syn keyword pushupTranSym ^
 syn match pushupTranSym /\^/ contained
 
+" Server-side comments are defined last so they take precedence over the
+" expression rules, which would otherwise match the leading caret.
+syn region pushupComment start=/\^\*/ end=/\*\^/ contains=@Spell keepend containedin=htmlHead,htmlTitle
+syn cluster htmlTop add=pushupComment
+
 syn sync fromstart
 
 highlight pushupCatchall guifg=yellow
@@ -117,5 +122,6 @@ highlight link pushupHandlerKey pushupKeyword
 highlight link pushupPartialKey pushupKeyword
 highlight link pushupSectionKey pushupKeyword
 highlight link pushupDirName pushupKeyword
+highlight link pushupComment Comment
 
 let b:current_syntax = 'pushup'